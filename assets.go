@@ -0,0 +1,9 @@
+package main
+
+import "embed"
+
+// assets is compiled into the binary so it runs from any directory, see
+// backend.NewAssets.
+//
+//go:embed static templates
+var assets embed.FS
@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Assets serves static/ and renders templates/ from either the copies
+// embedded in the binary or, for development, a directory on disk.
+//
+// Embedded files are content hashed, each reference in index.html and each
+// relative import carrying the version of the file it points to. A version
+// covers the file and every file it reaches through its references, so a
+// change anywhere below a file changes the URL it is loaded by. The JS
+// modules import each other in a cycle (app.js and chat.js), the files of a
+// cycle share a version. Versioned URLs are cached forever, everything else
+// is revalidated with the version as ETag.
+type Assets struct {
+	static    fs.FS
+	errorPage *template.Template
+	// versions holds the version of each file, nil when serving from disk
+	versions map[string]string
+	// rewritten holds the files whose references carry the versions
+	rewritten map[string][]byte
+}
+
+var (
+	htmlRef   = regexp.MustCompile(`((?:href|src)=")([^":/?]+\.(?:css|js))(")`)
+	importRef = regexp.MustCompile(`(from\s+['"])(\./[^'"?]+\.js)(['"])`)
+)
+
+// NewAssets loads the assets from files, which has static/ and templates/ at
+// its root, or from dir instead when it is not empty.
+func NewAssets(files fs.FS, dir string) (*Assets, error) {
+	if dir != "" {
+		files = os.DirFS(dir)
+	} else if files == nil {
+		return nil, fmt.Errorf("no embedded assets and no assets directory")
+	}
+
+	static, err := fs.Sub(files, "static")
+	if err != nil {
+		return nil, err
+	}
+	errorPage, err := template.ParseFS(files, "templates/error.html")
+	if err != nil {
+		return nil, err
+	}
+	A := &Assets{static: static, errorPage: errorPage}
+	if dir == "" {
+		if err := A.stamp(); err != nil {
+			return nil, err
+		}
+	}
+	return A, nil
+}
+
+// references returns the pattern of the references in the file name, nil
+// for the kinds of files that have none.
+func references(name string) *regexp.Regexp {
+	switch path.Ext(name) {
+	case ".html":
+		return htmlRef
+	case ".js":
+		return importRef
+	}
+	return nil
+}
+
+// stamp versions every static file and rewrites the references to them.
+func (A *Assets) stamp() error {
+	contents := make(map[string][]byte)
+	err := fs.WalkDir(A.static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(A.static, name)
+		if err != nil {
+			return err
+		}
+		contents[name] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The static files each one refers to, resolved from its directory
+	refs := make(map[string][]string)
+	for name, data := range contents {
+		pattern := references(name)
+		if pattern == nil {
+			continue
+		}
+		for _, match := range pattern.FindAllSubmatch(data, -1) {
+			ref := path.Join(path.Dir(name), string(match[2]))
+			if _, ok := contents[ref]; ok {
+				refs[name] = append(refs[name], ref)
+			}
+		}
+	}
+
+	A.versions = make(map[string]string)
+	for name := range contents {
+		A.versions[name] = version(name, contents, refs)
+	}
+
+	A.rewritten = make(map[string][]byte)
+	for name, data := range contents {
+		pattern := references(name)
+		if pattern == nil {
+			continue
+		}
+		A.rewritten[name] = pattern.ReplaceAllFunc(data, func(match []byte) []byte {
+			parts := pattern.FindSubmatch(match)
+			version, ok := A.versions[path.Join(path.Dir(name), string(parts[2]))]
+			if !ok {
+				return match
+			}
+			return slices.Concat(parts[1], parts[2], []byte("?v="+version), parts[3])
+		})
+	}
+	return nil
+}
+
+// version hashes name and every file it reaches through refs.
+func version(name string, contents map[string][]byte, refs map[string][]string) string {
+	reached := []string{name}
+	seen := map[string]bool{name: true}
+	for i := 0; i < len(reached); i++ {
+		for _, ref := range refs[reached[i]] {
+			if !seen[ref] {
+				seen[ref] = true
+				reached = append(reached, ref)
+			}
+		}
+	}
+	slices.Sort(reached)
+
+	hash := sha256.New()
+	for _, name := range reached {
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(contents[name]))
+		hash.Write(contents[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// ServeStatic serves a file from static/, / being index.html. Unknown paths
+// and directories get the error page.
+func (S *Server) ServeStatic(w http.ResponseWriter, r *http.Request) {
+	A := S.assets
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	info, err := fs.Stat(A.static, name)
+	if err != nil || info.IsDir() {
+		S.renderErrorPage(w, r, "Page Not Found", http.StatusNotFound)
+		return
+	}
+
+	if A.versions == nil {
+		// Straight from disk, always check for a newer copy
+		w.Header().Set("Cache-Control", "no-cache")
+		data, err := fs.ReadFile(A.static, name)
+		if err != nil {
+			S.renderErrorPage(w, r, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+		return
+	}
+
+	data, ok := A.rewritten[name]
+	if !ok {
+		data, err = fs.ReadFile(A.static, name)
+		if err != nil {
+			S.renderErrorPage(w, r, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	version := A.versions[name]
+	if r.URL.Query().Get("v") == version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", `"`+version+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// renderErrorPage shows templates/error.html to browsers and a plain text
+// error to fetch calls and other clients.
+func (S *Server) renderErrorPage(w http.ResponseWriter, r *http.Request, errMsg string, errCode int) {
+	if S.assets == nil || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, errMsg, errCode)
+		return
+	}
+
+	var page bytes.Buffer
+	err := S.assets.errorPage.Execute(&page, Error{Err: errMsg, ErrNumber: strconv.Itoa(errCode)})
+	if err != nil {
+		fmt.Println("Template Error:", err)
+		http.Error(w, errMsg, errCode)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(errCode)
+	page.WriteTo(w)
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testAssets is a static/ where a.js and b.js import each other and leaf.js
+// is imported by b.js alone.
+func testAssets() fstest.MapFS {
+	return fstest.MapFS{
+		"templates/error.html": {Data: []byte("{{.ErrNumber}} {{.Err}}")},
+		"static/index.html":    {Data: []byte(`<link href="style.css"><script src="a.js"></script>`)},
+		"static/style.css":     {Data: []byte("body {}")},
+		"static/a.js":          {Data: []byte("import { b } from './b.js';")},
+		"static/b.js":          {Data: []byte("import { a } from './a.js';\nimport { leaf } from './leaf.js';")},
+		"static/leaf.js":       {Data: []byte("export const leaf = 1;")},
+		"static/other.js":      {Data: []byte("export const other = 1;")},
+	}
+}
+
+func TestAssetVersions(t *testing.T) {
+	files := testAssets()
+	A, err := NewAssets(files, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := A.versions
+	if v["a.js"] != v["b.js"] {
+		t.Errorf("a.js and b.js import each other but have versions %s and %s", v["a.js"], v["b.js"])
+	}
+	if v["leaf.js"] == v["other.js"] || v["leaf.js"] == v["b.js"] || v["style.css"] == v["index.html"] {
+		t.Errorf("files share a version: %v", v)
+	}
+
+	// Each reference carries the version of the file it points to
+	for name, want := range map[string][]string{
+		"index.html": {`href="style.css?v=` + v["style.css"] + `"`, `src="a.js?v=` + v["a.js"] + `"`},
+		"b.js":       {`'./a.js?v=` + v["a.js"] + `'`, `'./leaf.js?v=` + v["leaf.js"] + `'`},
+	} {
+		for _, ref := range want {
+			if !strings.Contains(string(A.rewritten[name]), ref) {
+				t.Errorf("no %s in %s:\n%s", ref, name, A.rewritten[name])
+			}
+		}
+	}
+
+	// A change to a file changes the version of everything importing it,
+	// and nothing else
+	files["static/leaf.js"] = &fstest.MapFile{Data: []byte("export const leaf = 2;")}
+	changed, err := NewAssets(files, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		changes bool
+	}{
+		{"leaf.js", true},
+		{"b.js", true},
+		{"a.js", true},
+		{"index.html", true},
+		{"style.css", false},
+		{"other.js", false},
+	} {
+		if got := changed.versions[test.name] != v[test.name]; got != test.changes {
+			t.Errorf("%s: version changed %v, want %v", test.name, got, test.changes)
+		}
+	}
+}
+
+// getAsset requests target from S with the given If-None-Match.
+func getAsset(S *Server, target, ifNoneMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	S.ServeStatic(w, r)
+	return w
+}
+
+func TestServeStatic(t *testing.T) {
+	S := newTestServer(t)
+	A, err := NewAssets(testAssets(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	S.assets = A
+	leaf := A.versions["leaf.js"]
+
+	for _, test := range []struct {
+		name         string
+		target       string
+		ifNoneMatch  string
+		code         int
+		cacheControl string
+		etag         string
+	}{
+		{"versioned", "/leaf.js?v=" + leaf, "", http.StatusOK, "public, max-age=31536000, immutable", `"` + leaf + `"`},
+		{"unversioned", "/leaf.js", "", http.StatusOK, "no-cache", `"` + leaf + `"`},
+		{"version of another file", "/leaf.js?v=" + A.versions["other.js"], "", http.StatusOK, "no-cache", `"` + leaf + `"`},
+		{"still fresh", "/leaf.js", `"` + leaf + `"`, http.StatusNotModified, "no-cache", `"` + leaf + `"`},
+		{"stale", "/leaf.js", `"` + A.versions["other.js"] + `"`, http.StatusOK, "no-cache", `"` + leaf + `"`},
+		{"index", "/", "", http.StatusOK, "no-cache", `"` + A.versions["index.html"] + `"`},
+		{"unknown", "/missing.js", "", http.StatusNotFound, "", ""},
+	} {
+		w := getAsset(S, test.target, test.ifNoneMatch)
+		if w.Code != test.code {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.code)
+		}
+		if got := w.Header().Get("Cache-Control"); got != test.cacheControl {
+			t.Errorf("%s: Cache-Control %q, want %q", test.name, got, test.cacheControl)
+		}
+		if got := w.Header().Get("ETag"); got != test.etag {
+			t.Errorf("%s: ETag %q, want %q", test.name, got, test.etag)
+		}
+	}
+
+	if body := getAsset(S, "/", "").Body.String(); !strings.Contains(body, "a.js?v="+A.versions["a.js"]) {
+		t.Errorf("index.html served without its versioned references:\n%s", body)
+	}
+}
+
+func TestAssetsDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, file := range testAssets() {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, file.Data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The directory wins over the embedded files
+	embedded := testAssets()
+	embedded["static/leaf.js"] = &fstest.MapFile{Data: []byte("embedded")}
+	S := newTestServer(t)
+	A, err := NewAssets(embedded, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	S.assets = A
+
+	w := getAsset(S, "/", "")
+	if w.Header().Get("Cache-Control") != "no-cache" || w.Header().Get("ETag") != "" {
+		t.Errorf("Cache-Control %q, ETag %q from disk", w.Header().Get("Cache-Control"), w.Header().Get("ETag"))
+	}
+	if strings.Contains(w.Body.String(), "?v=") {
+		t.Errorf("versioned references from disk:\n%s", w.Body)
+	}
+
+	// Edits show up without a restart
+	for _, data := range []string{"export const leaf = 1;", "export const leaf = 2;"} {
+		if err := os.WriteFile(filepath.Join(dir, "static", "leaf.js"), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if body := getAsset(S, "/leaf.js", "").Body.String(); body != data {
+			t.Errorf("got %q, want %q", body, data)
+		}
+	}
+}
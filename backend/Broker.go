@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Kinds of BrokerEvent.
+const (
+	// EventSend delivers Frame to every session of To except the client
+	// with id Except.
+	EventSend = "send"
+	// EventBroadcast delivers Frame to every connected client.
+	EventBroadcast = "broadcast"
+	// EventPresence carries the users connected to one instance.
+	EventPresence = "presence"
+	// EventRevoke disconnects the clients of To that belong to Sessions.
+	EventRevoke = "revoke"
+)
+
+// BrokerEvent is what server instances tell each other. Frames are already
+// encoded so the broker never needs to know about the protocol.
+type BrokerEvent struct {
+	Kind string `json:"kind"`
+	// Instance is the server that published the event.
+	Instance string          `json:"instance"`
+	To       string          `json:"to,omitempty"`
+	Except   string          `json:"except,omitempty"`
+	Frame    json.RawMessage `json:"frame,omitempty"`
+	Users    []string        `json:"users,omitempty"`
+	Sessions []string        `json:"sessions,omitempty"`
+	// Sync asks every other instance to publish its presence right away,
+	// a server that just started sends it to learn who is online.
+	Sync bool `json:"sync,omitempty"`
+}
+
+// Broker carries fan-out between server instances. Every instance subscribes
+// and delivers the events to its own websocket clients, so a user connected
+// to one instance can be reached from any other. Events published by an
+// instance come back to it as well.
+type Broker interface {
+	Publish(event BrokerEvent) error
+	// Subscribe calls handler for every event published from now on, in
+	// the order they were published.
+	Subscribe(handler func(BrokerEvent)) error
+	Close() error
+}
+
+// openBroker returns the broker named in the configuration.
+func openBroker(kind, redisURL string) (Broker, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryBroker(), nil
+	case "redis":
+		return NewRedisBroker(redisURL, RedisChannel)
+	}
+	return nil, fmt.Errorf("unknown broker %q", kind)
+}
+
+// MemoryBroker hands events straight to the subscribers in the same process,
+// it is all a single instance needs.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []func(BrokerEvent)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (M *MemoryBroker) Publish(event BrokerEvent) error {
+	M.mu.RLock()
+	handlers := M.handlers
+	M.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (M *MemoryBroker) Subscribe(handler func(BrokerEvent)) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.handlers = append(M.handlers, handler)
+	return nil
+}
+
+func (M *MemoryBroker) Close() error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.handlers = nil
+	return nil
+}
@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Client struct {
+	ID       string          `json:"id"` // Added ID field
+	Conn     *websocket.Conn `json:"-"`  // Added json:"-" to exclude from JSON
+	Username string          `json:"username"`
+	// Session is the public id of the login the client connected with.
+	Session string `json:"-"`
+
+	// send is the outbound queue, only writePump writes to Conn.
+	send      chan []byte
+	config    WSConfig
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+}
+
+func newClient(id string, conn *websocket.Conn, username string, config WSConfig) *Client {
+	return &Client{
+		ID:       id,
+		Conn:     conn,
+		Username: username,
+		send:     make(chan []byte, config.SendQueueSize),
+		config:   config,
+		done:     make(chan struct{}),
+	}
+}
+
+// startHeartbeat arms the read deadline and pushes it forward on every pong.
+// A half-open connection stops answering pings, its next read times out and
+// the read loop runs the usual disconnect cleanup.
+func (c *Client) startHeartbeat() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+	})
+}
+
+// Send queues v for delivery without blocking. A client whose queue is full
+// is not keeping up, so it gets disconnected instead of holding everyone back.
+func (c *Client) Send(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Encode Error:", err)
+		return false
+	}
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return true
+	default:
+		fmt.Println("Send queue full, evicting", c.Username, c.ID)
+		c.Close(websocket.ClosePolicyViolation, "send queue overflow")
+		return false
+	}
+}
+
+// Close asks the write pump to send a close frame and drop the connection.
+// It is safe to call more than once and from any goroutine.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.done)
+	})
+}
+
+// writePump is the only goroutine allowed to write to the connection. It
+// also sends the periodic pings that keep the read deadline alive.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.config.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+			if err := c.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				fmt.Println("WebSocket Write Error:", err)
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				fmt.Println("WebSocket Ping Error:", err)
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			c.Conn.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(c.config.WriteWait))
+			return
+		}
+	}
+}
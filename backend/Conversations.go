@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// loadConversations returns every other user and the viewer's groups, most
+// recent conversation first and the ones without messages alphabetically
+// after them.
+func (s *Server) loadConversations(viewer string) ([]Conversation, error) {
+	conversations, err := s.Store.Conversations(viewer)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.Store.GroupConversations(viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range conversations {
+		conversations[i].Online = s.isOnline(conversations[i].Nickname)
+	}
+	conversations = append(conversations, groups...)
+	sort.SliceStable(conversations, func(i, j int) bool {
+		a, b := conversations[i], conversations[j]
+		if a.LastMessageID != b.LastMessageID {
+			return a.LastMessageID > b.LastMessageID
+		}
+		return strings.ToLower(a.title()) < strings.ToLower(b.title())
+	})
+	return conversations, nil
+}
+
+// title is what the sidebar shows, the user's nickname or the group's name.
+func (c Conversation) title() string {
+	if c.GroupID != 0 {
+		return c.Name
+	}
+	return c.Nickname
+}
+
+// sendConversation pushes viewer's sidebar entry for other to all of viewer's
+// sessions.
+func (s *Server) sendConversation(viewer, other string) {
+	if !s.isOnline(viewer) {
+		return
+	}
+
+	conversation, err := s.Store.Conversation(viewer, other)
+	if err != nil {
+		fmt.Println("DB Conversation Error:", err)
+		return
+	}
+	conversation.Online = s.isOnline(other)
+	s.sendTo(viewer, NewFrame(FrameConversation, conversation), nil)
+}
+
+// sendGroupConversation pushes the member's sidebar entry for a group to all
+// of the member's sessions.
+func (s *Server) sendGroupConversation(member string, groupID int64) {
+	if !s.isOnline(member) {
+		return
+	}
+
+	conversation, err := s.Store.GroupConversation(member, groupID)
+	if err != nil {
+		fmt.Println("DB Conversation Error:", err)
+		return
+	}
+	s.sendTo(member, NewFrame(FrameConversation, conversation), nil)
+}
@@ -1,92 +1,65 @@
 package backend
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 	"os"
-
-	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"strconv"
 )
 
-func MakeDataBase() {
-	if err := os.MkdirAll("database", os.ModePerm); err != nil {
-		log.Fatalf("Failed to create database directory: %v", err)
-	}
-
-	db, err := sql.Open("sqlite3", "database/forum.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+func MakeDataBase(driver, dsn string) {
+	store := openDataBase(driver, dsn)
+	defer store.Close()
 
-	table, err := createTables(db)
-	if err != nil {
-		log.Fatalf("Failed to create tables in %d: %v ", table, err)
+	if err := store.Migrate(LatestVersion()); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
 	fmt.Println("Database and tables created successfully!")
 }
 
-func createTables(db *sql.DB) (int, error) {
-	tables := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		nickname TEXT UNIQUE,
-		first_name TEXT,
-		last_name TEXT,
-		email TEXT UNIQUE,
-		password TEXT,
-		age INTEGER,
-		gender TEXT
-	)`,
-		`CREATE TABLE IF NOT EXISTS posts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER,
-		title TEXT,
-		content TEXT,
-		category TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	)`,
-
-		`CREATE TABLE IF NOT EXISTS comments (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		post_id INTEGER,
-		user_id INTEGER,
-		content TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY(post_id) REFERENCES posts(id),
-		FOREIGN KEY(user_id) REFERENCES users(id)
-	)`,
+// RunMigrations handles the -migrate command: "up" goes to the latest
+// version, "down" undoes the last migration and a number migrates to exactly
+// that version.
+func RunMigrations(driver, dsn, command string) error {
+	store := openDataBase(driver, dsn)
+	defer store.Close()
 
-		`CREATE TABLE IF NOT EXISTS messages (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	sender TEXT,
-	receiver TEXT,
-	content TEXT,
-	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	)`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-    session_id TEXT PRIMARY KEY,
-    nickname TEXT,
-    expires_at DATETIME,
-    FOREIGN KEY(nickname) REFERENCES users(nickname)
-	)`,
-		`CREATE TABLE IF NOT EXISTS notifications (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	receiver_nickname TEXT,
-	sender_nickname TEXT,
-	unread_messages INTEGER DEFAULT 0,
-	FOREIGN KEY(receiver_nickname) REFERENCES users(nickname),
-	FOREIGN KEY(sender_nickname) REFERENCES users(nickname)
-	)`}
+	current, err := store.SchemaVersion()
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < len(tables); i++ {
-		_, err := db.Exec(tables[i])
+	target := LatestVersion()
+	switch command {
+	case "up":
+	case "down":
+		target = max(current-1, 0)
+	default:
+		target, err = strconv.Atoi(command)
 		if err != nil {
-			return i + 1, err
+			return fmt.Errorf("expected up, down or a version number, got %q", command)
 		}
 	}
-	return 0, nil
+
+	if err := store.Migrate(target); err != nil {
+		return err
+	}
+	fmt.Println("Database schema is at version", target)
+	return nil
+}
+
+func openDataBase(driver, dsn string) *SQLStore {
+	if driver == SQLite.Driver {
+		if err := os.MkdirAll(filepath.Dir(dsn), os.ModePerm); err != nil {
+			log.Fatalf("Failed to create database directory: %v", err)
+		}
+	}
+
+	store, err := NewSQLStore(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
 }
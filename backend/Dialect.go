@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect papers over the differences between the SQL databases the forum
+// can run on. Queries and schema are written for SQLite and translated.
+type Dialect struct {
+	Driver string
+	// numbered placeholders ($1, $2...) instead of ?
+	numbered bool
+	schema   *strings.Replacer
+}
+
+var (
+	SQLite   = Dialect{Driver: "sqlite3", schema: strings.NewReplacer()}
+	Postgres = Dialect{
+		Driver:   "postgres",
+		numbered: true,
+		schema: strings.NewReplacer(
+			"INTEGER PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY",
+			"DATETIME", "TIMESTAMPTZ",
+		),
+	}
+)
+
+func DialectFor(driver string) (Dialect, error) {
+	switch driver {
+	case SQLite.Driver:
+		return SQLite, nil
+	case Postgres.Driver:
+		return Postgres, nil
+	}
+	return Dialect{}, fmt.Errorf("unsupported database driver %q", driver)
+}
+
+// Rebind rewrites ? placeholders for drivers that number them. A ? inside a
+// quoted string or identifier is left alone, a doubled quote inside one
+// closes and reopens it, which comes to the same.
+func (d Dialect) Rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Schema translates SQLite DDL.
+func (d Dialect) Schema(ddl string) string {
+	return d.schema.Replace(ddl)
+}
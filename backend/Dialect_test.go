@@ -0,0 +1,58 @@
+package backend
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	for _, test := range []struct {
+		query, postgres string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM users WHERE nickname = ? OR email = ?", "SELECT * FROM users WHERE nickname = $1 OR email = $2"},
+		{"INSERT INTO t (a, b, c) VALUES (?, ?, ?)", "INSERT INTO t (a, b, c) VALUES ($1, $2, $3)"},
+		{"SELECT '?' FROM t WHERE a = ?", "SELECT '?' FROM t WHERE a = $1"},
+		{"SELECT 'what?', ? FROM t WHERE b = 'it''s ?' AND c = ?", "SELECT 'what?', $1 FROM t WHERE b = 'it''s ?' AND c = $2"},
+		{`SELECT "odd?column" FROM t WHERE a = ?`, `SELECT "odd?column" FROM t WHERE a = $1`},
+		{"SELECT '\"' FROM t WHERE a = ?", "SELECT '\"' FROM t WHERE a = $1"},
+		{"UPDATE t SET a = ? WHERE id = ? RETURNING id", "UPDATE t SET a = $1 WHERE id = $2 RETURNING id"},
+	} {
+		if got := SQLite.Rebind(test.query); got != test.query {
+			t.Errorf("SQLite.Rebind(%q) = %q, want it unchanged", test.query, got)
+		}
+		if got := Postgres.Rebind(test.query); got != test.postgres {
+			t.Errorf("Postgres.Rebind(%q) = %q, want %q", test.query, got, test.postgres)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	ddl := `CREATE TABLE t (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		other INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		done BOOLEAN NOT NULL DEFAULT FALSE
+	)`
+	if got := SQLite.Schema(ddl); got != ddl {
+		t.Errorf("SQLite.Schema changed the DDL to %q", got)
+	}
+	want := `CREATE TABLE t (
+		id SERIAL PRIMARY KEY,
+		other INTEGER NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		done BOOLEAN NOT NULL DEFAULT FALSE
+	)`
+	if got := Postgres.Schema(ddl); got != want {
+		t.Errorf("Postgres.Schema = %q, want %q", got, want)
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	for _, d := range []Dialect{SQLite, Postgres} {
+		got, err := DialectFor(d.Driver)
+		if err != nil || got.Driver != d.Driver {
+			t.Errorf("DialectFor(%q) = %v, %v", d.Driver, got.Driver, err)
+		}
+	}
+	if _, err := DialectFor("mysql"); err == nil {
+		t.Error("DialectFor accepted mysql")
+	}
+}
@@ -0,0 +1,261 @@
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Purposes of the tokens mailed to users, each one is also the query
+// parameter carrying the token in the link.
+const (
+	TokenReset  = "reset"
+	TokenVerify = "verify"
+)
+
+// MinPasswordLength matches what the registration form asks for.
+const MinPasswordLength = 8
+
+// MaxEmailTokens is how many links of one kind a user can have outstanding,
+// mailing another one drops the oldest.
+const MaxEmailTokens = 3
+
+// Reset and verification mails asked for within MailRequestWindow are
+// limited to MaxAccountMails for one account and MaxIPMails from one address.
+const (
+	MailRequestWindow = time.Hour
+	MaxAccountMails   = 3
+	MaxIPMails        = 10
+)
+
+// emailTokens describes the mail sent for each token purpose. The body is
+// formatted with the nickname and the link.
+var emailTokens = map[string]struct {
+	lifetime time.Duration
+	subject  string
+	body     string
+}{
+	TokenReset: {
+		lifetime: time.Hour,
+		subject:  "Reset your password",
+		body: "Hello %s,\n\nsomeone, hopefully you, asked to reset your password. Choose a new one at\n\n%s\n\n" +
+			"The link works once, within the hour. If it was not you, you can ignore this email.\n",
+	},
+	TokenVerify: {
+		lifetime: 48 * time.Hour,
+		subject:  "Confirm your email address",
+		body:     "Welcome %s,\n\nplease confirm your email address at\n\n%s\n\nThe link works once, within two days.\n",
+	},
+}
+
+// hashToken is how tokens handed to users are stored, a leaked table does
+// not give them away.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// mailToken mails nickname a link with a new single-use token. The mail goes
+// out in the background, the response does not wait for the mail server.
+func (S *Server) mailToken(nickname, purpose string) error {
+	kind := emailTokens[purpose]
+	email, _, err := S.Store.UserEmail(nickname)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	now := S.now()
+	if err := S.Store.CreateEmailToken(hashToken(token), nickname, purpose, now, now.Add(kind.lifetime)); err != nil {
+		return err
+	}
+
+	// Both were escaped on the way into the database
+	mail := Mail{
+		To:      html.UnescapeString(email),
+		Subject: kind.subject,
+		Body:    fmt.Sprintf(kind.body, html.UnescapeString(nickname), S.Config.PublicURL+"/?"+purpose+"="+token),
+	}
+	S.mails.Add(1)
+	go func() {
+		defer S.mails.Done()
+		if err := S.Mailer.Send(mail); err != nil {
+			fmt.Println("Mail Error:", err)
+		}
+	}()
+	return nil
+}
+
+// ForgotPasswordHandler mails a reset link to the account with the given
+// nickname or email. It answers the same whether there is one or not.
+func (S *Server) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := emailRequest(w, r)
+	if !ok {
+		return
+	}
+	nickname, _, err := S.Store.GetCredentials(request.Identifier)
+	if !S.throttleMail(w, r, request.Identifier, nickname) {
+		return
+	}
+	if err == nil {
+		err = S.mailToken(nickname, TokenReset)
+	}
+	if err != nil && err != ErrNoRecord {
+		fmt.Println("Mail Error:", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPasswordHandler sets a new password with a token from a reset mail
+// and ends every session of the account. Any other reset link mailed to the
+// account stops working with it. Getting the mail proves the address, so it
+// counts as verified too.
+func (S *Server) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := emailRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(request.Password) < MinPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", MinPasswordLength), http.StatusBadRequest)
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	nickname, err := S.Store.ResetPassword(hashToken(request.Token), string(hashedPassword), S.now())
+	if err == ErrNoRecord {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sessions, err := S.Store.DeleteOtherSessions(nickname, "")
+	if err != nil {
+		fmt.Println("DB Session Error:", err)
+	}
+	S.disconnectSessions(nickname, sessions...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmailHandler marks an email address verified with the token from
+// the verification mail.
+func (S *Server) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := emailRequest(w, r)
+	if !ok {
+		return
+	}
+	nickname, err := S.Store.UseEmailToken(hashToken(request.Token), TokenVerify, S.now())
+	if err == ErrNoRecord {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = S.Store.SetEmailVerified(nickname)
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendVerificationHandler mails a new verification link to an account
+// that is not verified yet, answering the same either way.
+func (S *Server) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := emailRequest(w, r)
+	if !ok {
+		return
+	}
+	nickname, _, err := S.Store.GetCredentials(request.Identifier)
+	if !S.throttleMail(w, r, request.Identifier, nickname) {
+		return
+	}
+	if err == nil {
+		var verified bool
+		_, verified, err = S.Store.UserEmail(nickname)
+		if err == nil && !verified {
+			err = S.mailToken(nickname, TokenVerify)
+		}
+	}
+	if err != nil && err != ErrNoRecord {
+		fmt.Println("Mail Error:", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// throttleMail limits how many mails can be asked for to one account, its
+// nickname or else the identifier as typed, and from one address. It reports
+// whether the request may go on and answers it when not.
+func (S *Server) throttleMail(w http.ResponseWriter, r *http.Request, identifier, nickname string) bool {
+	account := nickname
+	if account == "" {
+		account = identifier
+	}
+	ip, now := S.clientIP(r), S.now()
+	since := now.Add(-MailRequestWindow)
+
+	accountRequests, accountOldest, err := S.Store.AccountMailRequests(account, since)
+	if err != nil {
+		fmt.Println("DB Mail Error:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	ipRequests, ipOldest, err := S.Store.IPMailRequests(ip, since)
+	if err != nil {
+		fmt.Println("DB Mail Error:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+
+	// Refused requests are not recorded, so each limit lifts once its
+	// oldest request leaves the window
+	var wait time.Duration
+	if accountRequests >= MaxAccountMails {
+		wait = accountOldest.Add(MailRequestWindow).Sub(now)
+	}
+	if ipRequests >= MaxIPMails {
+		wait = max(wait, ipOldest.Add(MailRequestWindow).Sub(now))
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many emails asked for, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	if err := S.Store.RecordMailRequest(account, ip, now); err != nil {
+		fmt.Println("DB Mail Error:", err)
+	}
+	return true
+}
+
+// emailRequest checks the method of a POST to one of the password and email
+// endpoints, none of which need a session, and decodes its body.
+func emailRequest(w http.ResponseWriter, r *http.Request) (EmailRequest, bool) {
+	var request EmailRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return request, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return request, false
+	}
+	return request, true
+}
@@ -0,0 +1,294 @@
+package backend
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureMailer keeps the mails instead of sending them.
+type captureMailer struct {
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func (M *captureMailer) Send(mail Mail) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.mails = append(M.mails, mail)
+	return nil
+}
+
+var tokenLink = regexp.MustCompile(`/\?(reset|verify)=([A-Za-z0-9_-]+)`)
+
+// mailServer is a test server that keeps the mails it sends, on a clock that
+// only moves when the test calls the returned function.
+type mailServer struct {
+	*Server
+	t      *testing.T
+	mailer *captureMailer
+}
+
+func newMailServer(t *testing.T, nicknames ...string) (*mailServer, func(time.Duration)) {
+	t.Helper()
+	S := newTestServer(t, nicknames...)
+	mailer := &captureMailer{}
+	S.Mailer = mailer
+	now := time.Now()
+	S.clock = func() time.Time { return now }
+	return &mailServer{Server: S, t: t, mailer: mailer}, func(d time.Duration) { now = now.Add(d) }
+}
+
+// request posts an EmailRequest from ip and waits for the mails it sent.
+func (M *mailServer) request(handler http.HandlerFunc, target string, request EmailRequest, ip string) int {
+	w := post(handler, target, request, ip)
+	M.Server.mails.Wait()
+	return w.Code
+}
+
+// sent returns the mails sent since the last call.
+func (M *mailServer) sent() []Mail {
+	M.mailer.mu.Lock()
+	defer M.mailer.mu.Unlock()
+
+	mails := M.mailer.mails
+	M.mailer.mails = nil
+	return mails
+}
+
+// token asks for a mail to identifier and returns the token in its link.
+func (M *mailServer) token(handler http.HandlerFunc, target, identifier string) string {
+	M.t.Helper()
+	if code := M.request(handler, target, EmailRequest{Identifier: identifier}, "192.0.2.1"); code != http.StatusAccepted {
+		M.t.Fatalf("asking for a mail: status %d", code)
+	}
+	mails := M.sent()
+	if len(mails) != 1 {
+		M.t.Fatalf("%d mails sent, want 1", len(mails))
+	}
+	link := tokenLink.FindStringSubmatch(mails[0].Body)
+	if link == nil {
+		M.t.Fatalf("no link in %q", mails[0].Body)
+	}
+	return link[2]
+}
+
+func (M *mailServer) reset(token, password string) int {
+	return M.request(M.ResetPasswordHandler, "/password/reset", EmailRequest{Token: token, Password: password}, "192.0.2.1")
+}
+
+func TestResetPassword(t *testing.T) {
+	M, _ := newMailServer(t, "alice")
+	if err := M.Store.CreateSession("alice2", "alice", "test", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// A websocket of each session, connected to this instance
+	M.hub = NewHub(WSConfig{})
+	M.Broker = NewMemoryBroker()
+	M.Broker.Subscribe(M.handleEvent)
+	clients := []*Client{testClient(M.hub, "1", "alice"), testClient(M.hub, "2", "alice")}
+	clients[0].Session = sessionHandle("alice")
+	clients[1].Session = sessionHandle("alice2")
+	for _, client := range clients {
+		M.hub.Register(client)
+	}
+
+	first := M.token(M.ForgotPasswordHandler, "/password/forgot", "alice@example.com")
+	second := M.token(M.ForgotPasswordHandler, "/password/forgot", "alice")
+
+	if code := M.reset(second, "short"); code != http.StatusBadRequest {
+		t.Fatalf("too short a password: status %d", code)
+	}
+	if code := M.reset(second, "a new password"); code != http.StatusNoContent {
+		t.Fatalf("reset: status %d", code)
+	}
+
+	// Every session ends and its websockets close
+	for _, session := range []string{"alice", "alice2"} {
+		if _, err := M.Store.SessionUser(session); err != ErrNoRecord {
+			t.Errorf("session %s: error %v after the reset", session, err)
+		}
+	}
+	for _, client := range clients {
+		if !isClosed(client) {
+			t.Errorf("websocket of session %s still open", client.Session)
+		}
+	}
+
+	// Neither this link nor any other one mailed before works again
+	for _, token := range []string{second, first} {
+		if code := M.reset(token, "another password"); code != http.StatusBadRequest {
+			t.Errorf("reusing a link: status %d", code)
+		}
+	}
+	if code := M.reset("made up", "another password"); code != http.StatusBadRequest {
+		t.Errorf("unknown token: status %d", code)
+	}
+
+	if w := login(M.Server, "alice", testPassword, "192.0.2.1"); w.Code != http.StatusUnauthorized {
+		t.Errorf("old password: status %d", w.Code)
+	}
+	if w := login(M.Server, "alice", "a new password", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("new password: status %d", w.Code)
+	}
+}
+
+func TestEmailTokensExpire(t *testing.T) {
+	M, wait := newMailServer(t, "alice")
+
+	reset := M.token(M.ForgotPasswordHandler, "/password/forgot", "alice")
+	verify := M.token(M.ResendVerificationHandler, "/email/resend", "alice")
+	wait(time.Hour)
+	if code := M.reset(reset, "a new password"); code != http.StatusBadRequest {
+		t.Errorf("reset link after an hour: status %d", code)
+	}
+	wait(47 * time.Hour)
+	if code := M.request(M.VerifyEmailHandler, "/email/verify", EmailRequest{Token: verify}, "192.0.2.1"); code != http.StatusBadRequest {
+		t.Errorf("verification link after two days: status %d", code)
+	}
+
+	// Tokens are for one purpose only
+	verify = M.token(M.ResendVerificationHandler, "/email/resend", "alice")
+	if code := M.reset(verify, "a new password"); code != http.StatusBadRequest {
+		t.Errorf("verification link to reset: status %d", code)
+	}
+}
+
+func TestMailRequestsLookAlike(t *testing.T) {
+	M, _ := newMailServer(t, "alice")
+
+	for _, test := range []struct {
+		handler    http.HandlerFunc
+		target     string
+		identifier string
+		mails      int
+	}{
+		{M.ForgotPasswordHandler, "/password/forgot", "alice", 1},
+		{M.ForgotPasswordHandler, "/password/forgot", "nobody", 0},
+		{M.ForgotPasswordHandler, "/password/forgot", "nobody@example.com", 0},
+		{M.ResendVerificationHandler, "/email/resend", "alice", 1},
+		{M.ResendVerificationHandler, "/email/resend", "nobody", 0},
+	} {
+		w := post(test.handler, test.target, EmailRequest{Identifier: test.identifier}, "192.0.2.1")
+		M.Server.mails.Wait()
+		if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+			t.Errorf("%s for %s: status %d, body %q", test.target, test.identifier, w.Code, w.Body)
+		}
+		if mails := M.sent(); len(mails) != test.mails {
+			t.Errorf("%s for %s: %d mails sent, want %d", test.target, test.identifier, len(mails), test.mails)
+		}
+	}
+}
+
+func TestMailRequestsThrottled(t *testing.T) {
+	M, wait := newMailServer(t, "alice", "bob")
+
+	forgot := func(identifier, ip string) int {
+		return M.request(M.ForgotPasswordHandler, "/password/forgot", EmailRequest{Identifier: identifier}, ip)
+	}
+	for i := 0; i < MaxAccountMails; i++ {
+		if code := forgot("alice", "192.0.2.1"); code != http.StatusAccepted {
+			t.Fatalf("request %d: status %d", i, code)
+		}
+		wait(time.Minute)
+	}
+	// By any name and from anywhere
+	w := post(M.ForgotPasswordHandler, "/password/forgot", EmailRequest{Identifier: "alice@example.com"}, "192.0.2.2")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3420" {
+		t.Fatalf("one request too many: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	M.sent()
+
+	// Logging in is not affected
+	if w := login(M.Server, "alice", testPassword, "192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatalf("login: status %d", w.Code)
+	}
+
+	wait(MailRequestWindow - 2*time.Minute)
+	if code := forgot("alice", "192.0.2.1"); code != http.StatusAccepted {
+		t.Fatalf("once the first request is out of the window: status %d", code)
+	}
+
+	// Unknown accounts count per address as well
+	for i := 0; i < MaxIPMails; i++ {
+		forgot("nobody"+string(rune('a'+i)), "192.0.2.3")
+	}
+	if code := forgot("bob", "192.0.2.3"); code != http.StatusTooManyRequests {
+		t.Fatalf("one request too many from an address: status %d", code)
+	}
+	if code := forgot("bob", "192.0.2.4"); code != http.StatusAccepted {
+		t.Fatalf("from another address: status %d", code)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	M, _ := newMailServer(t, "alice")
+	M.Config.RequireVerifiedEmail = true
+
+	if w := login(M.Server, "alice", testPassword, "192.0.2.1"); w.Code != http.StatusForbidden {
+		t.Fatalf("login before verifying: status %d", w.Code)
+	}
+	// Wrong passwords do not give away that the address is not verified
+	if w := login(M.Server, "alice", "wrong", "192.0.2.1"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", w.Code)
+	}
+
+	token := M.token(M.ResendVerificationHandler, "/email/resend", "alice")
+	if code := M.request(M.VerifyEmailHandler, "/email/verify", EmailRequest{Token: token}, "192.0.2.1"); code != http.StatusNoContent {
+		t.Fatalf("verify: status %d", code)
+	}
+	if code := M.request(M.VerifyEmailHandler, "/email/verify", EmailRequest{Token: token}, "192.0.2.1"); code != http.StatusBadRequest {
+		t.Fatalf("verifying twice: status %d", code)
+	}
+	if w := login(M.Server, "alice", testPassword, "192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatalf("login once verified: status %d", w.Code)
+	}
+
+	// Nothing more to verify, nothing is sent
+	M.request(M.ResendVerificationHandler, "/email/resend", EmailRequest{Identifier: "alice"}, "192.0.2.1")
+	if mails := M.sent(); len(mails) != 0 {
+		t.Fatalf("%d verification mails to a verified address", len(mails))
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	mailer := NewLogMailer(path, "forum@example.com")
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		err := mailer.Send(Mail{To: to, Subject: "Hello", Body: "http://localhost:8080/?verify=" + to})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mailer.Send(Mail{To: "eve@example.com\r\nBcc: mallory@example.com", Subject: "Hello"}); err == nil {
+		t.Error("logged a mail to an invalid recipient")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	for _, want := range []string{
+		"From: forum@example.com\r\nTo: alice@example.com\r\nSubject: Hello\r\n",
+		"http://localhost:8080/?verify=alice@example.com",
+		"To: bob@example.com\r\n",
+		"http://localhost:8080/?verify=bob@example.com",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("no %q in the log:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "eve") {
+		t.Errorf("the invalid mail was logged:\n%s", log)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("log file mode %v, %v", info.Mode().Perm(), err)
+	}
+}
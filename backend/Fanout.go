@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every instance republishes its presence this often, and forgets an instance
+// it has not heard from for PresenceTTL, e.g. because it crashed.
+const (
+	PresenceInterval = 15 * time.Second
+	PresenceTTL      = 3 * PresenceInterval
+)
+
+type instancePresence struct {
+	users map[string]bool
+	seen  time.Time
+}
+
+// presence is who is connected to the other instances.
+type presence struct {
+	mu        sync.Mutex
+	instances map[string]instancePresence
+}
+
+func newPresence() *presence {
+	return &presence{instances: make(map[string]instancePresence)}
+}
+
+// update stores an instance's users and reports whether they changed.
+func (p *presence) update(instance string, users []string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old, known := p.instances[instance]
+	if len(users) == 0 {
+		delete(p.instances, instance)
+		return known && len(old.users) > 0
+	}
+
+	current := instancePresence{users: make(map[string]bool, len(users)), seen: time.Now()}
+	for _, user := range users {
+		current.users[user] = true
+	}
+	p.instances[instance] = current
+
+	if len(old.users) != len(current.users) {
+		return true
+	}
+	for user := range current.users {
+		if !old.users[user] {
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops instances that went quiet and reports whether any did.
+func (p *presence) expire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expired := false
+	for instance, state := range p.instances {
+		if time.Since(state.seen) > PresenceTTL {
+			delete(p.instances, instance)
+			expired = true
+		}
+	}
+	return expired
+}
+
+func (p *presence) isOnline(username string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, state := range p.instances {
+		if state.users[username] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *presence) usernames() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var usernames []string
+	for _, state := range p.instances {
+		for user := range state.users {
+			usernames = append(usernames, user)
+		}
+	}
+	return usernames
+}
+
+// sendTo delivers v to every session of username, on whichever instance they
+// are connected, except the given client, which may be nil.
+func (S *Server) sendTo(username string, v interface{}, except *Client) {
+	event := BrokerEvent{Kind: EventSend, To: username}
+	if except != nil {
+		event.Except = except.ID
+	}
+	S.publishFrame(event, v)
+}
+
+// broadcast delivers v to every client of every instance.
+func (S *Server) broadcast(v interface{}) {
+	S.publishFrame(BrokerEvent{Kind: EventBroadcast}, v)
+}
+
+func (S *Server) publishFrame(event BrokerEvent, v interface{}) {
+	frame, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Encode Error:", err)
+		return
+	}
+	event.Instance = S.instance
+	event.Frame = frame
+
+	if err := S.Broker.Publish(event); err != nil {
+		// The local clients can still be served without the broker
+		fmt.Println("Broker Publish Error:", err)
+		S.handleEvent(event)
+	}
+}
+
+// handleEvent delivers an event from the broker to the local clients.
+func (S *Server) handleEvent(event BrokerEvent) {
+	switch event.Kind {
+	case EventSend:
+		S.hub.SendTo(event.To, event.Frame, event.Except)
+	case EventBroadcast:
+		S.hub.Broadcast(event.Frame)
+	case EventRevoke:
+		S.hub.CloseSessions(event.To, event.Sessions, websocket.ClosePolicyViolation, SessionRevokedReason)
+	case EventPresence:
+		if event.Instance == S.instance {
+			return
+		}
+		if event.Sync {
+			S.publishPresence(false)
+		}
+		if S.presence.update(event.Instance, event.Users) {
+			S.sendUserList()
+		}
+	}
+}
+
+// publishPresence tells the other instances who is connected here.
+func (S *Server) publishPresence(sync bool) {
+	err := S.Broker.Publish(BrokerEvent{
+		Kind:     EventPresence,
+		Instance: S.instance,
+		Users:    S.hub.Usernames(),
+		Sync:     sync,
+	})
+	if err != nil {
+		fmt.Println("Broker Publish Error:", err)
+	}
+}
+
+// presenceLoop keeps this instance's presence fresh on the others and drops
+// instances that stopped talking, until stop is closed.
+func (S *Server) presenceLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(PresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			S.publishPresence(false)
+			if S.presence.expire() {
+				S.sendUserList()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// onlineUsers is everyone connected to any instance.
+func (S *Server) onlineUsers() []string {
+	seen := make(map[string]bool)
+	usernames := []string{}
+	for _, user := range append(S.hub.Usernames(), S.presence.usernames()...) {
+		if !seen[user] {
+			seen[user] = true
+			usernames = append(usernames, user)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+func (S *Server) isOnline(username string) bool {
+	return S.hub.IsOnline(username) || S.presence.isOnline(username)
+}
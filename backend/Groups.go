@@ -0,0 +1,303 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// MaxGroupNameLength bounds a group's name.
+const MaxGroupNameLength = 64
+
+// checkMember reports whether the client's user belongs to the group, when
+// not the frame is answered with an error.
+func (s *Server) checkMember(client *Client, frameID string, groupID int64) bool {
+	group, err := s.Store.Group(groupID)
+	if err != nil && err != ErrNoRecord {
+		fmt.Println("DB Group Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "group could not be loaded"))
+		return false
+	}
+	if err == ErrNoRecord || !slices.Contains(group.Members, client.Username) {
+		client.Send(ErrorFrame(frameID, ErrNotFound, "no such group for this user"))
+		return false
+	}
+	return true
+}
+
+// sendToGroup delivers v to every session of every member of the group except
+// the given client, which may be nil.
+func (s *Server) sendToGroup(groupID int64, v interface{}, except *Client) {
+	group, err := s.Store.Group(groupID)
+	if err != nil {
+		fmt.Println("DB Group Error:", err)
+		return
+	}
+	for _, member := range group.Members {
+		s.sendTo(member, v, except)
+	}
+}
+
+// deliverGroupMessage sends a stored group message to every member, numbered
+// in their own sequence, except the sending client which already got the ack.
+func (s *Server) deliverGroupMessage(client *Client, msg Message, seqs map[string]int64) {
+	for member, seq := range seqs {
+		received := msg
+		received.Seq = seq
+		s.sendTo(member, NewFrame(FrameMessage, received), client)
+	}
+	for member := range seqs {
+		if member != msg.From {
+			s.sendGroupUnread(member, msg.GroupID)
+		}
+		s.sendGroupConversation(member, msg.GroupID)
+	}
+}
+
+// sendGroup tells every member, and the users in also, e.g. one who just
+// left, the current state of a group.
+func (s *Server) sendGroup(group Group, also ...string) {
+	frame := NewFrame(FrameGroup, group)
+	for _, nickname := range append(group.Members, also...) {
+		s.sendTo(nickname, frame, nil)
+	}
+}
+
+// GroupsHandler lists the caller's groups on GET and creates one, owned by
+// the caller, on POST.
+func (S *Server) GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		S.createGroup(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	groups, err := S.Store.ListGroups(nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+func (S *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.groupRequest(w, r)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" || len(name) > MaxGroupNameLength {
+		http.Error(w, fmt.Sprintf("Group name must be 1 to %d bytes", MaxGroupNameLength), http.StatusBadRequest)
+		return
+	}
+
+	id, err := S.Store.CreateGroup(html.EscapeString(name), nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	group, err := S.Store.Group(id)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	S.sendGroup(group)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// GroupInviteHandler lets the owner invite a user, who is told right away.
+func (S *Server) GroupInviteHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.groupRequest(w, r)
+	if !ok {
+		return
+	}
+	group, ok := S.memberGroup(w, request.GroupID, nickname)
+	if !ok {
+		return
+	}
+	if group.Owner != nickname {
+		http.Error(w, "Only the owner can invite", http.StatusForbidden)
+		return
+	}
+	if slices.Contains(group.Members, request.Nickname) {
+		http.Error(w, "Already a member", http.StatusConflict)
+		return
+	}
+
+	err := S.Store.CreateInvite(group.ID, request.Nickname, nickname)
+	if err == ErrNoRecord {
+		http.Error(w, "No such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	invite := GroupInvite{GroupID: group.ID, Name: group.Name, Nickname: request.Nickname, InvitedBy: nickname}
+	S.sendTo(request.Nickname, NewFrame(FrameGroupInvite, invite), nil)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GroupInvitesHandler lists the invites waiting for the caller.
+func (S *Server) GroupInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	invites, err := S.Store.ListInvites(nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+// GroupAcceptHandler joins the group the caller was invited to.
+func (S *Server) GroupAcceptHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.groupRequest(w, r)
+	if !ok {
+		return
+	}
+	err := S.Store.AcceptInvite(request.GroupID, nickname)
+	if err == ErrNoRecord {
+		http.Error(w, "No such invite", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	group, err := S.Store.Group(request.GroupID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	S.sendGroup(group)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// GroupDeclineHandler drops an invite of the caller.
+func (S *Server) GroupDeclineHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.groupRequest(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := S.Store.DeleteInvite(request.GroupID, nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "No such invite", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GroupLeaveHandler removes the caller from a group.
+func (S *Server) GroupLeaveHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.groupRequest(w, r)
+	if !ok {
+		return
+	}
+	S.removeMember(w, request.GroupID, nickname)
+}
+
+// GroupRemoveHandler lets the owner remove a member.
+func (S *Server) GroupRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.groupRequest(w, r)
+	if !ok {
+		return
+	}
+	group, ok := S.memberGroup(w, request.GroupID, nickname)
+	if !ok {
+		return
+	}
+	if group.Owner != nickname {
+		http.Error(w, "Only the owner can remove members", http.StatusForbidden)
+		return
+	}
+	S.removeMember(w, group.ID, request.Nickname)
+}
+
+func (S *Server) removeMember(w http.ResponseWriter, groupID int64, nickname string) {
+	removed, err := S.Store.RemoveMember(groupID, nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Not a member", http.StatusNotFound)
+		return
+	}
+	if S.typing.Stop(nickname, "", groupID) {
+		S.sendTyping(TypingIndicator{From: nickname, GroupID: groupID}, nil)
+	}
+
+	group, err := S.Store.Group(groupID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	S.sendGroup(group, nickname)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// groupRequest checks the method and the session of a POST to one of the
+// group endpoints and decodes its body.
+func (S *Server) groupRequest(w http.ResponseWriter, r *http.Request) (string, GroupRequest, bool) {
+	var request GroupRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return "", request, false
+	}
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", request, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return "", request, false
+	}
+	return nickname, request, true
+}
+
+// memberGroup loads a group of nickname's, groups they are not in do not
+// exist as far as they are concerned.
+func (S *Server) memberGroup(w http.ResponseWriter, groupID int64, nickname string) (Group, bool) {
+	group, err := S.Store.Group(groupID)
+	if err != nil && err != ErrNoRecord {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return group, false
+	}
+	if err == ErrNoRecord || !slices.Contains(group.Members, nickname) {
+		http.Error(w, "No such group", http.StatusNotFound)
+		return group, false
+	}
+	return group, true
+}
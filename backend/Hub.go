@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/twinj/uuid"
+)
+
+const (
+	DefaultSendQueueSize = 64
+	DefaultWriteWait     = 10 * time.Second
+	DefaultPongWait      = 60 * time.Second
+)
+
+// WSConfig holds the websocket tuning knobs, zero values fall back to the
+// defaults above.
+type WSConfig struct {
+	// SendQueueSize is how many outbound frames a client may have pending
+	// before it is treated as a slow consumer and disconnected.
+	SendQueueSize int
+	// WriteWait bounds how long a single frame write may take.
+	WriteWait time.Duration
+	// PongWait is how long a connection may stay silent before it is
+	// considered dead, every pong resets the clock.
+	PongWait time.Duration
+	// PingPeriod is how often the server pings, it has to be shorter than
+	// PongWait so a healthy client always answers in time.
+	PingPeriod time.Duration
+	// TypingTimeout is how long a typing indicator survives without a
+	// fresh start frame from the sender.
+	TypingTimeout time.Duration
+}
+
+func (c WSConfig) withDefaults() WSConfig {
+	if c.SendQueueSize <= 0 {
+		c.SendQueueSize = DefaultSendQueueSize
+	}
+	if c.WriteWait <= 0 {
+		c.WriteWait = DefaultWriteWait
+	}
+	if c.PongWait <= 0 {
+		c.PongWait = DefaultPongWait
+	}
+	if c.PingPeriod <= 0 || c.PingPeriod >= c.PongWait {
+		c.PingPeriod = c.PongWait * 9 / 10
+	}
+	if c.TypingTimeout <= 0 {
+		c.TypingTimeout = DefaultTypingTimeout
+	}
+	return c
+}
+
+// Hub owns every connected websocket client, grouped by username so a user
+// with several tabs open has several sessions. All access to the registry
+// goes through the mutex, callers only ever get copies of the slices.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[string][]*Client
+	config  WSConfig
+	// closed is set by Close, drained is closed once the last client has
+	// unregistered after that.
+	closed  bool
+	drained chan struct{}
+}
+
+func NewHub(config WSConfig) *Hub {
+	return &Hub{
+		clients: make(map[string][]*Client),
+		config:  config.withDefaults(),
+		drained: make(chan struct{}),
+	}
+}
+
+// NewClient wraps an upgraded connection and starts its write pump. The
+// client still has to be registered.
+func (H *Hub) NewClient(conn *websocket.Conn, username, session string) *Client {
+	client := newClient(uuid.NewV4().String(), conn, username, H.config)
+	client.Session = session
+	go client.writePump()
+	return client
+}
+
+// Register adds a client to its user's session list. It refuses once the hub
+// is closed.
+func (H *Hub) Register(client *Client) bool {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+
+	if H.closed {
+		return false
+	}
+	H.clients[client.Username] = append(H.clients[client.Username], client)
+	return true
+}
+
+// Unregister removes a client and reports whether it was still registered,
+// so that the cleanup after a disconnect only runs once per client.
+func (H *Hub) Unregister(client *Client) bool {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+
+	sessions := H.clients[client.Username]
+	for i, c := range sessions {
+		if c.ID == client.ID {
+			remaining := make([]*Client, 0, len(sessions)-1)
+			remaining = append(remaining, sessions[:i]...)
+			remaining = append(remaining, sessions[i+1:]...)
+			if len(remaining) == 0 {
+				delete(H.clients, client.Username)
+			} else {
+				H.clients[client.Username] = remaining
+			}
+			if H.closed && len(H.clients) == 0 {
+				close(H.drained)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Sessions returns a copy of the clients connected as username.
+func (H *Hub) Sessions(username string) []*Client {
+	H.mu.RLock()
+	defer H.mu.RUnlock()
+
+	sessions := H.clients[username]
+	out := make([]*Client, len(sessions))
+	copy(out, sessions)
+	return out
+}
+
+// Usernames returns every user with at least one open session.
+func (H *Hub) Usernames() []string {
+	H.mu.RLock()
+	defer H.mu.RUnlock()
+
+	usernames := make([]string, 0, len(H.clients))
+	for username := range H.clients {
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// All returns a snapshot of every connected client.
+func (H *Hub) All() []*Client {
+	H.mu.RLock()
+	defer H.mu.RUnlock()
+
+	var all []*Client
+	for _, sessions := range H.clients {
+		all = append(all, sessions...)
+	}
+	return all
+}
+
+func (H *Hub) IsOnline(username string) bool {
+	H.mu.RLock()
+	defer H.mu.RUnlock()
+
+	return len(H.clients[username]) > 0
+}
+
+// SendTo queues v on every session of username connected to this instance
+// except the client with id exceptID, which may be empty.
+func (H *Hub) SendTo(username string, v interface{}, exceptID string) {
+	for _, client := range H.Sessions(username) {
+		if client.ID == exceptID {
+			continue
+		}
+		client.Send(v)
+	}
+}
+
+// CloseSessions closes the clients of username connected with one of the
+// given sessions, their read loops unregister them.
+func (H *Hub) CloseSessions(username string, sessions []string, code int, reason string) {
+	for _, client := range H.Sessions(username) {
+		if slices.Contains(sessions, client.Session) {
+			client.Close(code, reason)
+		}
+	}
+}
+
+// Broadcast queues v on every client connected to this instance.
+func (H *Hub) Broadcast(v interface{}) {
+	for _, client := range H.All() {
+		client.Send(v)
+	}
+}
+
+// Close stops accepting clients and closes every connected one with the given
+// code and reason. The returned channel is closed once all of them have
+// unregistered, that is once their read loops are done.
+func (H *Hub) Close(code int, reason string) <-chan struct{} {
+	H.mu.Lock()
+	defer H.mu.Unlock()
+
+	if !H.closed {
+		H.closed = true
+		for _, sessions := range H.clients {
+			for _, client := range sessions {
+				client.Close(code, reason)
+			}
+		}
+		if len(H.clients) == 0 {
+			close(H.drained)
+		}
+	}
+	return H.drained
+}
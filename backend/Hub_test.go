@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a client without a connection or write pump, its queue is
+// only drained by the test.
+func testClient(H *Hub, id, username string) *Client {
+	client := newClient(id, nil, username, H.config)
+	client.Session = "session-" + id
+	return client
+}
+
+func isClosed(client *Client) bool {
+	select {
+	case <-client.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// TestHubConcurrentAccess is meant for go test -race, it registers, sends to
+// and unregisters clients from many goroutines while the hub closes.
+func TestHubConcurrentAccess(t *testing.T) {
+	H := NewHub(WSConfig{SendQueueSize: 4096})
+	const workers, rounds = 8, 50
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	var mu sync.Mutex
+	var kept []*Client
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			username := "user" + strconv.Itoa(w%3)
+			for i := 0; i < rounds; i++ {
+				client := testClient(H, strconv.Itoa(w)+"-"+strconv.Itoa(i), username)
+				if !H.Register(client) {
+					continue
+				}
+				H.SendTo(username, "to user", "")
+				H.SendTo(username, "to the others", client.ID)
+				H.Broadcast("to everyone")
+				H.IsOnline(username)
+				H.Usernames()
+				H.CloseSessions(username, []string{"not a session"}, websocket.ClosePolicyViolation, SessionRevokedReason)
+				if i%2 == 0 {
+					if !H.Unregister(client) {
+						t.Error("client", client.ID, "was not registered")
+					}
+					if H.Unregister(client) {
+						t.Error("client", client.ID, "unregistered twice")
+					}
+				} else {
+					mu.Lock()
+					kept = append(kept, client)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var drained <-chan struct{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		drained = H.Close(websocket.CloseGoingAway, ShutdownReason)
+	}()
+	close(start)
+	wg.Wait()
+
+	if H.Register(testClient(H, "late", "user0")) {
+		t.Error("registered a client after Close")
+	}
+	for _, client := range kept {
+		if !isClosed(client) {
+			t.Error("client", client.ID, "still open after Close")
+		}
+	}
+	for i, client := range kept {
+		select {
+		case <-drained:
+			t.Fatal("drained with", len(kept)-i, "clients still registered")
+		default:
+		}
+		H.Unregister(client)
+	}
+	<-drained
+	if usernames := H.Usernames(); len(usernames) != 0 {
+		t.Errorf("got %v online after draining", usernames)
+	}
+}
+
+func TestHubEvictsSlowConsumer(t *testing.T) {
+	H := NewHub(WSConfig{SendQueueSize: 2})
+	fast := testClient(H, "fast", "alice")
+	slow := testClient(H, "slow", "bob")
+	H.Register(fast)
+	H.Register(slow)
+
+	// fast reads every frame as it comes, slow never does
+	for i := 0; i < 3; i++ {
+		H.Broadcast(i)
+		if got := string(<-fast.send); got != strconv.Itoa(i) {
+			t.Errorf("fast got %s, want %d", got, i)
+		}
+	}
+
+	if isClosed(fast) {
+		t.Error("a client keeping up was evicted")
+	}
+	if !isClosed(slow) {
+		t.Fatal("a client with a full queue was not evicted")
+	}
+	if want := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "send queue overflow"); !bytes.Equal(slow.closeMsg, want) {
+		t.Errorf("close message %q, want %q", slow.closeMsg, want)
+	}
+	if slow.Send("more") {
+		t.Error("queued a frame on an evicted client")
+	}
+	if len(slow.send) != 2 {
+		t.Errorf("slow has %d frames queued, want the 2 sent before the overflow", len(slow.send))
+	}
+
+	// Its read loop would unregister it, everyone else is not affected
+	H.Unregister(slow)
+	H.SendTo("alice", "still here", "")
+	if got := string(<-fast.send); got != `"still here"` {
+		t.Errorf("fast got %s after the eviction", got)
+	}
+}
@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons a login attempt failed, as kept in the audit log.
+const (
+	LoginUnknownUser = "unknown_user"
+	LoginBadPassword = "bad_password"
+	// LoginBadCode is a wrong second factor after the right password.
+	LoginBadCode = "bad_code"
+	// LoginLocked attempts were refused without looking at the password,
+	// they do not count towards further lockouts.
+	LoginLocked = "locked"
+)
+
+// LoginAttempt is one entry of the login audit log. Account is the nickname,
+// or the identifier as typed when it matched no user.
+type LoginAttempt struct {
+	Account   string
+	IP        string
+	Succeeded bool
+	Reason    string
+	At        time.Time
+}
+
+// loginLockout returns how much longer logins to account or from ip are
+// refused, zero when they are not. Whichever limit locks longer wins.
+func (S *Server) loginLockout(account, ip string, now time.Time) (time.Duration, error) {
+	limits := S.Config.Login
+	since := now.Add(-limits.Window)
+
+	failures, last, err := S.Store.AccountFailures(account, since)
+	if err != nil {
+		return 0, err
+	}
+	wait := last.Add(limits.LockoutAfter(failures, limits.AccountAttempts)).Sub(now)
+
+	failures, last, err = S.Store.IPFailures(ip, since)
+	if err != nil {
+		return 0, err
+	}
+	wait = max(wait, last.Add(limits.LockoutAfter(failures, limits.IPAttempts)).Sub(now))
+	return max(wait, 0), nil
+}
+
+// refuseLogin answers an attempt made during a lockout.
+func (S *Server) refuseLogin(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	S.renderErrorPage(w, r, "Too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+// recordLogin adds an attempt to the audit log, an empty reason means it
+// succeeded.
+func (S *Server) recordLogin(account, ip, reason string, at time.Time) {
+	err := S.Store.RecordLogin(LoginAttempt{
+		Account:   account,
+		IP:        ip,
+		Succeeded: reason == "",
+		Reason:    reason,
+		At:        at,
+	})
+	if err != nil {
+		fmt.Println("DB Login Error:", err)
+	}
+}
+
+// clientIP is the address a request came from. Behind a trusted proxy that
+// is the last X-Forwarded-For entry, the one the proxy added itself.
+func (S *Server) clientIP(r *http.Request) string {
+	if S.Config.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
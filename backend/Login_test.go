@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// lockoutServer is a test server with small login limits, on a clock that
+// only moves when the test calls the returned function.
+func lockoutServer(t *testing.T, nicknames ...string) (*Server, func(time.Duration)) {
+	t.Helper()
+	S := newTestServer(t, nicknames...)
+	S.Config.Login.AccountAttempts = 3
+	S.Config.Login.IPAttempts = 5
+	S.Config.Login.Window = 15 * time.Minute
+	S.Config.Login.Lockout = 30 * time.Second
+	S.Config.Login.MaxLockout = 2 * time.Minute
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	S.clock = func() time.Time { return now }
+	return S, func(d time.Duration) { now = now.Add(d) }
+}
+
+func login(S *Server, identifier, password, ip string) *httptest.ResponseRecorder {
+	return post(S.LoginHandler, "/login", LoginUser{Identifier: identifier, Password: password}, ip)
+}
+
+// expectLogin fails the test unless w has the given status, and for a
+// lockout the given Retry-After.
+func expectLogin(t *testing.T, w *httptest.ResponseRecorder, code int, retryAfter string) {
+	t.Helper()
+	if w.Code != code {
+		t.Fatalf("status %d, want %d: %s", w.Code, code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != retryAfter {
+		t.Fatalf("Retry-After %q, want %q", got, retryAfter)
+	}
+}
+
+func TestLoginAccountLockout(t *testing.T) {
+	S, wait := lockoutServer(t, "alice")
+
+	// Unknown users and wrong passwords look the same
+	expectLogin(t, login(S, "nobody", testPassword, "192.0.2.1"), http.StatusUnauthorized, "")
+	for i := 0; i < 3; i++ {
+		expectLogin(t, login(S, "alice", "wrong", "192.0.2.1"), http.StatusUnauthorized, "")
+	}
+
+	// Locked from any address, even with the right password
+	expectLogin(t, login(S, "alice", testPassword, "192.0.2.2"), http.StatusTooManyRequests, "30")
+	wait(10 * time.Second)
+	// Refused attempts do not count, or this would lock for longer
+	expectLogin(t, login(S, "alice@example.com", testPassword, "192.0.2.2"), http.StatusTooManyRequests, "20")
+
+	// Every failure past the limit doubles the lockout, up to MaxLockout
+	wait(21 * time.Second)
+	expectLogin(t, login(S, "alice", "wrong", "192.0.2.1"), http.StatusUnauthorized, "")
+	expectLogin(t, login(S, "alice", testPassword, "192.0.2.1"), http.StatusTooManyRequests, "60")
+	wait(61 * time.Second)
+	expectLogin(t, login(S, "alice", "wrong", "192.0.2.1"), http.StatusUnauthorized, "")
+	expectLogin(t, login(S, "alice", testPassword, "192.0.2.1"), http.StatusTooManyRequests, "120")
+	wait(121 * time.Second)
+	expectLogin(t, login(S, "alice", "wrong", "192.0.2.1"), http.StatusUnauthorized, "")
+	expectLogin(t, login(S, "alice", testPassword, "192.0.2.1"), http.StatusTooManyRequests, "120")
+
+	// Failures older than the window are forgotten
+	wait(15*time.Minute + time.Second)
+	w := login(S, "alice", testPassword, "192.0.2.1")
+	expectLogin(t, w, http.StatusOK, "")
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatal("no session cookie after logging in")
+	}
+
+	// and a login that worked starts the count again
+	for i := 0; i < 2; i++ {
+		expectLogin(t, login(S, "alice", "wrong", "192.0.2.1"), http.StatusUnauthorized, "")
+	}
+	expectLogin(t, login(S, "alice", testPassword, "192.0.2.1"), http.StatusOK, "")
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	S, wait := lockoutServer(t, "alice", "bob")
+
+	// Spread over accounts, so only the address limit is reached
+	for _, identifier := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		expectLogin(t, login(S, identifier, "wrong", "192.0.2.1"), http.StatusUnauthorized, "")
+	}
+	expectLogin(t, login(S, "bob", testPassword, "192.0.2.1"), http.StatusTooManyRequests, "30")
+	// The accounts themselves are not locked
+	expectLogin(t, login(S, "bob", testPassword, "192.0.2.2"), http.StatusOK, "")
+
+	wait(31 * time.Second)
+	expectLogin(t, login(S, "alice", testPassword, "192.0.2.1"), http.StatusOK, "")
+}
+
+func TestLoginBehindProxy(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		trustProxy bool
+		// whether the client behind the proxy at the second address is
+		// still let in once the first one is locked out
+		separated bool
+	}{
+		{"trusted proxy", true, true},
+		{"no proxy", false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			S, _ := lockoutServer(t, "alice")
+			S.Config.Login.AccountAttempts = 100
+			S.Config.TrustProxy = test.trustProxy
+
+			// Every request comes from the proxy, the client may put
+			// anything in front of what the proxy adds
+			loginVia := func(forwarded, password string) *httptest.ResponseRecorder {
+				body, _ := json.Marshal(LoginUser{Identifier: "alice", Password: password})
+				r := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+				r.RemoteAddr = "10.0.0.1:1234"
+				r.Header.Set("X-Forwarded-For", forwarded)
+				w := httptest.NewRecorder()
+				S.LoginHandler(w, r)
+				return w
+			}
+			for i := 0; i < 5; i++ {
+				expectLogin(t, loginVia("203.0.113.9, 198.51.100.7", "wrong"), http.StatusUnauthorized, "")
+			}
+			expectLogin(t, loginVia("198.51.100.7", testPassword), http.StatusTooManyRequests, "30")
+
+			w := loginVia("203.0.113.9, 198.51.100.8", testPassword)
+			if separated := w.Code == http.StatusOK; separated != test.separated {
+				t.Errorf("status %d for the other client", w.Code)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, test := range []struct {
+		trustProxy bool
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{false, "192.0.2.1:1234", "", "192.0.2.1"},
+		{false, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{true, "10.0.0.1:1234", "", "10.0.0.1"},
+		{true, "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{true, "10.0.0.1:1234", "203.0.113.9,198.51.100.7", "198.51.100.7"},
+		{true, "10.0.0.1:1234", "203.0.113.9, 198.51.100.7 ", "198.51.100.7"},
+		{true, "[2001:db8::1]:1234", "", "2001:db8::1"},
+	} {
+		S := newTestServer(t)
+		S.Config.TrustProxy = test.trustProxy
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := S.clientIP(r); ip != test.ip {
+			t.Errorf("trust %v, from %s forwarded for %q: got %s, want %s", test.trustProxy, test.remoteAddr, test.forwarded, ip, test.ip)
+		}
+	}
+}
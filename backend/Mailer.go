@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"real-time-forum/config"
+)
+
+// Mail is a plain text email to one address.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the forum's emails.
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// openMailer returns the mailer named in the configuration.
+func openMailer(c config.MailConfig) (Mailer, error) {
+	switch c.Mailer {
+	case "log":
+		return NewLogMailer(c.LogPath, c.From), nil
+	case "smtp":
+		return NewSMTPMailer(c.SMTPAddr, c.From, c.SMTPUsername, c.SMTPPassword), nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", c.Mailer)
+}
+
+// formatMail renders a mail with its headers. The recipient must be a plain
+// address and neither it nor the subject may hold a line break, which could
+// smuggle in more headers.
+func formatMail(from string, m Mail) ([]byte, string, error) {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil || to.Name != "" || strings.ContainsAny(m.To, "\r\n") {
+		return nil, "", fmt.Errorf("invalid recipient %q", m.To)
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, "", fmt.Errorf("invalid subject %q", m.Subject)
+	}
+
+	var message bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&message, "%s: %s\r\n", name, value)
+	}
+	header("From", from)
+	header("To", to.Address)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return message.Bytes(), to.Address, nil
+}
+
+// SMTPMailer relays mails through an SMTP server, with STARTTLS when the
+// server offers it. Without a username it sends without logging in, which is
+// also what a local fake SMTP server for testing expects.
+type SMTPMailer struct {
+	Addr string
+	From string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	mailer := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (M *SMTPMailer) Send(m Mail) error {
+	message, to, err := formatMail(M.From, m)
+	if err != nil {
+		return err
+	}
+	sender, err := mail.ParseAddress(M.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(M.Addr, M.auth, sender.Address, []string{to}, message)
+}
+
+// LogMailer appends every mail to a file instead of sending it, for
+// development and for running without a mail server.
+type LogMailer struct {
+	mu   sync.Mutex
+	Path string
+	From string
+}
+
+func NewLogMailer(path, from string) *LogMailer {
+	return &LogMailer{Path: path, From: from}
+}
+
+func (M *LogMailer) Send(m Mail) error {
+	message, _, err := formatMail(M.From, m)
+	if err != nil {
+		return err
+	}
+
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	f, err := os.OpenFile(M.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\r\n\r\n", message)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
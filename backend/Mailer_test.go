@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts one SMTP session on a local port and sends what the
+// client said on the returned channel: the commands, then the message.
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	session := make(chan []string, 1)
+	go func() {
+		var lines []string
+		defer func() { session <- lines }()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 fake ESMTP")
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\r\n")
+			lines = append(lines, line)
+			if data {
+				if line == "." {
+					data = false
+					reply("250 queued")
+				}
+				continue
+			}
+			switch verb, _, _ := strings.Cut(strings.ToUpper(line), " "); verb {
+			case "EHLO", "HELO":
+				reply("250 fake")
+			case "DATA":
+				data = true
+				reply("354 go ahead")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), session
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, session := fakeSMTP(t)
+	mailer := NewSMTPMailer(addr, "Forum <forum@example.com>", "", "")
+
+	err := mailer.Send(Mail{
+		To:      "alice@example.com",
+		Subject: "Réinitialiser",
+		Body:    "Hello alice,\n\nhttp://localhost:8080/?reset=abc\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := <-session
+	transcript := strings.Join(lines, "\n")
+
+	for _, want := range []string{
+		"MAIL FROM:<forum@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"DATA",
+		"From: Forum <forum@example.com>",
+		"To: alice@example.com",
+		"Subject: =?utf-8?q?R=C3=A9initialiser?=",
+		"Content-Type: text/plain; charset=utf-8",
+		"http://localhost:8080/?reset=abc",
+		"QUIT",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("no line %q in the session:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestFormatMailRejectsLineBreaks(t *testing.T) {
+	for _, m := range []Mail{
+		{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hi"},
+		{To: "alice@example.com\nBcc: eve@example.com", Subject: "Hi"},
+		{To: "Alice <alice@example.com>", Subject: "Hi"},
+		{To: "alice@example.com", Subject: "Hi\r\nBcc: eve@example.com"},
+		{To: "alice@example.com", Subject: "Hi\nBcc: eve@example.com"},
+	} {
+		if _, _, err := formatMail("forum@example.com", m); err == nil {
+			t.Errorf("formatMail accepted To %q, Subject %q", m.To, m.Subject)
+		}
+	}
+}
+
+// blockingMailer holds every mail until release is closed.
+type blockingMailer struct {
+	sending chan Mail
+	release chan struct{}
+	sent    atomic.Int32
+}
+
+func (M *blockingMailer) Send(mail Mail) error {
+	M.sending <- mail
+	<-M.release
+	M.sent.Add(1)
+	return nil
+}
+
+func TestShutdownWaitsForMails(t *testing.T) {
+	mailer := &blockingMailer{sending: make(chan Mail, 1), release: make(chan struct{})}
+	S := newTestServer(t, "alice")
+	S.Mailer = mailer
+	addr, stop := runServer(t, S)
+
+	response, err := http.Post("http://"+addr+"/password/forgot", "application/json", strings.NewReader(`{"identifier":"alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("asking for a reset: got %d", response.StatusCode)
+	}
+	select {
+	case <-mailer.sending:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail sent")
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- stop()
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatal("shut down with a mail still being sent:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(mailer.release)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if mailer.sent.Load() != 1 {
+		t.Error("the mail was not sent")
+	}
+}
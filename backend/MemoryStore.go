@@ -0,0 +1,1066 @@
+package backend
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type memorySession struct {
+	nickname string
+	session  Session
+}
+
+type memoryEmailToken struct {
+	nickname  string
+	purpose   string
+	expiresAt time.Time
+	used      bool
+}
+
+type memoryChallenge struct {
+	nickname  string
+	expiresAt time.Time
+}
+
+type memoryMailRequest struct {
+	account string
+	ip      string
+	at      time.Time
+}
+
+type memoryMember struct {
+	nickname string
+	lastRead int64
+}
+
+type memoryGroup struct {
+	group   Group
+	members []memoryMember
+}
+
+// MemoryStore keeps everything in maps and slices, it behaves like the SQL
+// stores and is meant for tests and throwaway instances.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	users    []User
+	sessions map[string]memorySession
+	posts    []Post
+	comments []Comment
+	messages []Message
+	// logs holds each user's sequence as indexes into messages, seq n is
+	// logs[user][n-1]
+	logs map[string][]int
+	// clientIDs maps sender and client id to the message's seq in the
+	// sender's sequence, 0 when the sender is not a participant
+	clientIDs map[[2]string]int64
+	// groups[id-1] is group id
+	groups  []*memoryGroup
+	invites []GroupInvite
+	logins  []LoginAttempt
+	// mails is in the order the requests were made
+	mails []memoryMailRequest
+	totps map[string]TOTP
+	// recoveryCodes maps nickname and code hash to whether it was used
+	recoveryCodes map[string]map[string]bool
+	challenges    map[string]memoryChallenge
+	verified      map[string]bool
+	emailTokens   map[string]memoryEmailToken
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:      make(map[string]memorySession),
+		logs:          make(map[string][]int),
+		clientIDs:     make(map[[2]string]int64),
+		totps:         make(map[string]TOTP),
+		recoveryCodes: make(map[string]map[string]bool),
+		challenges:    make(map[string]memoryChallenge),
+		verified:      make(map[string]bool),
+		emailTokens:   make(map[string]memoryEmailToken),
+	}
+}
+
+func (M *MemoryStore) Close() error {
+	return nil
+}
+
+func (M *MemoryStore) findUser(identifier string) (User, bool) {
+	for _, user := range M.users {
+		if user.Nickname == identifier || user.Email == identifier {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+func (M *MemoryStore) UserExists(email, nickname string) (bool, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	for _, user := range M.users {
+		if user.Email == email || user.Nickname == nickname {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (M *MemoryStore) CreateUser(user User) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	user.ID = len(M.users) + 1
+	M.users = append(M.users, user)
+	return nil
+}
+
+func (M *MemoryStore) GetCredentials(identifier string) (string, string, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	user, ok := M.findUser(identifier)
+	if !ok {
+		return "", "", ErrNoRecord
+	}
+	return user.Nickname, user.Password, nil
+}
+
+func (M *MemoryStore) UserEmail(nickname string) (string, bool, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	user, ok := M.findUser(nickname)
+	if !ok || user.Nickname != nickname {
+		return "", false, ErrNoRecord
+	}
+	return user.Email, M.verified[nickname], nil
+}
+
+func (M *MemoryStore) SetEmailVerified(nickname string) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.verified[nickname] = true
+	return nil
+}
+
+func (M *MemoryStore) CreateEmailToken(hash, nickname, purpose string, at, expiresAt time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.emailTokens[hash] = memoryEmailToken{nickname: nickname, purpose: purpose, expiresAt: expiresAt}
+
+	var live []string
+	for hash, token := range M.emailTokens {
+		if token.nickname != nickname || token.purpose != purpose {
+			continue
+		}
+		if token.used || !token.expiresAt.After(at) {
+			delete(M.emailTokens, hash)
+			continue
+		}
+		live = append(live, hash)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return M.emailTokens[live[i]].expiresAt.After(M.emailTokens[live[j]].expiresAt)
+	})
+	for _, hash := range live[min(len(live), MaxEmailTokens):] {
+		delete(M.emailTokens, hash)
+	}
+	return nil
+}
+
+func (M *MemoryStore) UseEmailToken(hash, purpose string, at time.Time) (string, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	token, ok := M.emailTokens[hash]
+	if !ok || token.used || token.purpose != purpose || !token.expiresAt.After(at) {
+		return "", ErrNoRecord
+	}
+	token.used = true
+	M.emailTokens[hash] = token
+	return token.nickname, nil
+}
+
+func (M *MemoryStore) ResetPassword(hash, hashedPassword string, at time.Time) (string, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	token, ok := M.emailTokens[hash]
+	if !ok || token.used || token.purpose != TokenReset || !token.expiresAt.After(at) {
+		return "", ErrNoRecord
+	}
+	for i := range M.users {
+		if M.users[i].Nickname == token.nickname {
+			M.users[i].Password = hashedPassword
+		}
+	}
+	M.verified[token.nickname] = true
+	for hash, other := range M.emailTokens {
+		if other.nickname == token.nickname && other.purpose == TokenReset {
+			delete(M.emailTokens, hash)
+		}
+	}
+	return token.nickname, nil
+}
+
+func (M *MemoryStore) CreateSession(sessionID, nickname, userAgent string, expiresAt time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	now := time.Now()
+	M.sessions[sessionID] = memorySession{nickname: nickname, session: Session{
+		Token:     sessionID,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: expiresAt,
+		UserAgent: userAgent,
+	}}
+	return nil
+}
+
+func (M *MemoryStore) SessionUser(sessionID string) (string, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	session, ok := M.sessions[sessionID]
+	if !ok || !session.session.ExpiresAt.After(time.Now()) {
+		return "", ErrNoRecord
+	}
+	return session.nickname, nil
+}
+
+func (M *MemoryStore) Session(sessionID string) (Session, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	session, ok := M.sessions[sessionID]
+	if !ok || !session.session.ExpiresAt.After(time.Now()) {
+		return Session{}, ErrNoRecord
+	}
+	return session.session, nil
+}
+
+func (M *MemoryStore) TouchSession(sessionID string, at, expiresAt time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if session, ok := M.sessions[sessionID]; ok {
+		session.session.LastSeen = at
+		session.session.ExpiresAt = expiresAt
+		M.sessions[sessionID] = session
+	}
+	return nil
+}
+
+func (M *MemoryStore) ListSessions(nickname string) ([]Session, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	now := time.Now()
+	var sessions []Session
+	for _, session := range M.sessions {
+		if session.nickname == nickname && session.session.ExpiresAt.After(now) {
+			sessions = append(sessions, session.session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+func (M *MemoryStore) DeleteSession(sessionID string) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	delete(M.sessions, sessionID)
+	return nil
+}
+
+func (M *MemoryStore) DeleteOtherSessions(nickname, keep string) ([]string, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	var deleted []string
+	for sessionID, session := range M.sessions {
+		if session.nickname == nickname && sessionID != keep {
+			delete(M.sessions, sessionID)
+			deleted = append(deleted, sessionID)
+		}
+	}
+	return deleted, nil
+}
+
+func (M *MemoryStore) DeleteExpiredSessions(now time.Time) (map[string][]string, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	deleted := make(map[string][]string)
+	for sessionID, session := range M.sessions {
+		if !session.session.ExpiresAt.After(now) {
+			delete(M.sessions, sessionID)
+			deleted[session.nickname] = append(deleted[session.nickname], sessionID)
+		}
+	}
+	return deleted, nil
+}
+
+func (M *MemoryStore) TOTP(nickname string) (TOTP, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	totp, ok := M.totps[nickname]
+	if !ok {
+		return totp, ErrNoRecord
+	}
+	return totp, nil
+}
+
+func (M *MemoryStore) SetTOTPSecret(nickname, secret string) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if M.totps[nickname].Enabled {
+		return false, nil
+	}
+	M.totps[nickname] = TOTP{Secret: secret}
+	return true, nil
+}
+
+func (M *MemoryStore) EnableTOTP(nickname string, step int64) (bool, error) {
+	return M.useTOTPStep(nickname, step, false)
+}
+
+func (M *MemoryStore) UseTOTPStep(nickname string, step int64) (bool, error) {
+	return M.useTOTPStep(nickname, step, true)
+}
+
+// useTOTPStep moves the last step of an authenticator that is enabled as
+// given and enables it.
+func (M *MemoryStore) useTOTPStep(nickname string, step int64, enabled bool) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	totp, ok := M.totps[nickname]
+	if !ok || totp.Enabled != enabled || totp.LastStep >= step {
+		return false, nil
+	}
+	totp.Enabled, totp.LastStep = true, step
+	M.totps[nickname] = totp
+	return true, nil
+}
+
+func (M *MemoryStore) DeleteTOTP(nickname string) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	_, ok := M.totps[nickname]
+	delete(M.totps, nickname)
+	delete(M.recoveryCodes, nickname)
+	return ok, nil
+}
+
+func (M *MemoryStore) ReplaceRecoveryCodes(nickname string, hashes []string) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = false
+	}
+	M.recoveryCodes[nickname] = codes
+	return nil
+}
+
+func (M *MemoryStore) UseRecoveryCode(nickname, hash string, at time.Time) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	used, ok := M.recoveryCodes[nickname][hash]
+	if !ok || used {
+		return false, nil
+	}
+	M.recoveryCodes[nickname][hash] = true
+	return true, nil
+}
+
+func (M *MemoryStore) RecoveryCodesLeft(nickname string) (int, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	left := 0
+	for _, used := range M.recoveryCodes[nickname] {
+		if !used {
+			left++
+		}
+	}
+	return left, nil
+}
+
+func (M *MemoryStore) CreateLoginChallenge(challenge, nickname string, expiresAt time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.challenges[challenge] = memoryChallenge{nickname: nickname, expiresAt: expiresAt}
+	return nil
+}
+
+func (M *MemoryStore) ChallengeUser(challenge string) (string, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	pending, ok := M.challenges[challenge]
+	if !ok || !pending.expiresAt.After(time.Now()) {
+		return "", ErrNoRecord
+	}
+	return pending.nickname, nil
+}
+
+func (M *MemoryStore) DeleteLoginChallenge(challenge string) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	delete(M.challenges, challenge)
+	return nil
+}
+
+func (M *MemoryStore) DeleteExpiredChallenges(now time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	for challenge, pending := range M.challenges {
+		if !pending.expiresAt.After(now) {
+			delete(M.challenges, challenge)
+		}
+	}
+	return nil
+}
+
+func (M *MemoryStore) RecordLogin(attempt LoginAttempt) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.logins = append(M.logins, attempt)
+	return nil
+}
+
+func (M *MemoryStore) AccountFailures(account string, since time.Time) (int, time.Time, error) {
+	return M.loginFailures(func(attempt LoginAttempt) (bool, bool) {
+		return attempt.Account == account, attempt.Succeeded
+	}, since)
+}
+
+func (M *MemoryStore) IPFailures(ip string, since time.Time) (int, time.Time, error) {
+	return M.loginFailures(func(attempt LoginAttempt) (bool, bool) {
+		return attempt.IP == ip, false
+	}, since)
+}
+
+// loginFailures walks the attempts from the latest back, match tells whether
+// one counts and whether the walk stops there.
+func (M *MemoryStore) loginFailures(match func(LoginAttempt) (bool, bool), since time.Time) (int, time.Time, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	var count int
+	var last time.Time
+	for i := len(M.logins) - 1; i >= 0; i-- {
+		attempt := M.logins[i]
+		matched, stop := match(attempt)
+		if !matched {
+			continue
+		}
+		if stop {
+			break
+		}
+		if attempt.At.After(since) && !attempt.Succeeded && attempt.Reason != LoginLocked {
+			if count == 0 {
+				last = attempt.At
+			}
+			count++
+		}
+	}
+	return count, last, nil
+}
+
+func (M *MemoryStore) RecordMailRequest(account, ip string, at time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	M.mails = append(M.mails, memoryMailRequest{account: account, ip: ip, at: at})
+	return nil
+}
+
+func (M *MemoryStore) AccountMailRequests(account string, since time.Time) (int, time.Time, error) {
+	return M.mailRequests(func(request memoryMailRequest) bool {
+		return request.account == account
+	}, since)
+}
+
+func (M *MemoryStore) IPMailRequests(ip string, since time.Time) (int, time.Time, error) {
+	return M.mailRequests(func(request memoryMailRequest) bool {
+		return request.ip == ip
+	}, since)
+}
+
+func (M *MemoryStore) mailRequests(match func(memoryMailRequest) bool, since time.Time) (int, time.Time, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	var count int
+	var oldest time.Time
+	for _, request := range M.mails {
+		if match(request) && request.at.After(since) {
+			if count == 0 || request.at.Before(oldest) {
+				oldest = request.at
+			}
+			count++
+		}
+	}
+	return count, oldest, nil
+}
+
+func (M *MemoryStore) DeleteMailRequests(before time.Time) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	kept := M.mails[:0]
+	for _, request := range M.mails {
+		if !request.at.Before(before) {
+			kept = append(kept, request)
+		}
+	}
+	M.mails = kept
+	return nil
+}
+
+func (M *MemoryStore) CreatePost(author string, post Post) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if _, ok := M.findUser(author); !ok {
+		return ErrNoRecord
+	}
+	post.ID = len(M.posts) + 1
+	post.Author = author
+	post.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	M.posts = append(M.posts, post)
+	return nil
+}
+
+func (M *MemoryStore) ListPosts() ([]Post, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	var posts []Post
+	for i := len(M.posts) - 1; i >= 0; i-- {
+		posts = append(posts, M.posts[i])
+	}
+	return posts, nil
+}
+
+func (M *MemoryStore) CreateComment(author string, comment Comment) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if _, ok := M.findUser(author); !ok {
+		return ErrNoRecord
+	}
+	comment.ID = len(M.comments) + 1
+	comment.Author = author
+	comment.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	M.comments = append(M.comments, comment)
+	return nil
+}
+
+func (M *MemoryStore) ListComments(postID int) ([]Comment, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	var comments []Comment
+	for _, comment := range M.comments {
+		if comment.PostID == postID {
+			comments = append(comments, comment)
+		}
+	}
+	return comments, nil
+}
+
+func (M *MemoryStore) CreateMessage(msg Message) (int64, map[string]int64, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	key := [2]string{msg.From, msg.ClientID}
+	if _, ok := M.clientIDs[key]; ok && msg.ClientID != "" {
+		return 0, nil, ErrDuplicateMessage
+	}
+	msg.ID = int64(len(M.messages) + 1)
+	M.messages = append(M.messages, msg)
+
+	members := participants(msg)
+	if msg.GroupID != 0 {
+		members = nil
+		if group, ok := M.group(msg.GroupID); ok {
+			for _, member := range group.members {
+				members = append(members, member.nickname)
+			}
+		}
+	}
+
+	seqs := make(map[string]int64)
+	for _, nickname := range members {
+		M.logs[nickname] = append(M.logs[nickname], len(M.messages)-1)
+		seqs[nickname] = int64(len(M.logs[nickname]))
+	}
+	if msg.ClientID != "" {
+		M.clientIDs[key] = seqs[msg.From]
+	}
+	return msg.ID, seqs, nil
+}
+
+func (M *MemoryStore) MessageByClientID(sender, clientID string) (Message, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	seq := M.clientIDs[[2]string{sender, clientID}]
+	if seq == 0 {
+		return Message{}, ErrNoRecord
+	}
+	msg := M.messages[M.logs[sender][seq-1]]
+	msg.Seq = seq
+	return msg, nil
+}
+
+func (M *MemoryStore) MessagesSince(nickname string, seq int64, limit int) ([]Message, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	messages := []Message{}
+	log := M.logs[nickname]
+	for i := max(seq, 0); i < int64(len(log)) && len(messages) < limit; i++ {
+		msg := M.messages[log[i]]
+		msg.Seq = i + 1
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func (M *MemoryStore) LatestSeq(nickname string) (int64, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	return int64(len(M.logs[nickname])), nil
+}
+
+func between(msg Message, a, b string) bool {
+	return (msg.From == a && msg.To == b) || (msg.From == b && msg.To == a)
+}
+
+func (M *MemoryStore) ListMessages(query MessageQuery) ([]Message, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	between := between
+	if query.GroupID != 0 {
+		between = func(msg Message, _, _ string) bool { return msg.GroupID == query.GroupID }
+	}
+
+	messages := []Message{}
+	if query.After != 0 {
+		for _, msg := range M.messages {
+			if len(messages) == query.Limit {
+				break
+			}
+			if msg.ID > query.After && between(msg, query.User, query.Other) {
+				messages = append(messages, msg)
+			}
+		}
+		return messages, nil
+	}
+
+	for i := len(M.messages) - 1; i >= 0 && len(messages) < query.Limit; i-- {
+		msg := M.messages[i]
+		if query.Before != 0 && msg.ID >= query.Before {
+			continue
+		}
+		if between(msg, query.User, query.Other) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (M *MemoryStore) MessageSender(id int64, receiver string) (string, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	if id < 1 || id > int64(len(M.messages)) || M.messages[id-1].To != receiver {
+		return "", ErrNoRecord
+	}
+	return M.messages[id-1].From, nil
+}
+
+func (M *MemoryStore) MarkDelivered(id int64, at string) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if id < 1 || id > int64(len(M.messages)) || M.messages[id-1].DeliveredAt != "" {
+		return false, nil
+	}
+	M.messages[id-1].DeliveredAt = at
+	return true, nil
+}
+
+func (M *MemoryStore) MarkRead(sender, receiver string, upTo int64, at string) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	changed := false
+	for i := range M.messages {
+		msg := &M.messages[i]
+		if msg.ID > upTo || msg.From != sender || msg.To != receiver || msg.ReadAt != "" {
+			continue
+		}
+		msg.ReadAt = at
+		if msg.DeliveredAt == "" {
+			msg.DeliveredAt = at
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func (M *MemoryStore) UnreadCounts(receiver string) ([]Notification, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, msg := range M.messages {
+		if msg.To == receiver && msg.ReadAt == "" {
+			counts[msg.From]++
+		}
+	}
+
+	notifications := []Notification{}
+	for sender, unread := range counts {
+		notifications = append(notifications, Notification{Receiver: receiver, Sender: sender, Unread: unread})
+	}
+	for _, group := range M.groups {
+		if member, ok := group.member(receiver); ok {
+			if unread := M.groupUnread(group.group.ID, member); unread > 0 {
+				notifications = append(notifications, Notification{Receiver: receiver, GroupID: group.group.ID, Unread: unread})
+			}
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		a, b := notifications[i], notifications[j]
+		if a.GroupID != b.GroupID {
+			return a.GroupID < b.GroupID
+		}
+		return a.Sender < b.Sender
+	})
+	return notifications, nil
+}
+
+func (M *MemoryStore) UnreadCount(receiver, sender string) (int, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	unread := 0
+	for _, msg := range M.messages {
+		if msg.To == receiver && msg.From == sender && msg.ReadAt == "" {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (M *MemoryStore) Conversations(viewer string) ([]Conversation, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	conversations := []Conversation{}
+	for _, user := range M.users {
+		if user.Nickname != viewer {
+			conversations = append(conversations, M.conversation(viewer, user.Nickname))
+		}
+	}
+	return conversations, nil
+}
+
+func (M *MemoryStore) Conversation(viewer, other string) (Conversation, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	if user, ok := M.findUser(other); !ok || user.Nickname != other || other == viewer {
+		return Conversation{}, ErrNoRecord
+	}
+	return M.conversation(viewer, other), nil
+}
+
+func (M *MemoryStore) conversation(viewer, other string) Conversation {
+	conversation := Conversation{Nickname: other}
+	for _, msg := range M.messages {
+		if !between(msg, viewer, other) {
+			continue
+		}
+		conversation.LastMessageID = msg.ID
+		conversation.LastSender = msg.From
+		conversation.LastMessage = msg.Content
+		conversation.LastMessageAt = msg.Timestamp
+		if msg.From == other && msg.ReadAt == "" {
+			conversation.Unread++
+		}
+	}
+	return conversation
+}
+
+func (M *MemoryStore) GroupConversations(viewer string) ([]Conversation, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	conversations := []Conversation{}
+	for _, group := range M.groups {
+		if member, ok := group.member(viewer); ok {
+			conversations = append(conversations, M.groupConversation(group, member))
+		}
+	}
+	return conversations, nil
+}
+
+func (M *MemoryStore) GroupConversation(viewer string, groupID int64) (Conversation, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	group, ok := M.group(groupID)
+	if !ok {
+		return Conversation{}, ErrNoRecord
+	}
+	member, ok := group.member(viewer)
+	if !ok {
+		return Conversation{}, ErrNoRecord
+	}
+	return M.groupConversation(group, member), nil
+}
+
+func (M *MemoryStore) groupConversation(group *memoryGroup, member memoryMember) Conversation {
+	conversation := Conversation{GroupID: group.group.ID, Name: group.group.Name}
+	for _, msg := range M.messages {
+		if msg.GroupID != group.group.ID {
+			continue
+		}
+		conversation.LastMessageID = msg.ID
+		conversation.LastSender = msg.From
+		conversation.LastMessage = msg.Content
+		conversation.LastMessageAt = msg.Timestamp
+	}
+	conversation.Unread = M.groupUnread(group.group.ID, member)
+	return conversation
+}
+
+func (M *MemoryStore) groupUnread(groupID int64, member memoryMember) int {
+	unread := 0
+	for _, msg := range M.messages {
+		if msg.GroupID == groupID && msg.ID > member.lastRead && msg.From != member.nickname {
+			unread++
+		}
+	}
+	return unread
+}
+
+func (M *MemoryStore) group(id int64) (*memoryGroup, bool) {
+	if id < 1 || id > int64(len(M.groups)) {
+		return nil, false
+	}
+	return M.groups[id-1], true
+}
+
+func (g *memoryGroup) member(nickname string) (memoryMember, bool) {
+	for _, member := range g.members {
+		if member.nickname == nickname {
+			return member, true
+		}
+	}
+	return memoryMember{}, false
+}
+
+// snapshot copies the group with its current members.
+func (g *memoryGroup) snapshot() Group {
+	group := g.group
+	group.Members = []string{}
+	for _, member := range g.members {
+		group.Members = append(group.Members, member.nickname)
+	}
+	return group
+}
+
+func (M *MemoryStore) CreateGroup(name, owner string) (int64, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	id := int64(len(M.groups) + 1)
+	M.groups = append(M.groups, &memoryGroup{
+		group:   Group{ID: id, Name: name, Owner: owner, CreatedAt: time.Now().Format(time.RFC3339)},
+		members: []memoryMember{{nickname: owner}},
+	})
+	return id, nil
+}
+
+func (M *MemoryStore) Group(id int64) (Group, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	group, ok := M.group(id)
+	if !ok {
+		return Group{}, ErrNoRecord
+	}
+	return group.snapshot(), nil
+}
+
+func (M *MemoryStore) ListGroups(nickname string) ([]Group, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	groups := []Group{}
+	for _, group := range M.groups {
+		if _, ok := group.member(nickname); ok {
+			groups = append(groups, group.snapshot())
+		}
+	}
+	return groups, nil
+}
+
+func (M *MemoryStore) CreateInvite(groupID int64, nickname, invitedBy string) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if user, ok := M.findUser(nickname); !ok || user.Nickname != nickname {
+		return ErrNoRecord
+	}
+	for _, invite := range M.invites {
+		if invite.GroupID == groupID && invite.Nickname == nickname {
+			return nil
+		}
+	}
+	M.invites = append(M.invites, GroupInvite{
+		GroupID:   groupID,
+		Nickname:  nickname,
+		InvitedBy: invitedBy,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+func (M *MemoryStore) ListInvites(nickname string) ([]GroupInvite, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	invites := []GroupInvite{}
+	for _, invite := range M.invites {
+		if group, ok := M.group(invite.GroupID); ok && invite.Nickname == nickname {
+			invite.Name = group.group.Name
+			invites = append(invites, invite)
+		}
+	}
+	return invites, nil
+}
+
+func (M *MemoryStore) AcceptInvite(groupID int64, nickname string) error {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	if !M.deleteInvite(groupID, nickname) {
+		return ErrNoRecord
+	}
+	group, ok := M.group(groupID)
+	if !ok {
+		return ErrNoRecord
+	}
+	if _, ok := group.member(nickname); ok {
+		return nil
+	}
+	// Only messages sent after joining count as unread
+	member := memoryMember{nickname: nickname}
+	for _, msg := range M.messages {
+		if msg.GroupID == groupID {
+			member.lastRead = msg.ID
+		}
+	}
+	group.members = append(group.members, member)
+	return nil
+}
+
+func (M *MemoryStore) DeleteInvite(groupID int64, nickname string) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	return M.deleteInvite(groupID, nickname), nil
+}
+
+func (M *MemoryStore) deleteInvite(groupID int64, nickname string) bool {
+	for i, invite := range M.invites {
+		if invite.GroupID == groupID && invite.Nickname == nickname {
+			M.invites = append(M.invites[:i:i], M.invites[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (M *MemoryStore) RemoveMember(groupID int64, nickname string) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	group, ok := M.group(groupID)
+	if !ok {
+		return false, nil
+	}
+	for i, member := range group.members {
+		if member.nickname != nickname {
+			continue
+		}
+		group.members = append(group.members[:i:i], group.members[i+1:]...)
+		// An empty group keeps its last owner
+		if group.group.Owner == nickname && len(group.members) > 0 {
+			group.group.Owner = group.members[0].nickname
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (M *MemoryStore) MarkGroupRead(groupID int64, nickname string, upTo int64) (bool, error) {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+
+	group, ok := M.group(groupID)
+	if !ok || upTo < 1 || upTo > int64(len(M.messages)) || M.messages[upTo-1].GroupID != groupID {
+		return false, nil
+	}
+	for i := range group.members {
+		member := &group.members[i]
+		if member.nickname == nickname && member.lastRead < upTo {
+			member.lastRead = upTo
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (M *MemoryStore) GroupUnreadCount(groupID int64, nickname string) (int, error) {
+	M.mu.RLock()
+	defer M.mu.RUnlock()
+
+	group, ok := M.group(groupID)
+	if !ok {
+		return 0, nil
+	}
+	member, ok := group.member(nickname)
+	if !ok {
+		return 0, nil
+	}
+	return M.groupUnread(groupID, member), nil
+}
@@ -0,0 +1,430 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration is one numbered schema change. Up and Down run inside a
+// transaction together with the schema_version bookkeeping, so a failed step
+// leaves the database at the previous version. DDL is written for SQLite and
+// translated by the Dialect.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx, d Dialect) error
+	Down    func(tx *sql.Tx, d Dialect) error
+}
+
+// migrations must stay ordered by Version. Never edit one that has shipped,
+// add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create tables",
+		// IF NOT EXISTS lets databases created before migrations existed
+		// adopt this as their starting point.
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nickname TEXT UNIQUE,
+		first_name TEXT,
+		last_name TEXT,
+		email TEXT UNIQUE,
+		password TEXT,
+		age INTEGER,
+		gender TEXT
+	)`,
+			`CREATE TABLE IF NOT EXISTS posts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		title TEXT,
+		content TEXT,
+		category TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	)`,
+			`CREATE TABLE IF NOT EXISTS comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER,
+		user_id INTEGER,
+		content TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(post_id) REFERENCES posts(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	)`,
+			`CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT,
+		receiver TEXT,
+		content TEXT,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+			`CREATE TABLE IF NOT EXISTS sessions (
+		session_id TEXT PRIMARY KEY,
+		nickname TEXT,
+		expires_at DATETIME,
+		FOREIGN KEY(nickname) REFERENCES users(nickname)
+	)`,
+			`CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		receiver_nickname TEXT,
+		sender_nickname TEXT,
+		unread_messages INTEGER DEFAULT 0,
+		FOREIGN KEY(receiver_nickname) REFERENCES users(nickname),
+		FOREIGN KEY(sender_nickname) REFERENCES users(nickname)
+	)`,
+		),
+		Down: execAll(
+			"DROP TABLE notifications",
+			"DROP TABLE sessions",
+			"DROP TABLE messages",
+			"DROP TABLE comments",
+			"DROP TABLE posts",
+			"DROP TABLE users",
+		),
+	},
+	{
+		Version: 2,
+		Name:    "message receipts",
+		// Older builds added these columns on startup, so they may already
+		// be there.
+		Up: func(tx *sql.Tx, d Dialect) error {
+			if err := addColumn(tx, d, "messages", "delivered_at", "DATETIME"); err != nil {
+				return err
+			}
+			return addColumn(tx, d, "messages", "read_at", "DATETIME")
+		},
+		Down: execAll(
+			"ALTER TABLE messages DROP COLUMN read_at",
+			"ALTER TABLE messages DROP COLUMN delivered_at",
+		),
+	},
+	{
+		Version: 3,
+		Name:    "drop notifications",
+		// Unread counts are derived from messages.read_at now.
+		Up: execAll("DROP TABLE IF EXISTS notifications"),
+		Down: execAll(`CREATE TABLE notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		receiver_nickname TEXT,
+		sender_nickname TEXT,
+		unread_messages INTEGER DEFAULT 0,
+		FOREIGN KEY(receiver_nickname) REFERENCES users(nickname),
+		FOREIGN KEY(sender_nickname) REFERENCES users(nickname)
+	)`),
+	},
+	{
+		Version: 4,
+		Name:    "message sequences",
+		// user_seqs holds each user's last seq, message_log maps every seq
+		// to its message. Existing messages are numbered in id order.
+		Up: execAll(
+			`CREATE TABLE user_seqs (
+		nickname TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL
+	)`,
+			`CREATE TABLE message_log (
+		nickname TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		PRIMARY KEY(nickname, seq),
+		FOREIGN KEY(message_id) REFERENCES messages(id)
+	)`,
+			`INSERT INTO message_log (nickname, seq, message_id)
+		SELECT nickname, ROW_NUMBER() OVER (PARTITION BY nickname ORDER BY id), id
+		FROM (SELECT sender AS nickname, id FROM messages
+			UNION SELECT receiver, id FROM messages) participants`,
+			`INSERT INTO user_seqs (nickname, seq)
+		SELECT nickname, MAX(seq) FROM message_log GROUP BY nickname`,
+		),
+		Down: execAll(
+			"DROP TABLE message_log",
+			"DROP TABLE user_seqs",
+		),
+	},
+	{
+		Version: 5,
+		Name:    "client message ids",
+		// The index makes a client id unique per sender, messages sent
+		// without one are all NULL and never collide.
+		Up: execAll(
+			"ALTER TABLE messages ADD COLUMN client_id TEXT",
+			"CREATE UNIQUE INDEX messages_client_id ON messages (sender, client_id)",
+		),
+		Down: execAll(
+			"DROP INDEX messages_client_id",
+			"ALTER TABLE messages DROP COLUMN client_id",
+		),
+	},
+	{
+		Version: 6,
+		Name:    "group conversations",
+		// Group messages have an empty receiver and the group in group_id.
+		// last_read is the last message id a member has read, unread counts
+		// start from the message before they joined.
+		Up: execAll(
+			`CREATE TABLE chat_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+			`CREATE TABLE group_members (
+		group_id INTEGER NOT NULL,
+		nickname TEXT NOT NULL,
+		last_read INTEGER NOT NULL DEFAULT 0,
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(group_id, nickname),
+		FOREIGN KEY(group_id) REFERENCES chat_groups(id)
+	)`,
+			`CREATE TABLE group_invites (
+		group_id INTEGER NOT NULL,
+		nickname TEXT NOT NULL,
+		invited_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(group_id, nickname),
+		FOREIGN KEY(group_id) REFERENCES chat_groups(id)
+	)`,
+			"ALTER TABLE messages ADD COLUMN group_id INTEGER",
+			"CREATE INDEX messages_group_id ON messages (group_id, id)",
+		),
+		Down: execAll(
+			"DROP INDEX messages_group_id",
+			"ALTER TABLE messages DROP COLUMN group_id",
+			"DROP TABLE group_invites",
+			"DROP TABLE group_members",
+			"DROP TABLE chat_groups",
+		),
+	},
+	{
+		Version: 7,
+		Name:    "login attempts",
+		// Every login attempt is kept as an audit log, recent failures lock
+		// the account or the address out for a while.
+		Up: execAll(
+			`CREATE TABLE login_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		succeeded BOOLEAN NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		attempted_at DATETIME NOT NULL
+	)`,
+			"CREATE INDEX login_attempts_account ON login_attempts (account, id)",
+			"CREATE INDEX login_attempts_ip ON login_attempts (ip, id)",
+		),
+		Down: execAll(
+			"DROP INDEX login_attempts_ip",
+			"DROP INDEX login_attempts_account",
+			"DROP TABLE login_attempts",
+		),
+	},
+	{
+		Version: 8,
+		Name:    "session details",
+		// Sessions from before this only know when they expire, they count
+		// as created and last seen when the migration ran.
+		Up: execAll(
+			"ALTER TABLE sessions ADD COLUMN created_at DATETIME",
+			"ALTER TABLE sessions ADD COLUMN last_seen DATETIME",
+			"ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''",
+			"UPDATE sessions SET created_at = CURRENT_TIMESTAMP, last_seen = CURRENT_TIMESTAMP",
+		),
+		Down: execAll(
+			"ALTER TABLE sessions DROP COLUMN user_agent",
+			"ALTER TABLE sessions DROP COLUMN last_seen",
+			"ALTER TABLE sessions DROP COLUMN created_at",
+		),
+	},
+	{
+		Version: 9,
+		Name:    "two-factor authentication",
+		// A totp row stays disabled until the user proved their app works.
+		// last_step is the latest time step a code was accepted for, codes
+		// cannot be used twice. Recovery codes are kept as SHA-256 hashes,
+		// and a login waits in login_challenges for its second factor.
+		Up: execAll(
+			`CREATE TABLE totp (
+		nickname TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(nickname) REFERENCES users(nickname)
+	)`,
+			`CREATE TABLE recovery_codes (
+		nickname TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		PRIMARY KEY(nickname, code_hash),
+		FOREIGN KEY(nickname) REFERENCES users(nickname)
+	)`,
+			`CREATE TABLE login_challenges (
+		challenge TEXT PRIMARY KEY,
+		nickname TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY(nickname) REFERENCES users(nickname)
+	)`,
+		),
+		Down: execAll(
+			"DROP TABLE login_challenges",
+			"DROP TABLE recovery_codes",
+			"DROP TABLE totp",
+		),
+	},
+	{
+		Version: 10,
+		Name:    "email verification",
+		// Accounts from before verification existed are taken as verified,
+		// otherwise turning it on would lock every one of them out. Tokens
+		// are kept as SHA-256 hashes, purpose is reset or verify.
+		Up: execAll(
+			"ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE",
+			"UPDATE users SET email_verified = TRUE",
+			`CREATE TABLE email_tokens (
+		token_hash TEXT PRIMARY KEY,
+		nickname TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY(nickname) REFERENCES users(nickname)
+	)`,
+		),
+		Down: execAll(
+			"DROP TABLE email_tokens",
+			"ALTER TABLE users DROP COLUMN email_verified",
+		),
+	},
+	{
+		Version: 11,
+		Name:    "mail requests",
+		// Asking for a reset or verification mail is throttled on a table
+		// of its own. It used to be logged as a failed login under prefixed
+		// accounts, those rows are not login attempts and go.
+		Up: execAll(
+			`CREATE TABLE mail_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		requested_at DATETIME NOT NULL
+	)`,
+			"CREATE INDEX mail_requests_account ON mail_requests (account, requested_at)",
+			"CREATE INDEX mail_requests_ip ON mail_requests (ip, requested_at)",
+			"DELETE FROM login_attempts WHERE account LIKE 'mail:%' AND ip LIKE 'mail:%'",
+		),
+		Down: execAll(
+			"DROP INDEX mail_requests_ip",
+			"DROP INDEX mail_requests_account",
+			"DROP TABLE mail_requests",
+		),
+	},
+}
+
+// LatestVersion is the schema version the code expects.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version the database is at, 0 when no migration
+// ran yet.
+func SchemaVersion(db *sql.DB, d Dialect) (int, error) {
+	if err := ensureVersionTable(db, d); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// Migrate moves the schema up or down until it is at target.
+func Migrate(db *sql.DB, d Dialect, target int) error {
+	if target < 0 || target > LatestVersion() {
+		return fmt.Errorf("unknown schema version %d, latest is %d", target, LatestVersion())
+	}
+	current, err := SchemaVersion(db, d)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version > current && m.Version <= target {
+			if err := runMigration(db, d, m, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= current && m.Version > target {
+			if err := runMigration(db, d, m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func runMigration(db *sql.DB, d Dialect, m Migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	action := "Applied"
+	step, bookkeeping := m.Up, "INSERT INTO schema_version (version, name) VALUES (?, ?)"
+	args := []interface{}{m.Version, m.Name}
+	if !up {
+		action = "Reverted"
+		step, bookkeeping = m.Down, "DELETE FROM schema_version WHERE version = ?"
+		args = args[:1]
+	}
+
+	if err := step(tx, d); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	if _, err := tx.Exec(d.Rebind(bookkeeping), args...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("%s migration %d (%s)\n", action, m.Version, m.Name)
+	return nil
+}
+
+func ensureVersionTable(db *sql.DB, d Dialect) error {
+	_, err := db.Exec(d.Schema(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`))
+	return err
+}
+
+func execAll(statements ...string) func(tx *sql.Tx, d Dialect) error {
+	return func(tx *sql.Tx, d Dialect) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(d.Schema(statement)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func addColumn(tx *sql.Tx, d Dialect, table, column, definition string) error {
+	if d.Driver == Postgres.Driver {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, d.Schema(definition)))
+		return err
+	}
+
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
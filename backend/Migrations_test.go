@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"database/sql"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openTestSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(SQLite.Driver, filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schema returns the definition of every table and index, by name.
+func schema(t *testing.T, db *sql.DB) map[string]string {
+	t.Helper()
+	rows, err := db.Query("SELECT name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	definitions := make(map[string]string)
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			t.Fatal(err)
+		}
+		definitions[name] = definition
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return definitions
+}
+
+func migrateTo(t *testing.T, db *sql.DB, target int) {
+	t.Helper()
+	if err := Migrate(db, SQLite, target); err != nil {
+		t.Fatalf("migrating to %d: %v", target, err)
+	}
+	version, err := SchemaVersion(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != target {
+		t.Fatalf("schema at version %d after migrating to %d", version, target)
+	}
+}
+
+func TestMigrateUpDownUp(t *testing.T) {
+	db := openTestSQLite(t)
+	migrateTo(t, db, 0)
+	empty := schema(t, db)
+
+	migrateTo(t, db, LatestVersion())
+	head := schema(t, db)
+	for _, table := range []string{
+		"users", "posts", "comments", "messages", "sessions", "message_log", "user_seqs",
+		"chat_groups", "group_members", "group_invites", "login_attempts",
+		"totp", "recovery_codes", "login_challenges", "email_tokens", "mail_requests",
+	} {
+		if _, ok := head[table]; !ok {
+			t.Errorf("no table %s at version %d", table, LatestVersion())
+		}
+	}
+
+	migrateTo(t, db, 0)
+	if got := schema(t, db); !slices.Equal(keys(got), keys(empty)) {
+		t.Errorf("migrating down left %v, want %v", keys(got), keys(empty))
+	}
+
+	migrateTo(t, db, LatestVersion())
+	if got := schema(t, db); !maps.Equal(got, head) {
+		t.Errorf("migrating up again gave a different schema:\n%v\nwant\n%v", got, head)
+	}
+}
+
+// TestMigrateEachStep walks up and back down one version at a time, every
+// Down must undo its Up exactly.
+func TestMigrateEachStep(t *testing.T) {
+	db := openTestSQLite(t)
+	migrateTo(t, db, 0)
+	schemas := []map[string]string{schema(t, db)}
+	for version := 1; version <= LatestVersion(); version++ {
+		migrateTo(t, db, version)
+		schemas = append(schemas, schema(t, db))
+	}
+	for version := LatestVersion() - 1; version >= 0; version-- {
+		migrateTo(t, db, version)
+		if got := schema(t, db); !maps.Equal(got, schemas[version]) {
+			t.Errorf("reverting migration %d gave a different schema:\n%v\nwant\n%v", version+1, got, schemas[version])
+		}
+	}
+}
+
+// TestMigratePostgres runs migrations up, down and up again on the database
+// named by FORUM_TEST_POSTGRES_DSN, which is wiped.
+func TestMigratePostgres(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skip(postgresDSNEnv + " is not set")
+	}
+	db, err := sql.Open(Postgres.Driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tables := func() []string {
+		t.Helper()
+		rows, err := db.Query("SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	migrate := func(target int) {
+		t.Helper()
+		if err := Migrate(db, Postgres, target); err != nil {
+			t.Fatalf("migrating to %d: %v", target, err)
+		}
+		version, err := SchemaVersion(db, Postgres)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != target {
+			t.Fatalf("schema at version %d after migrating to %d", version, target)
+		}
+	}
+
+	migrate(0)
+	migrate(LatestVersion())
+	head := tables()
+	if !slices.Contains(head, "email_tokens") || !slices.Contains(head, "users") {
+		t.Fatalf("tables at version %d: %v", LatestVersion(), head)
+	}
+	migrate(0)
+	if got := tables(); !slices.Equal(got, []string{"schema_version"}) {
+		t.Errorf("migrating down left %v", got)
+	}
+	migrate(LatestVersion())
+	if got := tables(); !slices.Equal(got, head) {
+		t.Errorf("migrating up again gave %v, want %v", got, head)
+	}
+}
+
+func TestMigrateUnknownVersion(t *testing.T) {
+	db := openTestSQLite(t)
+	for _, target := range []int{-1, LatestVersion() + 1} {
+		if err := Migrate(db, SQLite, target); err == nil {
+			t.Errorf("migrating to %d succeeded", target)
+		}
+	}
+}
+
+func keys(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -1,6 +1,6 @@
 package backend
 
-import "github.com/gorilla/websocket"
+import "time"
 
 type Post struct {
 	ID        int    `json:"id"`
@@ -11,11 +11,13 @@ type Post struct {
 	Author    string `json:"author"`
 }
 
+// Notification is an unread count, either from Sender or, with GroupID set,
+// in that group.
 type Notification struct {
-	ID       int    `json:"id"`
 	Receiver string `json:"receiver_nickname"`
-	Sender   string `json:"sender_nickname"`
-	Unread   *int    `json:"unread_messages"`
+	Sender   string `json:"sender_nickname,omitempty"`
+	GroupID  int64  `json:"group_id,omitempty"`
+	Unread   int    `json:"unread_messages"`
 }
 
 type Comment struct {
@@ -26,24 +28,84 @@ type Comment struct {
 	Author    string `json:"author"`
 }
 
+// Message goes either to one user, To, or to every member of a group.
 type Message struct {
+	ID          int64  `json:"id"`
+	From        string `json:"from"`
+	To          string `json:"to,omitempty"`
+	GroupID     int64  `json:"group_id,omitempty"`
+	Content     string `json:"content"`
+	Timestamp   string `json:"timestamp"`
+	DeliveredAt string `json:"delivered_at,omitempty"`
+	ReadAt      string `json:"read_at,omitempty"`
+	// ClientID is picked by the sending client, a message sent twice with
+	// the same one is only stored once.
+	ClientID string `json:"client_id,omitempty"`
+	// Seq is the message's number in the sequence of whoever receives the
+	// frame, see Protocol.go.
+	Seq int64 `json:"seq,omitempty"`
+}
+
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor int64     `json:"next_cursor,omitempty"`
+	HasMore    bool      `json:"has_more"`
+}
+
+// Conversation is a sidebar entry, a user or, with GroupID set, a group.
+type Conversation struct {
+	Nickname      string `json:"nickname,omitempty"`
+	GroupID       int64  `json:"group_id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Online        bool   `json:"online"`
+	LastMessageID int64  `json:"last_message_id,omitempty"`
+	LastSender    string `json:"last_sender,omitempty"`
+	LastMessage   string `json:"last_message,omitempty"`
+	LastMessageAt string `json:"last_message_at,omitempty"`
+	Unread        int    `json:"unread_messages"`
+}
+
+type Receipt struct {
+	MessageID int64  `json:"id"`
 	From      string `json:"from"`
 	To        string `json:"to"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
+	GroupID   int64  `json:"group_id,omitempty"`
+	Status    string `json:"status"`
+	At        string `json:"at"`
 }
 
 type TypingIndicator struct {
-	Type     string `json:"type"`
 	From     string `json:"from"`
-	To       string `json:"to"`
+	To       string `json:"to,omitempty"`
+	GroupID  int64  `json:"group_id,omitempty"`
 	IsTyping bool   `json:"isTyping"`
 }
 
-type Client struct {
-	ID       string          `json:"id"` // Added ID field
-	Conn     *websocket.Conn `json:"-"`  // Added json:"-" to exclude from JSON
-	Username string          `json:"username"`
+// Group is a named conversation between its members. The owner invites and
+// removes members.
+type Group struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	Owner     string   `json:"owner"`
+	Members   []string `json:"members"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// GroupInvite lets Nickname join a group until it is accepted or declined.
+type GroupInvite struct {
+	GroupID   int64  `json:"group_id"`
+	Name      string `json:"name"`
+	Nickname  string `json:"nickname"`
+	InvitedBy string `json:"invited_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+// GroupRequest is the body of the /groups endpoints, each reads the fields
+// it needs.
+type GroupRequest struct {
+	GroupID  int64  `json:"group_id"`
+	Name     string `json:"name"`
+	Nickname string `json:"nickname"`
 }
 
 type User struct {
@@ -57,12 +119,41 @@ type User struct {
 	Gender    string `json:"gender"`
 }
 
-type LoginUser struct {
+// Session is one login as its user sees it. ID stands in for the token,
+// which never leaves the cookie, and Current marks the caller's own session.
+type Session struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+}
+
+// SessionRequest is the body of /sessions/revoke.
+type SessionRequest struct {
+	ID string `json:"id"`
+}
+
+// TwoFactorRequest is the body of the /2fa endpoints and of /login/2fa,
+// which also needs the challenge handed out by /login. Code is a code from
+// the authenticator or a recovery code.
+type TwoFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Nickname  string `json:"nickname"`
+}
+
+// EmailRequest is the body of the /password and /email endpoints, each
+// reads the fields it needs. Token comes from the link in a mail.
+type EmailRequest struct {
 	Identifier string `json:"identifier"`
+	Token      string `json:"token"`
 	Password   string `json:"password"`
 }
 
-type WSMessage struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
-}
\ No newline at end of file
+type LoginUser struct {
+	Identifier string `json:"identifier"`
+	Password   string `json:"password"`
+}
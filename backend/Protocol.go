@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/twinj/uuid"
+)
+
+// Every websocket frame, in both directions, is a JSON Envelope:
+//
+//	{"type": "message", "id": "c-42", "version": 1, "payload": {...}}
+//
+// Client to server:
+//
+//	message    payload Message (only "to" or "group_id", "content" and
+//	           "client_id" are read), answered with an ack carrying the same
+//	           id
+//	typing     payload TypingIndicator (only "to" or "group_id" and
+//	           "isTyping" are read)
+//	receipt    payload Receipt (only "id", "group_id" and "status" are read),
+//	           sent by the recipient with status "delivered" when a message
+//	           arrives and "read" once it has been seen. In a group only
+//	           "read" counts, it moves the reader's own unread count.
+//	resume     payload ResumePayload, sent after connecting, answered with
+//	           the missed messages and then a resumed frame with the same id
+//
+// Server to client:
+//
+//	message    payload Message
+//	typing     payload TypingIndicator, in a group every member gets it
+//	           and the client shows everyone it has seen start and not stop
+//	user_list  payload UserListPayload
+//	receipt    payload Receipt, sent to every session of both participants
+//	           when a message was delivered or read. A read receipt covers
+//	           every earlier message of the conversation as well.
+//	unread     payload Notification, the receiver's unread count for one
+//	           sender or group, sent whenever it changes
+//	conversation payload Conversation, one updated sidebar entry, sent when
+//	           a message is exchanged or read
+//	group      payload Group, sent to the members whenever the group changes
+//	           and to a user who left or was removed, who is no longer
+//	           among the members
+//	group_invite payload GroupInvite, sent to the invited user
+//	ack        payload AckPayload, id is the id of the acknowledged frame
+//	resumed    payload ResumedPayload, id is the id of the resume frame
+//	error      payload ErrorPayload, id is the id of the offending frame
+//	           when it could be read
+//
+// Every message a user sends or receives gets the next number in that user's
+// sequence, carried as "seq" in the message and ack frames. A client keeps the
+// highest seq it has seen and resumes from it after reconnecting, a client
+// without one, e.g. right after loading the page, resumes from 0 and only
+// learns the current seq and state. A seq higher than the current one is
+// answered the same way.
+//
+// A client should give every message a "client_id" of its own, unique among
+// the messages of that user, and resend it with the same client_id until it
+// is acknowledged. The server stores it only once and acknowledges every
+// copy with the stored message.
+//
+// Frames the server sends on its own get a fresh id. A frame with a version
+// other than ProtocolVersion is rejected with an error frame.
+const ProtocolVersion = 1
+
+// MaxClientIDLength bounds the client_id of a message.
+const MaxClientIDLength = 64
+
+const (
+	FrameMessage  = "message"
+	FrameTyping   = "typing"
+	FrameUserList = "user_list"
+	FrameReceipt  = "receipt"
+	FrameUnread   = "unread"
+
+	FrameConversation = "conversation"
+	FrameGroup        = "group"
+	FrameGroupInvite  = "group_invite"
+	FrameAck          = "ack"
+	FrameError        = "error"
+
+	FrameResume  = "resume"
+	FrameResumed = "resumed"
+)
+
+// Receipt statuses.
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrBadFrame           = "bad_frame"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownType        = "unknown_type"
+	ErrInvalidPayload     = "invalid_payload"
+	ErrNotFound           = "not_found"
+	ErrInternal           = "internal"
+)
+
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type AckPayload struct {
+	MessageID int64  `json:"message_id"`
+	Timestamp string `json:"timestamp"`
+	Seq       int64  `json:"seq,omitempty"`
+	// Message is the message as stored, with Seq in the sender's sequence.
+	Message Message `json:"message"`
+}
+
+func ackPayload(msg Message) AckPayload {
+	return AckPayload{MessageID: msg.ID, Timestamp: msg.Timestamp, Seq: msg.Seq, Message: msg}
+}
+
+type ResumePayload struct {
+	// Seq is the highest seq the client has seen.
+	Seq int64 `json:"seq"`
+}
+
+// ResumedPayload ends a resume. The client replaces its typing indicators and
+// unread counts with the ones given here.
+type ResumedPayload struct {
+	// Seq is the client's seq after the replay.
+	Seq int64 `json:"seq"`
+	// HasMore means the replay was cut short, the client resumes again from
+	// Seq to get the rest.
+	HasMore bool     `json:"has_more"`
+	Typing  []string `json:"typing"`
+	// GroupTyping is who is typing in each of the user's groups.
+	GroupTyping map[int64][]string `json:"group_typing"`
+	Unread      []Notification     `json:"unread"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type UserListPayload struct {
+	Users []string `json:"users"`
+}
+
+// NewFrame builds a server initiated frame with a fresh id.
+func NewFrame(frameType string, payload interface{}) Envelope {
+	return newEnvelope(frameType, uuid.NewV4().String(), payload)
+}
+
+// ReplyFrame builds a frame answering the client frame with the given id.
+func ReplyFrame(frameType string, id string, payload interface{}) Envelope {
+	return newEnvelope(frameType, id, payload)
+}
+
+func ErrorFrame(id string, code string, message string) Envelope {
+	return ReplyFrame(FrameError, id, ErrorPayload{Code: code, Message: message})
+}
+
+func newEnvelope(frameType string, id string, payload interface{}) Envelope {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Println("Encode Error:", err)
+	}
+	return Envelope{
+		Type:    frameType,
+		ID:      id,
+		Version: ProtocolVersion,
+		Payload: data,
+	}
+}
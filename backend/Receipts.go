@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// handleReceipt records that the recipient's client got or read a message and
+// tells both participants. Receipts for messages addressed to someone else
+// are rejected, repeated ones are ignored.
+func (s *Server) handleReceipt(client *Client, frameID string, receipt Receipt) {
+	if receipt.GroupID != 0 {
+		s.handleGroupReceipt(client, frameID, receipt)
+		return
+	}
+
+	sender, err := s.Store.MessageSender(receipt.MessageID, client.Username)
+	if err != nil {
+		if err != ErrNoRecord {
+			fmt.Println("DB Receipt Error:", err)
+		}
+		client.Send(ErrorFrame(frameID, ErrNotFound, "no such message for this user"))
+		return
+	}
+
+	receipt.From = sender
+	receipt.To = client.Username
+	receipt.At = time.Now().Format(time.RFC3339)
+
+	var changed bool
+	if receipt.Status == ReceiptDelivered {
+		changed, err = s.Store.MarkDelivered(receipt.MessageID, receipt.At)
+	} else {
+		changed, err = s.Store.MarkRead(receipt.From, receipt.To, receipt.MessageID, receipt.At)
+	}
+	if err != nil {
+		fmt.Println("DB Receipt Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "receipt could not be stored"))
+		return
+	}
+	if !changed {
+		return
+	}
+
+	frame := NewFrame(FrameReceipt, receipt)
+	s.sendTo(receipt.From, frame, nil)
+	s.sendTo(receipt.To, frame, client)
+
+	if receipt.Status == ReceiptRead {
+		s.sendUnread(receipt.To, receipt.From)
+		s.sendConversation(receipt.To, receipt.From)
+	}
+}
+
+// sendUnread pushes the current number of unread messages from sender to
+// every session of receiver.
+func (s *Server) sendUnread(receiver, sender string) {
+	if !s.isOnline(receiver) {
+		return
+	}
+
+	unread, err := s.Store.UnreadCount(receiver, sender)
+	if err != nil {
+		fmt.Println("DB Unread Error:", err)
+		return
+	}
+	notif := Notification{Receiver: receiver, Sender: sender, Unread: unread}
+	s.sendTo(receiver, NewFrame(FrameUnread, notif), nil)
+}
+
+// handleGroupReceipt moves the reader's marker in a group. Group messages have
+// no delivered state and nobody else learns who read what, so only the
+// reader's own sessions are updated.
+func (s *Server) handleGroupReceipt(client *Client, frameID string, receipt Receipt) {
+	if receipt.Status != ReceiptRead || !s.checkMember(client, frameID, receipt.GroupID) {
+		return
+	}
+
+	changed, err := s.Store.MarkGroupRead(receipt.GroupID, client.Username, receipt.MessageID)
+	if err != nil {
+		fmt.Println("DB Receipt Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "receipt could not be stored"))
+		return
+	}
+	if changed {
+		s.sendGroupUnread(client.Username, receipt.GroupID)
+		s.sendGroupConversation(client.Username, receipt.GroupID)
+	}
+}
+
+// sendGroupUnread pushes the number of unread messages in a group to every
+// session of the member.
+func (s *Server) sendGroupUnread(member string, groupID int64) {
+	if !s.isOnline(member) {
+		return
+	}
+
+	unread, err := s.Store.GroupUnreadCount(groupID, member)
+	if err != nil {
+		fmt.Println("DB Unread Error:", err)
+		return
+	}
+	notif := Notification{Receiver: member, GroupID: groupID, Unread: unread}
+	s.sendTo(member, NewFrame(FrameUnread, notif), nil)
+}
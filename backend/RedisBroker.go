@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisChannel is the pub/sub channel every instance publishes to.
+const RedisChannel = "forum:events"
+
+// RedisBroker fans events out through Redis pub/sub, so any number of server
+// instances sharing one Redis see each other's users. Events are not stored,
+// an instance only gets what was published while it was subscribed.
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+// NewRedisBroker connects to url, e.g. redis://localhost:6379/0.
+func NewRedisBroker(url, channel string) (*RedisBroker, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	return &RedisBroker{client: client, channel: channel}, nil
+}
+
+func (R *RedisBroker) Publish(event BrokerEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return R.client.Publish(context.Background(), R.channel, data).Err()
+}
+
+// Subscribe waits until Redis confirmed the subscription, so nothing
+// published after it returns is missed. go-redis resubscribes by itself when
+// the connection drops.
+func (R *RedisBroker) Subscribe(handler func(BrokerEvent)) error {
+	ctx := context.Background()
+	R.pubsub = R.client.Subscribe(ctx, R.channel)
+	if _, err := R.pubsub.Receive(ctx); err != nil {
+		R.pubsub.Close()
+		return err
+	}
+
+	go func() {
+		for msg := range R.pubsub.Channel() {
+			var event BrokerEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				fmt.Println("Broker Decode Error:", err)
+				continue
+			}
+			handler(event)
+		}
+	}()
+	return nil
+}
+
+func (R *RedisBroker) Close() error {
+	if R.pubsub != nil {
+		R.pubsub.Close()
+	}
+	return R.client.Close()
+}
@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"real-time-forum/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+// startInstance runs a server on store with the redis broker at redisURL
+// until the test ends and returns its address.
+func startInstance(t *testing.T, store Store, redisURL string) string {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Broker = "redis"
+	cfg.RedisURL = redisURL
+	addr, stop := runServer(t, &Server{Config: cfg, Store: store})
+	t.Cleanup(func() {
+		if err := stop(); err != nil {
+			t.Error("shutdown:", err)
+		}
+	})
+	return addr
+}
+
+// dial opens a websocket to addr with the given session token.
+func dial(t *testing.T, addr, session string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Cookie": {"session_token=" + session}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expectFrame reads frames from conn until one of type kind for which match
+// returns true, and fails the test if none comes.
+func expectFrame(t *testing.T, conn *websocket.Conn, kind string, match func(payload json.RawMessage) bool) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame Envelope
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for a %s frame: %v", kind, err)
+		}
+		if frame.Type == kind && match(frame.Payload) {
+			return
+		}
+	}
+}
+
+func usersOnline(usernames ...string) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var list UserListPayload
+		if err := json.Unmarshal(payload, &list); err != nil {
+			return false
+		}
+		return slices.Equal(list.Users, usernames)
+	}
+}
+
+func TestRedisBrokerAcrossInstances(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	redisURL := "redis://" + redisServer.Addr()
+
+	// Both instances share the database, as they would in production
+	store := newTestServer(t, "alice", "bob").Store
+	if err := store.CreateSession("alice2", "alice", "test", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	A := startInstance(t, store, redisURL)
+	B := startInstance(t, store, redisURL)
+
+	bob := dial(t, B, "bob")
+	expectFrame(t, bob, FrameUserList, usersOnline("bob"))
+
+	// Presence: each side sees the user connected to the other
+	alice := dial(t, A, "alice")
+	expectFrame(t, alice, FrameUserList, usersOnline("alice", "bob"))
+	expectFrame(t, bob, FrameUserList, usersOnline("alice", "bob"))
+
+	// Send: a message from A reaches the recipient on B
+	request := Envelope{Type: FrameMessage, ID: "1", Version: ProtocolVersion}
+	request.Payload, _ = json.Marshal(Message{To: "bob", Content: "hello from A"})
+	if err := alice.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, bob, FrameMessage, func(payload json.RawMessage) bool {
+		var msg Message
+		return json.Unmarshal(payload, &msg) == nil && msg.From == "alice" && msg.Content == "hello from A"
+	})
+
+	// Broadcast: an event published by anyone reaches every instance
+	broker, err := NewRedisBroker(redisURL, RedisChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	frame, _ := json.Marshal(NewFrame(FrameUserList, UserListPayload{Users: []string{"everyone"}}))
+	if err := broker.Publish(BrokerEvent{Kind: EventBroadcast, Instance: "test", Frame: frame}); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, alice, FrameUserList, usersOnline("everyone"))
+	expectFrame(t, bob, FrameUserList, usersOnline("everyone"))
+
+	// Revoke: logging out the other sessions on A closes the one on B
+	alice2 := dial(t, B, "alice2")
+	r, err := http.NewRequest(http.MethodPost, "http://"+A+"/sessions/revoke-others", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: "session_token", Value: "alice"})
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("revoking the other sessions: got %d", response.StatusCode)
+	}
+	alice2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := alice2.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != SessionRevokedReason {
+			t.Fatalf("got %v, want the session to be revoked", err)
+		}
+		break
+	}
+
+	// Presence again: alice leaving A is seen on B
+	alice.Close()
+	expectFrame(t, bob, FrameUserList, usersOnline("bob"))
+}
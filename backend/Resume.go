@@ -0,0 +1,67 @@
+package backend
+
+import "fmt"
+
+// MaxResumeMessages caps one replay, a client that missed more resumes again.
+// Replays are also kept to half the send queue so they never get a client
+// evicted as a slow consumer.
+const MaxResumeMessages = 200
+
+// handleResume brings a reconnecting client up to date: it replays the
+// messages after seq and then sends a resumed frame with the current typing
+// indicators and unread counts. A client resuming from 0 has just loaded
+// everything over HTTP and only gets the resumed frame. So does a client
+// ahead of the sequence, whose seq was never given out, e.g. from before the
+// database was reset: it would miss every message up to its seq otherwise.
+func (s *Server) handleResume(client *Client, frameID string, seq int64) {
+	resumed := ResumedPayload{Seq: seq}
+
+	latest, err := s.Store.LatestSeq(client.Username)
+	if err != nil {
+		fmt.Println("DB Resume Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "could not resume"))
+		return
+	}
+	if seq == 0 || seq > latest {
+		resumed.Seq = latest
+	} else {
+		limit := max(min(MaxResumeMessages, client.config.SendQueueSize/2), 1)
+		missed, err := s.Store.MessagesSince(client.Username, seq, limit+1)
+		if err != nil {
+			fmt.Println("DB Resume Error:", err)
+			client.Send(ErrorFrame(frameID, ErrInternal, "could not resume"))
+			return
+		}
+		if len(missed) > limit {
+			missed = missed[:limit]
+			resumed.HasMore = true
+		}
+		for _, msg := range missed {
+			client.Send(NewFrame(FrameMessage, msg))
+			resumed.Seq = msg.Seq
+		}
+	}
+
+	unread, err := s.Store.UnreadCounts(client.Username)
+	if err != nil {
+		fmt.Println("DB Resume Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "could not resume"))
+		return
+	}
+	groups, err := s.Store.ListGroups(client.Username)
+	if err != nil {
+		fmt.Println("DB Resume Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "could not resume"))
+		return
+	}
+	resumed.Unread = unread
+	resumed.Typing = s.typing.TypingTo(client.Username)
+	resumed.GroupTyping = make(map[int64][]string)
+	for _, group := range groups {
+		if typing := s.typing.TypingIn(group.ID); len(typing) > 0 {
+			resumed.GroupTyping[group.ID] = typing
+		}
+	}
+
+	client.Send(ReplyFrame(FrameResumed, frameID, resumed))
+}
@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// resume has client resume from seq and returns the messages replayed and
+// the resumed frame that ends the replay.
+func resume(t *testing.T, S *Server, client *Client, seq int64) ([]Message, ResumedPayload) {
+	t.Helper()
+	S.handleResume(client, "r", seq)
+
+	var replayed []Message
+	for {
+		select {
+		case data := <-client.send:
+			var frame Envelope
+			if err := json.Unmarshal(data, &frame); err != nil {
+				t.Fatal(err)
+			}
+			switch frame.Type {
+			case FrameMessage:
+				var msg Message
+				if err := json.Unmarshal(frame.Payload, &msg); err != nil {
+					t.Fatal(err)
+				}
+				replayed = append(replayed, msg)
+			case FrameResumed:
+				var resumed ResumedPayload
+				if err := json.Unmarshal(frame.Payload, &resumed); err != nil {
+					t.Fatal(err)
+				}
+				if frame.ID != "r" {
+					t.Errorf("resumed frame with id %q", frame.ID)
+				}
+				return replayed, resumed
+			default:
+				t.Fatalf("unexpected %s frame: %s", frame.Type, frame.Payload)
+			}
+		default:
+			t.Fatal("no resumed frame")
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	S := newTestServer(t, "alice", "bob", "carol")
+	// Replays are kept to half the queue, 4 messages
+	S.hub = NewHub(WSConfig{SendQueueSize: 8})
+	S.typing = NewTypingTracker(time.Minute, func(TypingIndicator) {})
+	alice := testClient(S.hub, "1", "alice")
+
+	// alice's sequence numbers them 1 to 10, carol sees none of them
+	for i := 1; i <= 10; i++ {
+		msg := Message{From: "alice", To: "bob", Content: strconv.Itoa(i)}
+		if i%2 == 0 {
+			msg.From, msg.To = "bob", "alice"
+		}
+		sendMessage(t, S, msg)
+	}
+
+	for _, test := range []struct {
+		name    string
+		seq     int64
+		from    int64
+		to      int64
+		hasMore bool
+		latest  int64
+	}{
+		{"from the page load", 0, 0, 0, false, 10},
+		{"a few behind", 7, 8, 10, false, 10},
+		{"more behind than a replay", 2, 3, 6, true, 6},
+		{"from the first", 1, 2, 5, true, 5},
+		{"up to date", 10, 0, 0, false, 10},
+		{"ahead of the sequence", 99, 0, 0, false, 10},
+	} {
+		replayed, resumed := resume(t, S, alice, test.seq)
+		want := int64(0)
+		if test.from != 0 {
+			want = test.to - test.from + 1
+		}
+		if int64(len(replayed)) != want {
+			t.Errorf("%s: %d messages replayed, want %d", test.name, len(replayed), want)
+		}
+		for i, msg := range replayed {
+			if seq := test.from + int64(i); msg.Seq != seq || msg.Content != strconv.FormatInt(seq, 10) {
+				t.Errorf("%s: got seq %d %q at %d, want seq %d", test.name, msg.Seq, msg.Content, i, seq)
+			}
+		}
+		if resumed.Seq != test.latest || resumed.HasMore != test.hasMore {
+			t.Errorf("%s: resumed at %d, has_more %v, want %d, %v", test.name, resumed.Seq, resumed.HasMore, test.latest, test.hasMore)
+		}
+	}
+
+	// Resuming again from the seq given, as the client does, pages through
+	// everything in order
+	var seqs []int64
+	for seq, more := int64(1), true; more; {
+		replayed, resumed := resume(t, S, alice, seq)
+		for _, msg := range replayed {
+			seqs = append(seqs, msg.Seq)
+		}
+		seq, more = resumed.Seq, resumed.HasMore
+	}
+	if !slices.Equal(seqs, []int64{2, 3, 4, 5, 6, 7, 8, 9, 10}) {
+		t.Errorf("paged through seqs %v, want 2 to 10", seqs)
+	}
+
+	// Each user has a sequence of their own
+	carol := testClient(S.hub, "2", "carol")
+	if replayed, resumed := resume(t, S, carol, 3); len(replayed) != 0 || resumed.Seq != 0 {
+		t.Errorf("carol: %d messages replayed, resumed at %d", len(replayed), resumed.Seq)
+	}
+}
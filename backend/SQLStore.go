@@ -0,0 +1,1067 @@
+package backend
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLStore is the Store backed by a SQL database, SQLite or PostgreSQL. The
+// queries are written once with ? placeholders and rebound for the driver.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLStore connects to the database, dsn is a file path for SQLite and a
+// connection string for PostgreSQL.
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	dialect, err := DialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db, dialect: dialect}, nil
+}
+
+// Migrate brings the schema to the given version, see Migrations.go.
+func (S *SQLStore) Migrate(target int) error {
+	return Migrate(S.db, S.dialect, target)
+}
+
+func (S *SQLStore) SchemaVersion() (int, error) {
+	return SchemaVersion(S.db, S.dialect)
+}
+
+func (S *SQLStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return S.db.Exec(S.dialect.Rebind(query), args...)
+}
+
+func (S *SQLStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return S.db.Query(S.dialect.Rebind(query), args...)
+}
+
+func (S *SQLStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return S.db.QueryRow(S.dialect.Rebind(query), args...)
+}
+
+func (S *SQLStore) Close() error {
+	return S.db.Close()
+}
+
+func (S *SQLStore) UserExists(email, nickname string) (bool, error) {
+	var exists int
+	err := S.queryRow("SELECT COUNT(*) FROM users WHERE email = ? OR nickname = ?", email, nickname).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists > 0, nil
+}
+
+func (S *SQLStore) CreateUser(user User) error {
+	query := `INSERT INTO users (nickname, first_name, last_name, email, password, age, gender)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := S.exec(query, user.Nickname, user.FirstName, user.LastName, user.Email, user.Password, user.Age, user.Gender)
+	return err
+}
+
+func (S *SQLStore) GetCredentials(identifier string) (string, string, error) {
+	var nickname, hashedPassword string
+	err := S.queryRow(`
+		SELECT nickname, password FROM users
+		WHERE nickname = ? OR email = ?
+	`, identifier, identifier).Scan(&nickname, &hashedPassword)
+	if err == sql.ErrNoRows {
+		return "", "", ErrNoRecord
+	}
+	return nickname, hashedPassword, err
+}
+
+func (S *SQLStore) UserEmail(nickname string) (string, bool, error) {
+	var email string
+	var verified bool
+	err := S.queryRow("SELECT email, email_verified FROM users WHERE nickname = ?", nickname).Scan(&email, &verified)
+	if err == sql.ErrNoRows {
+		return "", false, ErrNoRecord
+	}
+	return email, verified, err
+}
+
+func (S *SQLStore) SetEmailVerified(nickname string) error {
+	_, err := S.exec("UPDATE users SET email_verified = ? WHERE nickname = ?", true, nickname)
+	return err
+}
+
+func (S *SQLStore) CreateEmailToken(hash, nickname, purpose string, at, expiresAt time.Time) error {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(S.dialect.Rebind("INSERT INTO email_tokens (token_hash, nickname, purpose, expires_at) VALUES (?, ?, ?, ?)"),
+		hash, nickname, purpose, expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	// Every token of a purpose lives as long, the newest expire last
+	_, err = tx.Exec(S.dialect.Rebind(`
+		DELETE FROM email_tokens
+		WHERE nickname = ? AND purpose = ? AND token_hash NOT IN (
+			SELECT token_hash FROM email_tokens
+			WHERE nickname = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+			ORDER BY expires_at DESC LIMIT ?)`),
+		nickname, purpose, nickname, purpose, at.UTC(), MaxEmailTokens)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (S *SQLStore) UseEmailToken(hash, purpose string, at time.Time) (string, error) {
+	var nickname string
+	err := S.queryRow(`
+        UPDATE email_tokens SET used_at = ?
+        WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+        RETURNING nickname
+    `, at.UTC(), hash, purpose, at.UTC()).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	}
+	return nickname, err
+}
+
+func (S *SQLStore) ResetPassword(hash, hashedPassword string, at time.Time) (string, error) {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var nickname string
+	err = tx.QueryRow(S.dialect.Rebind(`
+        UPDATE email_tokens SET used_at = ?
+        WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+        RETURNING nickname
+    `), at.UTC(), hash, TokenReset, at.UTC()).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(S.dialect.Rebind("UPDATE users SET password = ?, email_verified = ? WHERE nickname = ?"),
+		hashedPassword, true, nickname)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(S.dialect.Rebind("DELETE FROM email_tokens WHERE nickname = ? AND purpose = ?"),
+		nickname, TokenReset)
+	if err != nil {
+		return "", err
+	}
+	return nickname, tx.Commit()
+}
+
+func (S *SQLStore) CreateSession(sessionID, nickname, userAgent string, expiresAt time.Time) error {
+	now := time.Now().UTC()
+	_, err := S.exec(`
+        INSERT INTO sessions (session_id, nickname, expires_at, created_at, last_seen, user_agent)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, sessionID, nickname, expiresAt.UTC(), now, now, userAgent)
+	return err
+}
+
+func (S *SQLStore) SessionUser(sessionID string) (string, error) {
+	var username string
+	err := S.queryRow(`
+        SELECT nickname FROM sessions
+        WHERE session_id = ? AND expires_at > CURRENT_TIMESTAMP
+    `, sessionID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	}
+	return username, err
+}
+
+func (S *SQLStore) Session(sessionID string) (Session, error) {
+	session := Session{Token: sessionID}
+	err := S.queryRow(`
+        SELECT created_at, last_seen, expires_at, user_agent
+        FROM sessions
+        WHERE session_id = ? AND expires_at > CURRENT_TIMESTAMP
+    `, sessionID).Scan(&session.CreatedAt, &session.LastSeen, &session.ExpiresAt, &session.UserAgent)
+	if err == sql.ErrNoRows {
+		return session, ErrNoRecord
+	}
+	return session, err
+}
+
+func (S *SQLStore) TouchSession(sessionID string, at, expiresAt time.Time) error {
+	_, err := S.exec("UPDATE sessions SET last_seen = ?, expires_at = ? WHERE session_id = ?",
+		at.UTC(), expiresAt.UTC(), sessionID)
+	return err
+}
+
+func (S *SQLStore) ListSessions(nickname string) ([]Session, error) {
+	rows, err := S.query(`
+        SELECT session_id, created_at, last_seen, expires_at, user_agent
+        FROM sessions
+        WHERE nickname = ? AND expires_at > CURRENT_TIMESTAMP
+        ORDER BY last_seen DESC
+    `, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.Token, &session.CreatedAt, &session.LastSeen, &session.ExpiresAt, &session.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (S *SQLStore) DeleteSession(sessionID string) error {
+	_, err := S.exec("DELETE FROM sessions WHERE session_id = ?", sessionID)
+	return err
+}
+
+func (S *SQLStore) DeleteOtherSessions(nickname, keep string) ([]string, error) {
+	rows, err := S.query("DELETE FROM sessions WHERE nickname = ? AND session_id != ? RETURNING session_id",
+		nickname, keep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deleted []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, sessionID)
+	}
+	return deleted, rows.Err()
+}
+
+func (S *SQLStore) DeleteExpiredSessions(now time.Time) (map[string][]string, error) {
+	rows, err := S.query("DELETE FROM sessions WHERE expires_at <= ? RETURNING nickname, session_id", now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := make(map[string][]string)
+	for rows.Next() {
+		var nickname, sessionID string
+		if err := rows.Scan(&nickname, &sessionID); err != nil {
+			return nil, err
+		}
+		deleted[nickname] = append(deleted[nickname], sessionID)
+	}
+	return deleted, rows.Err()
+}
+
+func (S *SQLStore) TOTP(nickname string) (TOTP, error) {
+	var totp TOTP
+	err := S.queryRow("SELECT secret, enabled, last_step FROM totp WHERE nickname = ?", nickname).
+		Scan(&totp.Secret, &totp.Enabled, &totp.LastStep)
+	if err == sql.ErrNoRows {
+		return totp, ErrNoRecord
+	}
+	return totp, err
+}
+
+func (S *SQLStore) SetTOTPSecret(nickname, secret string) (bool, error) {
+	return changed(S.exec(`
+        INSERT INTO totp (nickname, secret, enabled, last_step) VALUES (?, ?, ?, 0)
+        ON CONFLICT (nickname) DO UPDATE SET secret = excluded.secret, last_step = 0
+        WHERE NOT totp.enabled
+    `, nickname, secret, false))
+}
+
+func (S *SQLStore) EnableTOTP(nickname string, step int64) (bool, error) {
+	return changed(S.exec("UPDATE totp SET enabled = ?, last_step = ? WHERE nickname = ? AND NOT enabled AND last_step < ?",
+		true, step, nickname, step))
+}
+
+func (S *SQLStore) UseTOTPStep(nickname string, step int64) (bool, error) {
+	return changed(S.exec("UPDATE totp SET last_step = ? WHERE nickname = ? AND enabled AND last_step < ?",
+		step, nickname, step))
+}
+
+func (S *SQLStore) DeleteTOTP(nickname string) (bool, error) {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(S.dialect.Rebind("DELETE FROM recovery_codes WHERE nickname = ?"), nickname); err != nil {
+		return false, err
+	}
+	deleted, err := changed(tx.Exec(S.dialect.Rebind("DELETE FROM totp WHERE nickname = ?"), nickname))
+	if err != nil {
+		return false, err
+	}
+	return deleted, tx.Commit()
+}
+
+func (S *SQLStore) ReplaceRecoveryCodes(nickname string, hashes []string) error {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(S.dialect.Rebind("DELETE FROM recovery_codes WHERE nickname = ?"), nickname); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err := tx.Exec(S.dialect.Rebind("INSERT INTO recovery_codes (nickname, code_hash) VALUES (?, ?)"), nickname, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (S *SQLStore) UseRecoveryCode(nickname, hash string, at time.Time) (bool, error) {
+	return changed(S.exec("UPDATE recovery_codes SET used_at = ? WHERE nickname = ? AND code_hash = ? AND used_at IS NULL",
+		at.UTC(), nickname, hash))
+}
+
+func (S *SQLStore) RecoveryCodesLeft(nickname string) (int, error) {
+	var count int
+	err := S.queryRow("SELECT COUNT(*) FROM recovery_codes WHERE nickname = ? AND used_at IS NULL", nickname).Scan(&count)
+	return count, err
+}
+
+func (S *SQLStore) CreateLoginChallenge(challenge, nickname string, expiresAt time.Time) error {
+	_, err := S.exec("INSERT INTO login_challenges (challenge, nickname, expires_at) VALUES (?, ?, ?)",
+		challenge, nickname, expiresAt.UTC())
+	return err
+}
+
+func (S *SQLStore) ChallengeUser(challenge string) (string, error) {
+	var nickname string
+	err := S.queryRow("SELECT nickname FROM login_challenges WHERE challenge = ? AND expires_at > CURRENT_TIMESTAMP",
+		challenge).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	}
+	return nickname, err
+}
+
+func (S *SQLStore) DeleteLoginChallenge(challenge string) error {
+	_, err := S.exec("DELETE FROM login_challenges WHERE challenge = ?", challenge)
+	return err
+}
+
+func (S *SQLStore) DeleteExpiredChallenges(now time.Time) error {
+	_, err := S.exec("DELETE FROM login_challenges WHERE expires_at <= ?", now.UTC())
+	return err
+}
+
+func (S *SQLStore) RecordLogin(attempt LoginAttempt) error {
+	_, err := S.exec(
+		"INSERT INTO login_attempts (account, ip, succeeded, reason, attempted_at) VALUES (?, ?, ?, ?, ?)",
+		attempt.Account, attempt.IP, attempt.Succeeded, attempt.Reason, attempt.At.UTC(),
+	)
+	return err
+}
+
+func (S *SQLStore) AccountFailures(account string, since time.Time) (int, time.Time, error) {
+	return S.loginFailures(`account = ? AND id > COALESCE(
+            (SELECT MAX(id) FROM login_attempts WHERE account = ? AND succeeded), 0)`,
+		account, account, since.UTC())
+}
+
+func (S *SQLStore) IPFailures(ip string, since time.Time) (int, time.Time, error) {
+	return S.loginFailures("ip = ?", ip, since.UTC())
+}
+
+// loginFailures counts the failures matching where, whose arguments come
+// before since, and returns the latest.
+func (S *SQLStore) loginFailures(where string, args ...interface{}) (int, time.Time, error) {
+	var count int
+	var last time.Time
+	err := S.queryRow(`
+        SELECT attempted_at, COUNT(*) OVER ()
+        FROM login_attempts
+        WHERE `+where+` AND attempted_at > ? AND NOT succeeded AND reason != ?
+        ORDER BY id DESC
+        LIMIT 1
+    `, append(args, LoginLocked)...).Scan(&last, &count)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	return count, last, err
+}
+
+func (S *SQLStore) RecordMailRequest(account, ip string, at time.Time) error {
+	_, err := S.exec(
+		"INSERT INTO mail_requests (account, ip, requested_at) VALUES (?, ?, ?)",
+		account, ip, at.UTC(),
+	)
+	return err
+}
+
+func (S *SQLStore) AccountMailRequests(account string, since time.Time) (int, time.Time, error) {
+	return S.mailRequests("account = ?", account, since.UTC())
+}
+
+func (S *SQLStore) IPMailRequests(ip string, since time.Time) (int, time.Time, error) {
+	return S.mailRequests("ip = ?", ip, since.UTC())
+}
+
+// mailRequests counts the requests matching where, whose arguments come
+// before since, and returns the oldest.
+func (S *SQLStore) mailRequests(where string, args ...interface{}) (int, time.Time, error) {
+	var count int
+	var oldest time.Time
+	err := S.queryRow(`
+        SELECT requested_at, COUNT(*) OVER ()
+        FROM mail_requests
+        WHERE `+where+` AND requested_at > ?
+        ORDER BY requested_at
+        LIMIT 1
+    `, args...).Scan(&oldest, &count)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	return count, oldest, err
+}
+
+func (S *SQLStore) DeleteMailRequests(before time.Time) error {
+	_, err := S.exec("DELETE FROM mail_requests WHERE requested_at < ?", before.UTC())
+	return err
+}
+
+func (S *SQLStore) CreatePost(author string, post Post) error {
+	_, err := S.exec(
+		"INSERT INTO posts (user_id, title, content, category) VALUES ((SELECT id FROM users WHERE nickname = ?), ?, ?, ?)",
+		author, post.Title, post.Content, post.Category,
+	)
+	return err
+}
+
+func (S *SQLStore) ListPosts() ([]Post, error) {
+	rows, err := S.query(`
+        SELECT posts.id, posts.title, posts.content, posts.category, posts.created_at, users.nickname
+        FROM posts
+        JOIN users ON posts.user_id = users.id
+        ORDER BY posts.created_at DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Category, &p.CreatedAt, &p.Author)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+func (S *SQLStore) CreateComment(author string, comment Comment) error {
+	_, err := S.exec(
+		"INSERT INTO comments (post_id, user_id, content) VALUES (?, (SELECT id FROM users WHERE nickname = ?), ?)",
+		comment.PostID, author, comment.Content,
+	)
+	return err
+}
+
+func (S *SQLStore) ListComments(postID int) ([]Comment, error) {
+	rows, err := S.query(`
+        SELECT comments.id, comments.post_id, comments.content, comments.created_at, users.nickname
+        FROM comments
+        JOIN users ON comments.user_id = users.id
+        WHERE comments.post_id = ?
+        ORDER BY comments.created_at ASC
+    `, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		err := rows.Scan(&c.ID, &c.PostID, &c.Content, &c.CreatedAt, &c.Author)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (S *SQLStore) CreateMessage(msg Message) (int64, map[string]int64, error) {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	// RETURNING works on both drivers, LastInsertId does not. A repeated
+	// client id inserts nothing and so returns no row.
+	var id int64
+	err = tx.QueryRow(S.dialect.Rebind(`
+		INSERT INTO messages (sender, receiver, group_id, content, timestamp, client_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (sender, client_id) DO NOTHING RETURNING id`),
+		msg.From, msg.To, sql.NullInt64{Int64: msg.GroupID, Valid: msg.GroupID != 0}, msg.Content, msg.Timestamp,
+		sql.NullString{String: msg.ClientID, Valid: msg.ClientID != ""}).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil, ErrDuplicateMessage
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	members := participants(msg)
+	if msg.GroupID != 0 {
+		members, err = S.groupMembers(tx, msg.GroupID)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	seqs := make(map[string]int64)
+	for _, nickname := range members {
+		var seq int64
+		err := tx.QueryRow(S.dialect.Rebind(`
+			INSERT INTO user_seqs (nickname, seq) VALUES (?, 1)
+			ON CONFLICT (nickname) DO UPDATE SET seq = user_seqs.seq + 1
+			RETURNING seq`), nickname).Scan(&seq)
+		if err != nil {
+			return 0, nil, err
+		}
+		_, err = tx.Exec(S.dialect.Rebind("INSERT INTO message_log (nickname, seq, message_id) VALUES (?, ?, ?)"),
+			nickname, seq, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		seqs[nickname] = seq
+	}
+	return id, seqs, tx.Commit()
+}
+
+func (S *SQLStore) MessageByClientID(sender, clientID string) (Message, error) {
+	row := S.queryRow(`
+		SELECT `+messageColumns+`, l.seq
+		FROM messages m
+		JOIN message_log l ON l.message_id = m.id AND l.nickname = m.sender
+		WHERE m.sender = ? AND m.client_id = ?`,
+		sender, clientID)
+	msg, err := scanMessage(row, true)
+	if err == sql.ErrNoRows {
+		return msg, ErrNoRecord
+	}
+	return msg, err
+}
+
+func (S *SQLStore) MessagesSince(nickname string, seq int64, limit int) ([]Message, error) {
+	rows, err := S.query(`
+		SELECT `+messageColumns+`, l.seq
+		FROM message_log l
+		JOIN messages m ON m.id = l.message_id
+		WHERE l.nickname = ? AND l.seq > ?
+		ORDER BY l.seq ASC LIMIT ?`,
+		nickname, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows, true)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (S *SQLStore) LatestSeq(nickname string) (int64, error) {
+	var seq int64
+	err := S.queryRow("SELECT seq FROM user_seqs WHERE nickname = ?", nickname).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func (S *SQLStore) ListMessages(query MessageQuery) ([]Message, error) {
+	sqlQuery := `
+	SELECT ` + messageColumns + `
+	FROM messages m
+	WHERE ((sender = ? AND receiver = ?) OR (sender = ? AND receiver = ?))`
+	args := []interface{}{query.User, query.Other, query.Other, query.User}
+	if query.GroupID != 0 {
+		sqlQuery = `
+	SELECT ` + messageColumns + `
+	FROM messages m
+	WHERE group_id = ?`
+		args = []interface{}{query.GroupID}
+	}
+	if query.After != 0 {
+		sqlQuery += " AND id > ? ORDER BY id ASC LIMIT ?"
+		args = append(args, query.After, query.Limit)
+	} else {
+		if query.Before != 0 {
+			sqlQuery += " AND id < ?"
+			args = append(args, query.Before)
+		}
+		sqlQuery += " ORDER BY id DESC LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
+	rows, err := S.query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// messageColumns are the columns scanMessage reads, from messages aliased m.
+const messageColumns = "m.id, m.sender, m.receiver, m.group_id, m.content, m.timestamp, m.delivered_at, m.read_at, m.client_id"
+
+// scanMessage reads messageColumns, followed by the seq when withSeq is set.
+func scanMessage(row interface{ Scan(...any) error }, withSeq bool) (Message, error) {
+	var msg Message
+	var groupID sql.NullInt64
+	var deliveredAt, readAt, clientID sql.NullString
+	dest := []any{&msg.ID, &msg.From, &msg.To, &groupID, &msg.Content, &msg.Timestamp, &deliveredAt, &readAt, &clientID}
+	if withSeq {
+		dest = append(dest, &msg.Seq)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return msg, err
+	}
+	msg.GroupID = groupID.Int64
+	msg.DeliveredAt = deliveredAt.String
+	msg.ReadAt = readAt.String
+	msg.ClientID = clientID.String
+	return msg, nil
+}
+
+func (S *SQLStore) MessageSender(id int64, receiver string) (string, error) {
+	var sender string
+	err := S.queryRow("SELECT sender FROM messages WHERE id = ? AND receiver = ?", id, receiver).Scan(&sender)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	}
+	return sender, err
+}
+
+func (S *SQLStore) MarkDelivered(id int64, at string) (bool, error) {
+	result, err := S.exec(`
+		UPDATE messages SET delivered_at = ?
+		WHERE id = ? AND delivered_at IS NULL`,
+		at, id)
+	return changed(result, err)
+}
+
+func (S *SQLStore) MarkRead(sender, receiver string, upTo int64, at string) (bool, error) {
+	result, err := S.exec(`
+		UPDATE messages SET read_at = ?, delivered_at = COALESCE(delivered_at, ?)
+		WHERE sender = ? AND receiver = ? AND id <= ? AND read_at IS NULL`,
+		at, at, sender, receiver, upTo)
+	return changed(result, err)
+}
+
+func (S *SQLStore) UnreadCounts(receiver string) ([]Notification, error) {
+	rows, err := S.query(`
+		SELECT sender, 0, COUNT(*) FROM messages
+		WHERE receiver = ? AND read_at IS NULL
+		GROUP BY sender
+		UNION ALL
+		SELECT '', gm.group_id, COUNT(*) FROM group_members gm
+		JOIN messages m ON m.group_id = gm.group_id AND m.id > gm.last_read AND m.sender != gm.nickname
+		WHERE gm.nickname = ?
+		GROUP BY gm.group_id
+		ORDER BY 2, 1`, receiver, receiver)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		notif := Notification{Receiver: receiver}
+		if err := rows.Scan(&notif.Sender, &notif.GroupID, &notif.Unread); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notif)
+	}
+	return notifications, rows.Err()
+}
+
+func (S *SQLStore) UnreadCount(receiver, sender string) (int, error) {
+	var unread int
+	err := S.queryRow(`
+		SELECT COUNT(*) FROM messages
+		WHERE receiver = ? AND sender = ? AND read_at IS NULL`,
+		receiver, sender).Scan(&unread)
+	return unread, err
+}
+
+func (S *SQLStore) CreateGroup(name, owner string) (int64, error) {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(S.dialect.Rebind("INSERT INTO chat_groups (name, owner) VALUES (?, ?) RETURNING id"),
+		name, owner).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(S.dialect.Rebind("INSERT INTO group_members (group_id, nickname) VALUES (?, ?)"), id, owner)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (S *SQLStore) Group(id int64) (Group, error) {
+	var group Group
+	err := S.queryRow("SELECT id, name, owner, created_at FROM chat_groups WHERE id = ?", id).
+		Scan(&group.ID, &group.Name, &group.Owner, &group.CreatedAt)
+	if err == sql.ErrNoRows {
+		return group, ErrNoRecord
+	}
+	if err != nil {
+		return group, err
+	}
+	group.Members, err = S.groupMembers(S.db, id)
+	return group, err
+}
+
+func (S *SQLStore) ListGroups(nickname string) ([]Group, error) {
+	rows, err := S.query(`
+		SELECT g.id, g.name, g.owner, g.created_at
+		FROM group_members gm
+		JOIN chat_groups g ON g.id = gm.group_id
+		WHERE gm.nickname = ?
+		ORDER BY g.id`, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.ID, &group.Name, &group.Owner, &group.CreatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range groups {
+		groups[i].Members, err = S.groupMembers(S.db, groups[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// querier is what the database and a transaction have in common.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// groupMembers lists a group's members, oldest first.
+func (S *SQLStore) groupMembers(q querier, groupID int64) ([]string, error) {
+	rows, err := q.Query(S.dialect.Rebind(`
+		SELECT nickname FROM group_members
+		WHERE group_id = ? ORDER BY joined_at, nickname`), groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var nickname string
+		if err := rows.Scan(&nickname); err != nil {
+			return nil, err
+		}
+		members = append(members, nickname)
+	}
+	return members, rows.Err()
+}
+
+func (S *SQLStore) CreateInvite(groupID int64, nickname, invitedBy string) error {
+	var users int
+	if err := S.queryRow("SELECT COUNT(*) FROM users WHERE nickname = ?", nickname).Scan(&users); err != nil {
+		return err
+	}
+	if users == 0 {
+		return ErrNoRecord
+	}
+	_, err := S.exec(`
+		INSERT INTO group_invites (group_id, nickname, invited_by) VALUES (?, ?, ?)
+		ON CONFLICT (group_id, nickname) DO NOTHING`,
+		groupID, nickname, invitedBy)
+	return err
+}
+
+func (S *SQLStore) ListInvites(nickname string) ([]GroupInvite, error) {
+	rows, err := S.query(`
+		SELECT i.group_id, g.name, i.nickname, i.invited_by, i.created_at
+		FROM group_invites i
+		JOIN chat_groups g ON g.id = i.group_id
+		WHERE i.nickname = ?
+		ORDER BY i.created_at, i.group_id`, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []GroupInvite{}
+	for rows.Next() {
+		var invite GroupInvite
+		err := rows.Scan(&invite.GroupID, &invite.Name, &invite.Nickname, &invite.InvitedBy, &invite.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (S *SQLStore) AcceptInvite(groupID int64, nickname string) error {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(S.dialect.Rebind("DELETE FROM group_invites WHERE group_id = ? AND nickname = ?"),
+		groupID, nickname)
+	if found, err := changed(result, err); err != nil || !found {
+		if err == nil {
+			err = ErrNoRecord
+		}
+		return err
+	}
+	// Only messages sent after joining count as unread
+	_, err = tx.Exec(S.dialect.Rebind(`
+		INSERT INTO group_members (group_id, nickname, last_read)
+		VALUES (?, ?, COALESCE((SELECT MAX(id) FROM messages WHERE group_id = ?), 0))
+		ON CONFLICT (group_id, nickname) DO NOTHING`),
+		groupID, nickname, groupID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (S *SQLStore) DeleteInvite(groupID int64, nickname string) (bool, error) {
+	return changed(S.exec("DELETE FROM group_invites WHERE group_id = ? AND nickname = ?", groupID, nickname))
+}
+
+func (S *SQLStore) RemoveMember(groupID int64, nickname string) (bool, error) {
+	tx, err := S.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(S.dialect.Rebind("DELETE FROM group_members WHERE group_id = ? AND nickname = ?"),
+		groupID, nickname)
+	if removed, err := changed(result, err); err != nil || !removed {
+		return false, err
+	}
+	// An empty group keeps its last owner
+	_, err = tx.Exec(S.dialect.Rebind(`
+		UPDATE chat_groups SET owner = COALESCE((
+			SELECT nickname FROM group_members
+			WHERE group_id = ? ORDER BY joined_at, nickname LIMIT 1), owner)
+		WHERE id = ? AND owner = ?`),
+		groupID, groupID, nickname)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (S *SQLStore) MarkGroupRead(groupID int64, nickname string, upTo int64) (bool, error) {
+	result, err := S.exec(`
+		UPDATE group_members SET last_read = ?
+		WHERE group_id = ? AND nickname = ? AND last_read < ?
+		AND EXISTS (SELECT 1 FROM messages WHERE id = ? AND group_id = ?)`,
+		upTo, groupID, nickname, upTo, upTo, groupID)
+	return changed(result, err)
+}
+
+func (S *SQLStore) GroupUnreadCount(groupID int64, nickname string) (int, error) {
+	var unread int
+	err := S.queryRow(`
+		SELECT COUNT(*) FROM messages m
+		JOIN group_members gm ON gm.group_id = m.group_id AND gm.nickname = ?
+		WHERE m.group_id = ? AND m.id > gm.last_read AND m.sender != gm.nickname`,
+		nickname, groupID).Scan(&unread)
+	return unread, err
+}
+
+// conversationQuery lists other users as seen by the viewer (the first four
+// placeholders), together with the last message exchanged with them and how
+// many of their messages the viewer has not read yet.
+const conversationQuery = `
+	SELECT u.nickname, lm.id, lm.sender, lm.content, lm.timestamp,
+		(SELECT COUNT(*) FROM messages
+			WHERE sender = u.nickname AND receiver = ? AND read_at IS NULL)
+	FROM users u
+	LEFT JOIN messages lm ON lm.id = (
+		SELECT id FROM messages
+		WHERE (sender = u.nickname AND receiver = ?) OR (sender = ? AND receiver = u.nickname)
+		ORDER BY id DESC LIMIT 1)
+	WHERE u.nickname != ?`
+
+func (S *SQLStore) Conversations(viewer string) ([]Conversation, error) {
+	rows, err := S.query(conversationQuery, viewer, viewer, viewer, viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		conversation, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+func (S *SQLStore) Conversation(viewer, other string) (Conversation, error) {
+	row := S.queryRow(conversationQuery+" AND u.nickname = ?", viewer, viewer, viewer, viewer, other)
+	conversation, err := scanConversation(row)
+	if err == sql.ErrNoRows {
+		return conversation, ErrNoRecord
+	}
+	return conversation, err
+}
+
+// groupConversationQuery lists the viewer's groups (both placeholders) like
+// conversationQuery lists users.
+const groupConversationQuery = `
+	SELECT g.id, g.name, lm.id, lm.sender, lm.content, lm.timestamp,
+		(SELECT COUNT(*) FROM messages
+			WHERE group_id = g.id AND id > gm.last_read AND sender != gm.nickname)
+	FROM group_members gm
+	JOIN chat_groups g ON g.id = gm.group_id
+	LEFT JOIN messages lm ON lm.id = (SELECT MAX(id) FROM messages WHERE group_id = g.id)
+	WHERE gm.nickname = ?`
+
+func (S *SQLStore) GroupConversations(viewer string) ([]Conversation, error) {
+	rows, err := S.query(groupConversationQuery, viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		conversation, err := scanGroupConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+func (S *SQLStore) GroupConversation(viewer string, groupID int64) (Conversation, error) {
+	row := S.queryRow(groupConversationQuery+" AND g.id = ?", viewer, groupID)
+	conversation, err := scanGroupConversation(row)
+	if err == sql.ErrNoRows {
+		return conversation, ErrNoRecord
+	}
+	return conversation, err
+}
+
+func scanConversation(row interface{ Scan(...any) error }) (Conversation, error) {
+	var conversation Conversation
+	err := scanSidebar(row, &conversation, &conversation.Nickname)
+	return conversation, err
+}
+
+func scanGroupConversation(row interface{ Scan(...any) error }) (Conversation, error) {
+	var conversation Conversation
+	err := scanSidebar(row, &conversation, &conversation.GroupID, &conversation.Name)
+	return conversation, err
+}
+
+// scanSidebar reads the columns naming the conversation into name and then
+// the last message and unread count shared by both conversation queries.
+func scanSidebar(row interface{ Scan(...any) error }, conversation *Conversation, name ...any) error {
+	var lastID sql.NullInt64
+	var lastSender, lastContent, lastAt sql.NullString
+	dest := append(name, &lastID, &lastSender, &lastContent, &lastAt, &conversation.Unread)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	conversation.LastMessageID = lastID.Int64
+	conversation.LastSender = lastSender.String
+	conversation.LastMessage = lastContent.String
+	conversation.LastMessageAt = lastAt.String
+	return nil
+}
+
+// changed turns the result of an UPDATE into whether it touched any row.
+func changed(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -2,46 +2,137 @@ package backend
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
+	"io/fs"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
+	"real-time-forum/config"
+
 	"github.com/gorilla/websocket"
 	"github.com/twinj/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ShutdownReason is sent in the close frame of every websocket when the
+// server stops.
+const ShutdownReason = "server shutting down"
+
 type Server struct {
-	db       *sql.DB
-	Mux      *http.ServeMux
-	clients  map[string][]*Client // Changed: map username to slice of clients
+	// Config falls back to config.Default() when nil.
+	Config *config.Config
+	// Assets holds static/ and templates/, usually embedded in the binary.
+	// Config.AssetsDir replaces it when set.
+	Assets fs.FS
+	Store  Store
+	// Broker falls back to the one named in Config when nil.
+	Broker Broker
+	// Mailer falls back to the one named in Config when nil.
+	Mailer Mailer
+	// mails counts the mails still being sent
+	mails  sync.WaitGroup
+	Mux    *http.ServeMux
+	http   *http.Server
+	assets *Assets
+	hub    *Hub
+	// instance identifies this server to the others on the broker
+	instance     string
+	presence     *presence
+	stopPresence chan struct{}
+	stopSweeper  chan struct{}
+	// loops counts the presence loop and the session sweeper
+	loops    sync.WaitGroup
+	typing   *TypingTracker
 	upgrader websocket.Upgrader
+	// clock is time.Now unless a test fixes the time
+	clock func() time.Time
 }
 
-func (S *Server) Run(port string) {
+// Run serves until ctx is cancelled, then shuts down gracefully. It only
+// returns an error when the server could not start or did not stop cleanly.
+func (S *Server) Run(ctx context.Context) error {
+	if S.Config == nil {
+		S.Config = config.Default()
+	}
+	assets, err := NewAssets(S.Assets, S.Config.AssetsDir)
+	if err != nil {
+		return fmt.Errorf("loading assets: %w", err)
+	}
+	S.assets = assets
+
 	S.Mux = http.NewServeMux()
-	S.DataBase()
+	if S.Store == nil {
+		S.DataBase()
+	}
 	S.initRoutes()
 
-	S.clients = make(map[string][]*Client) // Updated initialization
+	if S.Mailer == nil {
+		S.Mailer, err = openMailer(S.Config.Mail)
+		if err != nil {
+			S.Store.Close()
+			return err
+		}
+	}
 
-	fmt.Println("Server running on http://localhost:" + port)
-	err := http.ListenAndServe(":"+port, S.Mux)
-	if err != nil {
+	S.hub = NewHub(WSConfig(S.Config.WS))
+	S.typing = NewTypingTracker(S.hub.config.TypingTimeout, func(stopped TypingIndicator) {
+		S.sendTyping(stopped, nil)
+	})
+
+	if S.Broker == nil {
+		S.Broker, err = openBroker(S.Config.Broker, S.Config.RedisURL)
+		if err != nil {
+			S.Store.Close()
+			return err
+		}
+	}
+	S.instance = uuid.NewV4().String()
+	S.presence = newPresence()
+	if err := S.Broker.Subscribe(S.handleEvent); err != nil {
+		S.Broker.Close()
+		S.Store.Close()
+		return fmt.Errorf("subscribing to broker: %w", err)
+	}
+	S.publishPresence(true)
+	S.stopPresence = make(chan struct{})
+	S.stopSweeper = make(chan struct{})
+	S.loops.Add(2)
+	go func() {
+		defer S.loops.Done()
+		S.presenceLoop(S.stopPresence)
+	}()
+	go func() {
+		defer S.loops.Done()
+		S.sweepSessions(S.stopSweeper)
+	}()
+
+	S.http = &http.Server{Addr: ":" + S.Config.Port, Handler: S.slideSessions(S.Mux)}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- S.http.ListenAndServe()
+	}()
+	fmt.Println("Server running on http://localhost:" + S.Config.Port)
+
+	select {
+	case err := <-serveErr:
 		log.Println("Server error:", err)
-		return
+		return errors.Join(err, S.Shutdown())
+	case <-ctx.Done():
 	}
+	return S.Shutdown()
 }
 
 func (S *Server) initRoutes() {
-	S.Mux.Handle("/", http.FileServer(http.Dir("./static")))
+	S.Mux.HandleFunc("/", S.ServeStatic)
 	S.Mux.HandleFunc("/logged", S.LoggedHandler)
 
-	S.Mux.HandleFunc("/notification", S.Notification)
+	S.Mux.HandleFunc("/unread", S.UnreadHandler)
+	S.Mux.HandleFunc("/conversations", S.ConversationsHandler)
 
 	S.Mux.Handle("/createPost", S.SessionMiddleware(http.HandlerFunc(S.CreatePostHandler)))
 	S.Mux.HandleFunc("/posts", S.GetPostsHandler)
@@ -51,23 +142,43 @@ func (S *Server) initRoutes() {
 
 	S.Mux.HandleFunc("/register", S.RegisterHandler)
 	S.Mux.HandleFunc("/login", S.LoginHandler)
+	S.Mux.HandleFunc("/login/2fa", S.TwoFactorLoginHandler)
+	S.Mux.HandleFunc("/password/forgot", S.ForgotPasswordHandler)
+	S.Mux.HandleFunc("/password/reset", S.ResetPasswordHandler)
+	S.Mux.HandleFunc("/email/verify", S.VerifyEmailHandler)
+	S.Mux.HandleFunc("/email/resend", S.ResendVerificationHandler)
 
 	S.Mux.HandleFunc("/ws", S.HandleWebSocket)
 	S.Mux.HandleFunc("/messages", S.GetMessagesHandler)
 
+	S.Mux.HandleFunc("/groups", S.GroupsHandler)
+	S.Mux.HandleFunc("/groups/invite", S.GroupInviteHandler)
+	S.Mux.HandleFunc("/groups/invites", S.GroupInvitesHandler)
+	S.Mux.HandleFunc("/groups/accept", S.GroupAcceptHandler)
+	S.Mux.HandleFunc("/groups/decline", S.GroupDeclineHandler)
+	S.Mux.HandleFunc("/groups/leave", S.GroupLeaveHandler)
+	S.Mux.HandleFunc("/groups/remove", S.GroupRemoveHandler)
+
+	S.Mux.HandleFunc("/sessions", S.SessionsHandler)
+	S.Mux.HandleFunc("/sessions/revoke", S.SessionRevokeHandler)
+	S.Mux.HandleFunc("/sessions/revoke-others", S.SessionRevokeOthersHandler)
+
+	S.Mux.HandleFunc("/2fa", S.TwoFactorHandler)
+	S.Mux.HandleFunc("/2fa/enroll", S.TwoFactorEnrollHandler)
+	S.Mux.HandleFunc("/2fa/confirm", S.TwoFactorConfirmHandler)
+	S.Mux.HandleFunc("/2fa/disable", S.TwoFactorDisableHandler)
+	S.Mux.HandleFunc("/2fa/recovery-codes", S.RecoveryCodesHandler)
+	S.Mux.HandleFunc("/admin/2fa/reset", S.TwoFactorResetHandler)
+
 	S.Mux.HandleFunc("/logout", S.LogoutHandler)
 }
 
 func (S *Server) UserFound(user User) (error, bool) {
-	var exists int
-	err := S.db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? OR nickname = ?", user.Email, user.Nickname).Scan(&exists)
+	found, err := S.Store.UserExists(html.EscapeString(user.Email), html.EscapeString(user.Nickname))
 	if err != nil {
 		return err, false
 	}
-	if exists > 0 {
-		return nil, true
-	}
-	return nil, false
+	return nil, found
 }
 
 func (S *Server) AddUser(user User) string {
@@ -75,9 +186,15 @@ func (S *Server) AddUser(user User) string {
 	if err != nil {
 		return "hash Password Error"
 	}
-	query := `INSERT INTO users (nickname, first_name, last_name, email, password, age, gender)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`
-	_, err = S.db.Exec(query, html.EscapeString(user.Nickname), html.EscapeString(user.FirstName), html.EscapeString(user.LastName), html.EscapeString(user.Email), string(hashedPassword), user.Age, user.Gender)
+	err = S.Store.CreateUser(User{
+		Nickname:  html.EscapeString(user.Nickname),
+		FirstName: html.EscapeString(user.FirstName),
+		LastName:  html.EscapeString(user.LastName),
+		Email:     html.EscapeString(user.Email),
+		Password:  string(hashedPassword),
+		Age:       user.Age,
+		Gender:    user.Gender,
+	})
 	if err != nil {
 		return error.Error(err)
 	}
@@ -104,12 +221,7 @@ func (S *Server) CheckSession(r *http.Request) (string, error) {
 	}
 	sessionID := cookie.Value
 
-	var username string
-	err = S.db.QueryRow(`
-        SELECT nickname FROM sessions 
-        WHERE session_id = ? AND expires_at > CURRENT_TIMESTAMP
-    `, sessionID).Scan(&username)
-
+	username, err := S.Store.SessionUser(sessionID)
 	if err != nil {
 		return "", fmt.Errorf("invalid or expired session")
 	}
@@ -117,195 +229,304 @@ func (S *Server) CheckSession(r *http.Request) (string, error) {
 	return username, nil
 }
 
-func (S *Server) MakeToken(Writer http.ResponseWriter, username string) {
+func (S *Server) MakeToken(Writer http.ResponseWriter, username, userAgent string) {
 	sessionID := uuid.NewV4().String()
-	expirationTime := time.Now().Add(24 * time.Hour)
+	now := time.Now()
+	expirationTime := S.sessionExpiry(now, now)
 
-	_, err := S.db.Exec("INSERT INTO sessions (session_id, nickname, expires_at) VALUES (?, ?, ?)",
-		sessionID, username, expirationTime)
+	if len(userAgent) > MaxUserAgentLength {
+		userAgent = userAgent[:MaxUserAgentLength]
+	}
+	err := S.Store.CreateSession(sessionID, username, userAgent, expirationTime)
 	if err != nil {
 		http.Error(Writer, "Error creating session", http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(Writer, &http.Cookie{
+	http.SetCookie(Writer, S.sessionCookie(sessionID, expirationTime))
+}
+
+// sessionCookie builds the session cookie with the configured attributes, an
+// expiry in the past deletes it.
+func (S *Server) sessionCookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
 		Name:     "session_token",
-		Value:    sessionID,
-		Expires:  expirationTime,
+		Value:    value,
+		Expires:  expires,
+		Path:     S.Config.Cookie.Path,
+		Domain:   S.Config.Cookie.Domain,
+		Secure:   S.Config.Cookie.Secure,
+		SameSite: S.Config.Cookie.SameSiteMode(),
 		HttpOnly: true,
-	})
+	}
 }
 
+// GetHashedPasswordFromDB returns the nickname and password hash of the user
+// with the given nickname or email.
 func (S *Server) GetHashedPasswordFromDB(identifier string) (string, string, error) {
-	var hashedPassword, nickname string
-
-	err := S.db.QueryRow(`
-		SELECT password, nickname FROM users 
-		WHERE nickname = ? OR email = ?
-	`, identifier, identifier).Scan(&nickname, &hashedPassword)
-
+	nickname, hashedPassword, err := S.Store.GetCredentials(identifier)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == ErrNoRecord {
 			return "", "", fmt.Errorf("this user does not exist")
 		}
 		return "", "", err
 	}
-	return hashedPassword, nickname, nil
+	return nickname, hashedPassword, nil
 }
 
 // Handle typing indicators
 func (s *Server) handleTypingIndicator(client *Client, typingData TypingIndicator) {
-	// Send typing indicator to all sessions of the recipient
-	if recipientSessions, ok := s.clients[typingData.To]; ok {
-		for _, recipient := range recipientSessions {
-			err := recipient.Conn.WriteJSON(typingData)
-			if err != nil {
-				fmt.Println("Send Error to recipient (typing):", err)
-			}
+	if typingData.IsTyping {
+		// Repeated start frames only keep the indicator alive
+		if !s.typing.Start(client.ID, typingData.From, typingData.To, typingData.GroupID) {
+			return
 		}
+	} else if !s.typing.Stop(typingData.From, typingData.To, typingData.GroupID) {
+		return
 	}
+	s.sendTyping(typingData, client)
+}
 
-	// Send to all other sessions of the sender (excluding current session)
-	if senderSessions, ok := s.clients[typingData.From]; ok {
-		for _, senderClient := range senderSessions {
-			if senderClient.ID != client.ID { // Don't send back to the same session
-				err := senderClient.Conn.WriteJSON(typingData)
-				if err != nil {
-					fmt.Println("Send Error to sender session (typing):", err)
-				}
-			}
-		}
+// sendTyping relays a typing state to the recipient, or every member of the
+// group, and to the sender's other sessions.
+func (s *Server) sendTyping(typingData TypingIndicator, origin *Client) {
+	frame := NewFrame(FrameTyping, typingData)
+	if typingData.GroupID != 0 {
+		s.sendToGroup(typingData.GroupID, frame, origin)
+		return
 	}
+
+	// Send typing indicator to all sessions of the recipient
+	s.sendTo(typingData.To, frame, nil)
+
+	// Send to all other sessions of the sender (excluding current session)
+	s.sendTo(typingData.From, frame, origin)
 }
 
-// Modified receiveMessages function
-func (s *Server) receiveMessages(client *Client) {
+// receiveMessages is the read loop of a client connected with the session
+// sessionID, it runs until the connection drops.
+func (s *Server) receiveMessages(client *Client, sessionID string) {
 	defer func() {
-		client.Conn.Close()
+		client.Close(websocket.CloseNormalClosure, "")
 
 		// Remove this specific client from the user's session list
-		if sessions, exists := s.clients[client.Username]; exists {
-			for i, c := range sessions {
-				if c.ID == client.ID {
-					s.clients[client.Username] = append(sessions[:i], sessions[i+1:]...)
-					break
-				}
-			}
-			// If no more sessions for this user, remove the user entirely
-			if len(s.clients[client.Username]) == 0 {
-				delete(s.clients, client.Username)
-			}
+		s.hub.Unregister(client)
+
+		// Whoever this session was typing to should stop seeing it
+		for _, stopped := range s.typing.StopClient(client.ID) {
+			s.sendTyping(stopped, nil)
 		}
 
-		s.broadcastUserList("")
+		s.broadcastUserList()
 		fmt.Println(client.Username, "disconnected")
 	}()
 
+	client.startHeartbeat()
+
+	// Someone who only chats makes no HTTP requests, their frames keep the
+	// session alive instead. The upgrade request slid it just now.
+	lastSlide := time.Now()
 	for {
-		var rawMessage json.RawMessage
-		err := client.Conn.ReadJSON(&rawMessage)
+		_, data, err := client.Conn.ReadMessage()
 		if err != nil {
 			fmt.Println("WebSocket Read Error:", err)
 			break
 		}
+		if now := time.Now(); now.Sub(lastSlide) >= s.lastSeenResolution() {
+			lastSlide = now
+			if _, err := s.touchSession(sessionID); err != nil && err != ErrNoRecord {
+				fmt.Println("DB Session Error:", err)
+			}
+		}
 
-		// Parse the message to determine its type
-		var messageType struct {
-			Type string `json:"type"`
+		var frame Envelope
+		if err := json.Unmarshal(data, &frame); err != nil {
+			client.Send(ErrorFrame("", ErrBadFrame, "frame is not a valid envelope"))
+			continue
 		}
-		
-		// First try to parse as typing indicator
-		err = json.Unmarshal(rawMessage, &messageType)
-		if err == nil && messageType.Type == "typing" {
-			// Handle typing indicator
+		if frame.Version != ProtocolVersion {
+			client.Send(ErrorFrame(frame.ID, ErrUnsupportedVersion, fmt.Sprintf("protocol version %d is required", ProtocolVersion)))
+			continue
+		}
+
+		switch frame.Type {
+		case FrameTyping:
 			var typingData TypingIndicator
-			err = json.Unmarshal(rawMessage, &typingData)
-			if err != nil {
-				fmt.Println("Error parsing typing indicator:", err)
+			if err := json.Unmarshal(frame.Payload, &typingData); err != nil || (typingData.To == "") == (typingData.GroupID == 0) {
+				client.Send(ErrorFrame(frame.ID, ErrInvalidPayload, "typing needs either a recipient or a group"))
+				continue
+			}
+			if typingData.GroupID != 0 && !s.checkMember(client, frame.ID, typingData.GroupID) {
 				continue
 			}
 			typingData.From = client.Username // Ensure from field is set correctly
 			s.handleTypingIndicator(client, typingData)
-			continue
-		}
-
-		// Otherwise, handle as regular message
-		var msg Message
-		err = json.Unmarshal(rawMessage, &msg)
-		if err != nil {
-			fmt.Println("Error parsing message:", err)
-			continue
+		case FrameMessage:
+			var msg Message
+			if err := json.Unmarshal(frame.Payload, &msg); err != nil || (msg.To == "") == (msg.GroupID == 0) || msg.Content == "" {
+				client.Send(ErrorFrame(frame.ID, ErrInvalidPayload, "message needs either a recipient or a group, and content"))
+				continue
+			}
+			if msg.GroupID != 0 && !s.checkMember(client, frame.ID, msg.GroupID) {
+				continue
+			}
+			if len(msg.ClientID) > MaxClientIDLength {
+				client.Send(ErrorFrame(frame.ID, ErrInvalidPayload, fmt.Sprintf("client_id is limited to %d bytes", MaxClientIDLength)))
+				continue
+			}
+			s.handleMessage(client, frame.ID, msg)
+		case FrameReceipt:
+			var receipt Receipt
+			if err := json.Unmarshal(frame.Payload, &receipt); err != nil || receipt.MessageID <= 0 ||
+				(receipt.Status != ReceiptDelivered && receipt.Status != ReceiptRead) {
+				client.Send(ErrorFrame(frame.ID, ErrInvalidPayload, "receipt needs a message id and a status of delivered or read"))
+				continue
+			}
+			s.handleReceipt(client, frame.ID, receipt)
+		case FrameResume:
+			var resume ResumePayload
+			if err := json.Unmarshal(frame.Payload, &resume); err != nil || resume.Seq < 0 {
+				client.Send(ErrorFrame(frame.ID, ErrInvalidPayload, "resume needs the last seq seen"))
+				continue
+			}
+			s.handleResume(client, frame.ID, resume.Seq)
+		default:
+			client.Send(ErrorFrame(frame.ID, ErrUnknownType, fmt.Sprintf("unknown frame type %q", frame.Type)))
 		}
+	}
+}
 
-		msg.From = client.Username
-		msg.Timestamp = time.Now().Format(time.RFC3339)
+// handleMessage stores a chat message, acknowledges it to the sending session
+// and delivers it everywhere else. A message whose client id was already
+// stored is a retry, it is only acknowledged again.
+func (s *Server) handleMessage(client *Client, frameID string, msg Message) {
+	msg.From = client.Username
+	msg.Content = html.EscapeString(msg.Content)
+	msg.Timestamp = time.Now().Format(time.RFC3339)
 
-		_, err = s.db.Exec(`
-			INSERT INTO messages (sender, receiver, content, timestamp)
-			VALUES (?, ?, ?, ?)`,
-			msg.From, msg.To, html.EscapeString(msg.Content), msg.Timestamp)
+	var err error
+	var seqs map[string]int64
+	msg.ID, seqs, err = s.Store.CreateMessage(msg)
+	if err == ErrDuplicateMessage {
+		stored, err := s.Store.MessageByClientID(msg.From, msg.ClientID)
 		if err != nil {
-			fmt.Println("DB Insert Error:", err)
-			continue
+			fmt.Println("DB Query Error:", err)
+			client.Send(ErrorFrame(frameID, ErrInternal, "message could not be stored"))
+			return
 		}
+		client.Send(ReplyFrame(FrameAck, frameID, ackPayload(stored)))
+		return
+	}
+	if err != nil {
+		fmt.Println("DB Insert Error:", err)
+		client.Send(ErrorFrame(frameID, ErrInternal, "message could not be stored"))
+		return
+	}
 
-		// Send to all sessions of the recipient
-		if recipientSessions, ok := s.clients[msg.To]; ok {
-			for _, recipient := range recipientSessions {
-				s.broadcastUserList(msg.To)
-				err := recipient.Conn.WriteJSON(msg)
-				if err != nil {
-					fmt.Println("Send Error to recipient:", err)
-				}
-			}
-		}
+	sent := msg
+	sent.Seq = seqs[msg.From]
+	client.Send(ReplyFrame(FrameAck, frameID, ackPayload(sent)))
 
-		// Send to all other sessions of the sender (excluding current session)
-		if senderSessions, ok := s.clients[msg.From]; ok {
-			for _, senderClient := range senderSessions {
-				if senderClient.ID != client.ID { // Don't send back to the same session
-					err := senderClient.Conn.WriteJSON(msg)
-					if err != nil {
-						fmt.Println("Send Error to sender session:", err)
-					}
-				}
-			}
-		}
+	// The message itself ends the typing indicator
+	if s.typing.Stop(msg.From, msg.To, msg.GroupID) {
+		s.sendTyping(TypingIndicator{From: msg.From, To: msg.To, GroupID: msg.GroupID}, client)
 	}
-}
 
-// Modified broadcastUserList function
-func (S *Server) broadcastUserList(lastsender string) {
-	var usernames []string
-	if lastsender != "" {
-		usernames = append(usernames, lastsender)
+	if msg.GroupID != 0 {
+		s.deliverGroupMessage(client, msg, seqs)
+		return
 	}
 
-	for username := range S.clients {
-		if lastsender != username {
-			usernames = append(usernames, username)
-		}
-	}
+	// Send to all sessions of the recipient, numbered in their sequence
+	received := msg
+	received.Seq = seqs[msg.To]
+	s.sendTo(msg.To, NewFrame(FrameMessage, received), nil)
 
-	// Send to all client sessions
-	for _, clientSessions := range S.clients {
-		for _, client := range clientSessions {
-			client.Conn.WriteJSON(map[string]interface{}{
-				"type":  "user_list",
-				"users": usernames,
-			})
-		}
+	// Send to all other sessions of the sender (excluding current session)
+	s.sendTo(msg.From, NewFrame(FrameMessage, sent), client)
+
+	s.sendUnread(msg.To, msg.From)
+	s.sendConversation(msg.To, msg.From)
+	s.sendConversation(msg.From, msg.To)
+}
+
+// broadcastUserList tells everyone who is online after a client of this
+// instance connected or left, the other instances refresh their clients when
+// the presence event reaches them. The order of the sidebar comes from the
+// conversation list.
+func (S *Server) broadcastUserList() {
+	S.publishPresence(false)
+	S.sendUserList()
+}
+
+// sendUserList sends the users online anywhere to the local clients.
+func (S *Server) sendUserList() {
+	S.hub.Broadcast(NewFrame(FrameUserList, UserListPayload{Users: S.onlineUsers()}))
+}
+
+// now is the current time on the server's clock.
+func (S *Server) now() time.Time {
+	if S.clock != nil {
+		return S.clock()
 	}
+	return time.Now()
 }
 
 func (S *Server) DataBase() {
-	var err error
-	S.db, err = sql.Open("sqlite3", "database/forum.db")
+	S.Store = openDataBase(S.Config.DBDriver, S.Config.DBDSN)
+}
+
+// Shutdown stops accepting connections, closes every websocket with
+// ShutdownReason and waits, up to the configured timeout, for in-flight
+// requests and websocket frames to be handled before closing the database.
+func (S *Server) Shutdown() error {
+	fmt.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), S.Config.ShutdownTimeout)
+	defer cancel()
+
+	// Closing the websockets first lets them drain while HTTP requests finish
+	drained := S.hub.Close(websocket.CloseGoingAway, ShutdownReason)
+
+	err := S.http.Shutdown(ctx)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Shutdown Error:", err)
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		fmt.Println("Shutdown Error: websocket clients still busy after", S.Config.ShutdownTimeout)
 	}
-}
 
-func (S *Server) Shutdown() {
-	S.db.Close()
-}
\ No newline at end of file
+	// No request is left to start a mail, let the ones on their way finish
+	sent := make(chan struct{})
+	go func() {
+		S.mails.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		err = ctx.Err()
+		fmt.Println("Shutdown Error: mails still being sent after", S.Config.ShutdownTimeout)
+	}
+
+	// The loops finish the round they are in, which may still use the
+	// broker and the store
+	close(S.stopPresence)
+	close(S.stopSweeper)
+	S.loops.Wait()
+
+	// An empty presence makes the other instances forget our users now
+	// rather than after PresenceTTL
+	S.Broker.Publish(BrokerEvent{Kind: EventPresence, Instance: S.instance})
+	if closeErr := S.Broker.Close(); closeErr != nil {
+		fmt.Println("Broker Close Error:", closeErr)
+	}
+
+	if closeErr := S.Store.Close(); closeErr != nil {
+		fmt.Println("DB Close Error:", closeErr)
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
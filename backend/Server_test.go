@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// queued takes the frames waiting in the queue of client.
+func queued(t *testing.T, client *Client) []Envelope {
+	t.Helper()
+	var frames []Envelope
+	for {
+		select {
+		case data := <-client.send:
+			var frame Envelope
+			if err := json.Unmarshal(data, &frame); err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
+
+// ofType returns the payloads of the frames of type kind.
+func ofType(frames []Envelope, kind string) []json.RawMessage {
+	var payloads []json.RawMessage
+	for _, frame := range frames {
+		if frame.Type == kind {
+			payloads = append(payloads, frame.Payload)
+		}
+	}
+	return payloads
+}
+
+func TestMessageRetry(t *testing.T) {
+	S := newTestServer(t, "alice", "bob")
+	S.hub = NewHub(WSConfig{SendQueueSize: 64})
+	S.Broker = NewMemoryBroker()
+	S.Broker.Subscribe(S.handleEvent)
+	S.typing = NewTypingTracker(time.Minute, func(TypingIndicator) {})
+	sender, other, bob := testClient(S.hub, "1", "alice"), testClient(S.hub, "2", "alice"), testClient(S.hub, "3", "bob")
+	for _, client := range []*Client{sender, other, bob} {
+		S.hub.Register(client)
+	}
+	group, err := S.Store.CreateGroup("friends", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := S.Store.CreateInvite(group, "bob", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := S.Store.AcceptInvite(group, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		msg  Message
+	}{
+		{"direct", Message{To: "bob", Content: "hi bob", ClientID: "c1"}},
+		{"group", Message{GroupID: group, Content: "hi all", ClientID: "c2"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			before, err := S.Store.LatestSeq("bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The ack of the first send is lost, the client sends again
+			S.handleMessage(sender, "f1", test.msg)
+			S.handleMessage(sender, "f2", test.msg)
+
+			var acks []AckPayload
+			for _, frame := range queued(t, sender) {
+				if frame.Type == FrameMessage {
+					t.Errorf("the sending session got its own message: %s", frame.Payload)
+				}
+				if frame.Type != FrameAck {
+					continue
+				}
+				var ack AckPayload
+				if err := json.Unmarshal(frame.Payload, &ack); err != nil {
+					t.Fatal(err)
+				}
+				if want := "f" + string(rune('1'+len(acks))); frame.ID != want {
+					t.Errorf("ack %d has id %q, want %q", len(acks), frame.ID, want)
+				}
+				acks = append(acks, ack)
+			}
+			if len(acks) != 2 {
+				t.Fatalf("%d acks, want one per send", len(acks))
+			}
+			if acks[0].MessageID != acks[1].MessageID || acks[0].Seq != acks[1].Seq || acks[0].Timestamp != acks[1].Timestamp {
+				t.Errorf("acked as %+v, then as %+v", acks[0], acks[1])
+			}
+
+			// Stored and fanned out once
+			if latest, err := S.Store.LatestSeq("bob"); err != nil || latest != before+1 {
+				t.Errorf("bob's seq went from %d to %d, %v", before, latest, err)
+			}
+			for _, client := range []*Client{other, bob} {
+				messages := ofType(queued(t, client), FrameMessage)
+				if len(messages) != 1 {
+					t.Errorf("%s got the message %d times", client.ID, len(messages))
+					continue
+				}
+				var msg Message
+				if err := json.Unmarshal(messages[0], &msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.ID != acks[0].MessageID || msg.ClientID != test.msg.ClientID {
+					t.Errorf("%s got %+v, acked as %d", client.ID, msg, acks[0].MessageID)
+				}
+			}
+		})
+	}
+}
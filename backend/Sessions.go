@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// LastSeenResolution keeps every request from writing to the session,
+	// last seen times and expiries only move once they are this much behind,
+	// or half the session lifetime when that is shorter.
+	LastSeenResolution = time.Minute
+	// MaxUserAgentLength bounds the user agent kept with a session.
+	MaxUserAgentLength = 256
+)
+
+// SessionRevokedReason is sent in the close frame of the websockets of a
+// session that was logged out, revoked or expired.
+const SessionRevokedReason = "session revoked"
+
+// sessionHandle is the public id of a session. It is derived from the token
+// so it needs no column of its own, and cannot be turned back into it.
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:12])
+}
+
+// disconnectSessions closes the websockets of the given sessions of username
+// on every instance.
+func (S *Server) disconnectSessions(username string, sessionIDs ...string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	event := BrokerEvent{Kind: EventRevoke, Instance: S.instance, To: username}
+	for _, sessionID := range sessionIDs {
+		event.Sessions = append(event.Sessions, sessionHandle(sessionID))
+	}
+	if err := S.Broker.Publish(event); err != nil {
+		fmt.Println("Broker Publish Error:", err)
+		S.handleEvent(event)
+	}
+}
+
+// sessionExpiry is when a session created at created expires if now is the
+// last activity on it.
+func (S *Server) sessionExpiry(created, now time.Time) time.Time {
+	expiresAt := now.Add(S.Config.SessionLifetime)
+	if limit := created.Add(S.Config.SessionMaxLifetime); expiresAt.After(limit) {
+		return limit
+	}
+	return expiresAt
+}
+
+// slideSessions keeps the sessions of active users alive, see slideSession.
+// Static files are left out, fetching them says nothing about the user.
+func (S *Server) slideSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := S.Mux.Handler(r); pattern == "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cookie, err := r.Cookie("session_token"); err == nil {
+			S.slideSession(w, cookie.Value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// slideSession records activity on a session and reissues the cookie to
+// expire with it. The cookie is reissued even when the session was touched
+// too recently to move, a websocket may have slid it since the last request.
+func (S *Server) slideSession(w http.ResponseWriter, sessionID string) {
+	session, err := S.touchSession(sessionID)
+	if err != nil {
+		if err != ErrNoRecord {
+			fmt.Println("DB Session Error:", err)
+		}
+		return
+	}
+	http.SetCookie(w, S.sessionCookie(sessionID, session.ExpiresAt))
+}
+
+// touchSession pushes the expiry of a session forward unless it was already
+// done within lastSeenResolution, and returns the session as it now stands.
+func (S *Server) touchSession(sessionID string) (Session, error) {
+	session, err := S.Store.Session(sessionID)
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	if now.Sub(session.LastSeen) < S.lastSeenResolution() {
+		return session, nil
+	}
+	expiresAt := S.sessionExpiry(session.CreatedAt, now)
+	if err := S.Store.TouchSession(sessionID, now, expiresAt); err != nil {
+		return Session{}, err
+	}
+	session.LastSeen, session.ExpiresAt = now, expiresAt
+	return session, nil
+}
+
+// lastSeenResolution is how far behind a session's last seen time may fall
+// before it is written again.
+func (S *Server) lastSeenResolution() time.Duration {
+	return min(LastSeenResolution, S.Config.SessionLifetime/2)
+}
+
+// sweepSessions deletes expired sessions and disconnects whoever is still
+// connected with one, along with expired login challenges and mail requests
+// too old to count, until stop is closed.
+func (S *Server) sweepSessions(stop <-chan struct{}) {
+	ticker := time.NewTicker(S.Config.SessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := S.Store.DeleteExpiredSessions(time.Now())
+			if err != nil {
+				fmt.Println("DB Session Error:", err)
+				continue
+			}
+			for nickname, sessionIDs := range expired {
+				S.disconnectSessions(nickname, sessionIDs...)
+			}
+			if err := S.Store.DeleteExpiredChallenges(time.Now()); err != nil {
+				fmt.Println("DB TOTP Error:", err)
+			}
+			if err := S.Store.DeleteMailRequests(time.Now().Add(-MailRequestWindow)); err != nil {
+				fmt.Println("DB Mail Error:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// SessionsHandler lists the caller's active sessions.
+func (S *Server) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, current, ok := S.currentSession(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := S.sessions(nickname, current)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// SessionRevokeHandler ends one of the caller's sessions, which may be the
+// current one.
+func (S *Server) SessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, current, ok := S.currentSession(w, r)
+	if !ok {
+		return
+	}
+	var request SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := S.sessions(nickname, current)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		if session.ID != request.ID {
+			continue
+		}
+		if err := S.Store.DeleteSession(session.Token); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		S.disconnectSessions(nickname, session.Token)
+		if session.Current {
+			http.SetCookie(w, S.sessionCookie("", time.Unix(0, 0)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "No such session", http.StatusNotFound)
+}
+
+// SessionRevokeOthersHandler signs the caller out everywhere but here.
+func (S *Server) SessionRevokeOthersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, current, ok := S.currentSession(w, r)
+	if !ok {
+		return
+	}
+	revoked, err := S.Store.DeleteOtherSessions(nickname, current)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	S.disconnectSessions(nickname, revoked...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"revoked": len(revoked),
+	})
+}
+
+// currentSession returns the caller and their session id.
+func (S *Server) currentSession(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", "", false
+	}
+	cookie, _ := r.Cookie("session_token")
+	return nickname, cookie.Value, true
+}
+
+// sessions lists nickname's sessions with their public ids.
+func (S *Server) sessions(nickname, current string) ([]Session, error) {
+	sessions, err := S.Store.ListSessions(nickname)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].ID = sessionHandle(sessions[i].Token)
+		sessions[i].Current = sessions[i].Token == current
+	}
+	return sessions, nil
+}
@@ -0,0 +1,187 @@
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNoRecord is returned by Store lookups that match nothing.
+	ErrNoRecord = errors.New("not found")
+	// ErrDuplicateMessage is returned by CreateMessage when the sender
+	// already has a message with the same client id.
+	ErrDuplicateMessage = errors.New("duplicate message")
+)
+
+// MessageQuery selects one page of the conversation between User and Other,
+// or of the group GroupID when it is set. With After set the page holds the
+// messages right after that id, oldest first, otherwise the messages right
+// before Before (or the latest ones when it is zero), newest first.
+type MessageQuery struct {
+	User    string
+	Other   string
+	GroupID int64
+	Before  int64
+	After   int64
+	Limit   int
+}
+
+// Store is everything the server keeps between restarts. Values are stored
+// as given, escaping and password hashing happen before they get here.
+type Store interface {
+	// users
+	UserExists(email, nickname string) (bool, error)
+	CreateUser(user User) error
+	// GetCredentials looks a user up by nickname or email and returns the
+	// nickname and the password hash.
+	GetCredentials(identifier string) (string, string, error)
+	// UserEmail returns a user's email address and whether it is verified.
+	UserEmail(nickname string) (string, bool, error)
+	SetEmailVerified(nickname string) error
+	// CreateEmailToken stores the hash of a token mailed to nickname at the
+	// given time, keeping only the MaxEmailTokens newest unused, unexpired
+	// ones for the purpose. UseEmailToken spends an unused, unexpired one
+	// and returns whose it was. Purpose is one of the Token* constants.
+	CreateEmailToken(hash, nickname, purpose string, at, expiresAt time.Time) error
+	UseEmailToken(hash, purpose string, at time.Time) (string, error)
+	// ResetPassword spends an unused, unexpired reset token, sets the
+	// password and the email verified of its user and deletes the user's
+	// other reset tokens, all at once. It returns the user's nickname.
+	ResetPassword(hash, hashedPassword string, at time.Time) (string, error)
+
+	// sessions
+	CreateSession(sessionID, nickname, userAgent string, expiresAt time.Time) error
+	// SessionUser returns the nickname owning an unexpired session.
+	SessionUser(sessionID string) (string, error)
+	// Session returns an unexpired session with the Token set but neither
+	// ID nor Current.
+	Session(sessionID string) (Session, error)
+	// TouchSession records activity on a session at the given time and
+	// moves its expiry.
+	TouchSession(sessionID string, at, expiresAt time.Time) error
+	// ListSessions returns nickname's unexpired sessions, most recently
+	// seen first, with the Token set but neither ID nor Current.
+	ListSessions(nickname string) ([]Session, error)
+	DeleteSession(sessionID string) error
+	// DeleteOtherSessions deletes every session of nickname but keep and
+	// returns the deleted session ids.
+	DeleteOtherSessions(nickname, keep string) ([]string, error)
+	// DeleteExpiredSessions deletes the sessions expired by now and returns
+	// their ids by nickname.
+	DeleteExpiredSessions(now time.Time) (map[string][]string, error)
+
+	// two-factor authentication
+	// TOTP returns nickname's authenticator, enabled or still pending.
+	TOTP(nickname string) (TOTP, error)
+	// SetTOTPSecret starts an enrollment with a new secret, replacing a
+	// pending one. It reports false when two-factor is already enabled.
+	SetTOTPSecret(nickname, secret string) (bool, error)
+	// EnableTOTP enables a pending authenticator, and UseTOTPStep accepts a
+	// code of an enabled one, if step is past the last accepted one.
+	EnableTOTP(nickname string, step int64) (bool, error)
+	UseTOTPStep(nickname string, step int64) (bool, error)
+	// DeleteTOTP removes the authenticator and the recovery codes.
+	DeleteTOTP(nickname string) (bool, error)
+	// ReplaceRecoveryCodes stores new recovery code hashes in place of the
+	// old ones, UseRecoveryCode spends an unused one.
+	ReplaceRecoveryCodes(nickname string, hashes []string) error
+	UseRecoveryCode(nickname, hash string, at time.Time) (bool, error)
+	RecoveryCodesLeft(nickname string) (int, error)
+	CreateLoginChallenge(challenge, nickname string, expiresAt time.Time) error
+	// ChallengeUser returns the nickname waiting on an unexpired challenge.
+	ChallengeUser(challenge string) (string, error)
+	DeleteLoginChallenge(challenge string) error
+	DeleteExpiredChallenges(now time.Time) error
+
+	// login attempts
+	RecordLogin(attempt LoginAttempt) error
+	// AccountFailures counts the failed logins to account after since and
+	// after its last successful one, IPFailures those from ip after since.
+	// Both skip attempts refused during a lockout and return the time of
+	// the latest failure.
+	AccountFailures(account string, since time.Time) (int, time.Time, error)
+	IPFailures(ip string, since time.Time) (int, time.Time, error)
+
+	// mail requests
+	RecordMailRequest(account, ip string, at time.Time) error
+	// AccountMailRequests counts the reset and verification mails asked
+	// for to account after since, IPMailRequests those asked for from ip.
+	// Both return the time of the oldest, the count goes down when it is
+	// out of the window.
+	AccountMailRequests(account string, since time.Time) (int, time.Time, error)
+	IPMailRequests(ip string, since time.Time) (int, time.Time, error)
+	// DeleteMailRequests forgets the requests made before the given time.
+	DeleteMailRequests(before time.Time) error
+
+	// posts and comments
+	CreatePost(author string, post Post) error
+	ListPosts() ([]Post, error)
+	CreateComment(author string, comment Comment) error
+	ListComments(postID int) ([]Comment, error)
+
+	// messages
+	// CreateMessage stores msg and appends it to the sequence of each
+	// participant, it returns the message id and the participants' new seqs.
+	// The participants of a group message are the group's members.
+	CreateMessage(msg Message) (int64, map[string]int64, error)
+	// MessageByClientID returns the message sender stored with clientID,
+	// with Seq set to its number in the sender's sequence.
+	MessageByClientID(sender, clientID string) (Message, error)
+	// MessagesSince returns the messages in nickname's sequence after seq,
+	// oldest first, with Seq set.
+	MessagesSince(nickname string, seq int64, limit int) ([]Message, error)
+	// LatestSeq is nickname's current seq, 0 before the first message.
+	LatestSeq(nickname string) (int64, error)
+	ListMessages(query MessageQuery) ([]Message, error)
+	// MessageSender returns who sent message id to receiver.
+	MessageSender(id int64, receiver string) (string, error)
+	// MarkDelivered and MarkRead report whether any message changed.
+	MarkDelivered(id int64, at string) (bool, error)
+	// MarkRead marks every message from sender to receiver up to id.
+	MarkRead(sender, receiver string, upTo int64, at string) (bool, error)
+
+	// groups
+	// CreateGroup stores a group with owner as its only member.
+	CreateGroup(name, owner string) (int64, error)
+	// Group returns a group with its members, oldest first.
+	Group(id int64) (Group, error)
+	ListGroups(nickname string) ([]Group, error)
+	// CreateInvite returns ErrNoRecord when nickname is not a user, inviting
+	// someone twice keeps the first invite.
+	CreateInvite(groupID int64, nickname, invitedBy string) error
+	ListInvites(nickname string) ([]GroupInvite, error)
+	// AcceptInvite turns nickname's invite into a membership, it returns
+	// ErrNoRecord without one.
+	AcceptInvite(groupID int64, nickname string) error
+	DeleteInvite(groupID int64, nickname string) (bool, error)
+	// RemoveMember reports whether nickname was a member. When the owner
+	// leaves, the longest standing member takes over.
+	RemoveMember(groupID int64, nickname string) (bool, error)
+	// MarkGroupRead moves nickname's read marker in the group up to the
+	// group message upTo and reports whether it moved.
+	MarkGroupRead(groupID int64, nickname string, upTo int64) (bool, error)
+	GroupUnreadCount(groupID int64, nickname string) (int, error)
+
+	// notifications
+	// UnreadCounts has one entry per sender with unread messages, by
+	// nickname, followed by one per such group, by id.
+	UnreadCounts(receiver string) ([]Notification, error)
+	UnreadCount(receiver, sender string) (int, error)
+	// Conversations lists every other user as seen by viewer, in no
+	// particular order and without the online flag.
+	Conversations(viewer string) ([]Conversation, error)
+	Conversation(viewer, other string) (Conversation, error)
+	// GroupConversations lists viewer's groups the same way.
+	GroupConversations(viewer string) ([]Conversation, error)
+	GroupConversation(viewer string, groupID int64) (Conversation, error)
+
+	Close() error
+}
+
+// participants are the users whose sequences a direct message goes into.
+func participants(msg Message) []string {
+	if msg.From == msg.To {
+		return []string{msg.From}
+	}
+	return []string{msg.From, msg.To}
+}
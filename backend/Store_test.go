@@ -0,0 +1,785 @@
+package backend
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore opens an empty Store with the latest schema.
+type testStore struct {
+	name string
+	open func(t *testing.T) Store
+}
+
+// postgresDSNEnv names a PostgreSQL database to run the store tests against
+// as well, e.g. FORUM_TEST_POSTGRES_DSN="postgres://forum@localhost/forum_test".
+// Every test drops and recreates all of its tables.
+const postgresDSNEnv = "FORUM_TEST_POSTGRES_DSN"
+
+// testStores are the Store implementations the contract runs against.
+func testStores() []testStore {
+	stores := []testStore{
+		{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+		{"sqlite", openTestSQLStore},
+	}
+	if os.Getenv(postgresDSNEnv) != "" {
+		stores = append(stores, testStore{"postgres", openTestPostgresStore})
+	}
+	return stores
+}
+
+func openTestPostgresStore(t *testing.T) Store {
+	t.Helper()
+	store, err := NewSQLStore(Postgres.Driver, os.Getenv(postgresDSNEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	// Start from nothing, whatever the last run left behind
+	if err := store.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Migrate(LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func openTestSQLStore(t *testing.T) Store {
+	t.Helper()
+	store, err := NewSQLStore(SQLite.Driver, filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// storeContract is what every Store must do the same way, each test gets an
+// empty store of its own.
+var storeContract = []struct {
+	name string
+	test func(t *testing.T, s Store)
+}{
+	{"users", testStoreUsers},
+	{"email tokens", testStoreEmailTokens},
+	{"sessions", testStoreSessions},
+	{"expired sessions", testStoreExpiredSessions},
+	{"two-factor", testStoreTwoFactor},
+	{"login attempts", testStoreLoginAttempts},
+	{"mail requests", testStoreMailRequests},
+	{"posts and comments", testStorePosts},
+	{"messages", testStoreMessages},
+	{"receipts and unread counts", testStoreReceipts},
+	{"groups", testStoreGroups},
+	{"conversations", testStoreConversations},
+}
+
+func TestStoreContract(t *testing.T) {
+	for _, impl := range testStores() {
+		t.Run(impl.name, func(t *testing.T) {
+			for _, c := range storeContract {
+				t.Run(c.name, func(t *testing.T) {
+					c.test(t, impl.open(t))
+				})
+			}
+		})
+	}
+}
+
+func noErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isErr(t *testing.T, what string, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("%s: error %v, want %v", what, err, want)
+	}
+}
+
+func equal[T any](t *testing.T, what string, got, want T) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s: got %+v, want %+v", what, got, want)
+	}
+}
+
+func sameTime(t *testing.T, what string, got, want time.Time) {
+	t.Helper()
+	if !got.Equal(want) {
+		t.Fatalf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func createUsers(t *testing.T, s Store, nicknames ...string) {
+	t.Helper()
+	for _, nickname := range nicknames {
+		noErr(t, s.CreateUser(User{
+			Nickname: nickname,
+			Email:    nickname + "@example.com",
+			Password: "hash of " + nickname,
+		}))
+	}
+}
+
+func createMessage(t *testing.T, s Store, msg Message) (int64, map[string]int64) {
+	t.Helper()
+	if msg.Timestamp == "" {
+		msg.Timestamp = "2024-01-02T03:04:05Z"
+	}
+	id, seqs, err := s.CreateMessage(msg)
+	noErr(t, err)
+	return id, seqs
+}
+
+// now is the current time without the precision databases drop.
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	exists, err := s.UserExists("alice@example.com", "alice")
+	noErr(t, err)
+	equal(t, "exists before", exists, false)
+
+	createUsers(t, s, "alice")
+	for _, lookup := range [][2]string{{"alice@example.com", "x"}, {"x@example.com", "alice"}} {
+		exists, err := s.UserExists(lookup[0], lookup[1])
+		noErr(t, err)
+		equal(t, "exists "+lookup[0]+" "+lookup[1], exists, true)
+	}
+
+	for _, identifier := range []string{"alice", "alice@example.com"} {
+		nickname, password, err := s.GetCredentials(identifier)
+		noErr(t, err)
+		equal(t, "credentials of "+identifier, [2]string{nickname, password}, [2]string{"alice", "hash of alice"})
+	}
+	_, _, err = s.GetCredentials("bob")
+	isErr(t, "credentials of an unknown user", err, ErrNoRecord)
+
+	email, verified, err := s.UserEmail("alice")
+	noErr(t, err)
+	equal(t, "email", email, "alice@example.com")
+	equal(t, "verified before", verified, false)
+	noErr(t, s.SetEmailVerified("alice"))
+	_, verified, err = s.UserEmail("alice")
+	noErr(t, err)
+	equal(t, "verified after", verified, true)
+	_, _, err = s.UserEmail("alice@example.com")
+	isErr(t, "email by email", err, ErrNoRecord)
+}
+
+func testStoreEmailTokens(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob")
+	at := now()
+
+	noErr(t, s.CreateEmailToken("verify", "alice", TokenVerify, at, at.Add(time.Hour)))
+	_, err := s.UseEmailToken("verify", TokenReset, at)
+	isErr(t, "token used for another purpose", err, ErrNoRecord)
+	nickname, err := s.UseEmailToken("verify", TokenVerify, at)
+	noErr(t, err)
+	equal(t, "token user", nickname, "alice")
+	_, err = s.UseEmailToken("verify", TokenVerify, at)
+	isErr(t, "token used twice", err, ErrNoRecord)
+
+	noErr(t, s.CreateEmailToken("short", "alice", TokenVerify, at, at.Add(time.Minute)))
+	_, err = s.UseEmailToken("short", TokenVerify, at.Add(time.Minute))
+	isErr(t, "expired token", err, ErrNoRecord)
+
+	// Only the newest MaxEmailTokens stay usable
+	hashes := []string{"first", "second", "third", "fourth"}
+	for i, hash := range hashes {
+		noErr(t, s.CreateEmailToken(hash, "bob", TokenVerify, at, at.Add(time.Hour+time.Duration(i)*time.Second)))
+	}
+	_, err = s.UseEmailToken("first", TokenVerify, at)
+	isErr(t, "token past the cap", err, ErrNoRecord)
+	for _, hash := range hashes[len(hashes)-MaxEmailTokens:] {
+		_, err = s.UseEmailToken(hash, TokenVerify, at)
+		noErr(t, err)
+	}
+
+	noErr(t, s.CreateEmailToken("reset1", "alice", TokenReset, at, at.Add(time.Hour)))
+	noErr(t, s.CreateEmailToken("reset2", "alice", TokenReset, at, at.Add(time.Hour)))
+	noErr(t, s.CreateEmailToken("verify2", "alice", TokenVerify, at, at.Add(time.Hour)))
+	_, err = s.ResetPassword("verify2", "new hash", at)
+	isErr(t, "reset with a verification token", err, ErrNoRecord)
+	nickname, err = s.ResetPassword("reset1", "new hash", at)
+	noErr(t, err)
+	equal(t, "reset user", nickname, "alice")
+	_, password, err := s.GetCredentials("alice")
+	noErr(t, err)
+	equal(t, "password after reset", password, "new hash")
+	_, verified, err := s.UserEmail("alice")
+	noErr(t, err)
+	equal(t, "verified after reset", verified, true)
+
+	// A reset ends every other reset link, not the other kinds
+	_, err = s.ResetPassword("reset2", "other hash", at)
+	isErr(t, "second reset link", err, ErrNoRecord)
+	_, err = s.UseEmailToken("reset2", TokenReset, at)
+	isErr(t, "second reset link used directly", err, ErrNoRecord)
+	_, err = s.UseEmailToken("verify2", TokenVerify, at)
+	noErr(t, err)
+}
+
+func testStoreSessions(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob")
+	at := now()
+	expires := at.Add(time.Hour)
+
+	noErr(t, s.CreateSession("a1", "alice", "firefox", expires))
+	noErr(t, s.CreateSession("a2", "alice", "curl", expires))
+	noErr(t, s.CreateSession("b1", "bob", "chrome", expires))
+	noErr(t, s.CreateSession("a-old", "alice", "lynx", at.Add(-time.Minute)))
+
+	nickname, err := s.SessionUser("a1")
+	noErr(t, err)
+	equal(t, "session user", nickname, "alice")
+	_, err = s.SessionUser("a-old")
+	isErr(t, "expired session user", err, ErrNoRecord)
+	_, err = s.SessionUser("nope")
+	isErr(t, "unknown session user", err, ErrNoRecord)
+
+	session, err := s.Session("a1")
+	noErr(t, err)
+	equal(t, "session token", session.Token, "a1")
+	equal(t, "session user agent", session.UserAgent, "firefox")
+	sameTime(t, "session expiry", session.ExpiresAt, expires)
+	_, err = s.Session("a-old")
+	isErr(t, "expired session", err, ErrNoRecord)
+
+	later := at.Add(time.Minute)
+	noErr(t, s.TouchSession("a2", later, later.Add(time.Hour)))
+	session, err = s.Session("a2")
+	noErr(t, err)
+	sameTime(t, "last seen after touch", session.LastSeen, later)
+	sameTime(t, "expiry after touch", session.ExpiresAt, later.Add(time.Hour))
+
+	sessions, err := s.ListSessions("alice")
+	noErr(t, err)
+	var tokens []string
+	for _, session := range sessions {
+		tokens = append(tokens, session.Token)
+	}
+	equal(t, "sessions, most recently seen first", tokens, []string{"a2", "a1"})
+
+	deleted, err := s.DeleteOtherSessions("alice", "a2")
+	noErr(t, err)
+	slices.Sort(deleted)
+	equal(t, "other sessions deleted", deleted, []string{"a-old", "a1"})
+	_, err = s.SessionUser("a1")
+	isErr(t, "deleted session", err, ErrNoRecord)
+	_, err = s.SessionUser("b1")
+	noErr(t, err)
+
+	noErr(t, s.DeleteSession("a2"))
+	_, err = s.SessionUser("a2")
+	isErr(t, "logged out session", err, ErrNoRecord)
+	deleted, err = s.DeleteOtherSessions("alice", "")
+	noErr(t, err)
+	equal(t, "sessions left", len(deleted), 0)
+}
+
+func testStoreExpiredSessions(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob")
+	at := now()
+	noErr(t, s.CreateSession("a1", "alice", "", at.Add(time.Hour)))
+	noErr(t, s.CreateSession("a2", "alice", "", at.Add(3*time.Hour)))
+	noErr(t, s.CreateSession("b1", "bob", "", at.Add(2*time.Hour)))
+
+	deleted, err := s.DeleteExpiredSessions(at.Add(2 * time.Hour))
+	noErr(t, err)
+	equal(t, "expired sessions", deleted, map[string][]string{"alice": {"a1"}, "bob": {"b1"}})
+	_, err = s.SessionUser("a2")
+	noErr(t, err)
+	deleted, err = s.DeleteExpiredSessions(at.Add(2 * time.Hour))
+	noErr(t, err)
+	equal(t, "expired sessions again", len(deleted), 0)
+}
+
+func testStoreTwoFactor(t *testing.T, s Store) {
+	createUsers(t, s, "alice")
+	at := now()
+
+	_, err := s.TOTP("alice")
+	isErr(t, "authenticator before enrolling", err, ErrNoRecord)
+	started, err := s.SetTOTPSecret("alice", "FIRST")
+	noErr(t, err)
+	equal(t, "enrollment started", started, true)
+	started, err = s.SetTOTPSecret("alice", "SECOND")
+	noErr(t, err)
+	equal(t, "enrollment restarted", started, true)
+	totp, err := s.TOTP("alice")
+	noErr(t, err)
+	equal(t, "pending authenticator", totp, TOTP{Secret: "SECOND"})
+
+	ok, err := s.UseTOTPStep("alice", 5)
+	noErr(t, err)
+	equal(t, "code of a pending authenticator", ok, false)
+	ok, err = s.EnableTOTP("alice", 5)
+	noErr(t, err)
+	equal(t, "enabled", ok, true)
+	ok, err = s.EnableTOTP("alice", 6)
+	noErr(t, err)
+	equal(t, "enabled twice", ok, false)
+	started, err = s.SetTOTPSecret("alice", "THIRD")
+	noErr(t, err)
+	equal(t, "enrolling while enabled", started, false)
+
+	ok, err = s.UseTOTPStep("alice", 5)
+	noErr(t, err)
+	equal(t, "replayed step", ok, false)
+	ok, err = s.UseTOTPStep("alice", 6)
+	noErr(t, err)
+	equal(t, "next step", ok, true)
+	totp, err = s.TOTP("alice")
+	noErr(t, err)
+	equal(t, "enabled authenticator", totp, TOTP{Secret: "SECOND", Enabled: true, LastStep: 6})
+
+	noErr(t, s.ReplaceRecoveryCodes("alice", []string{"h1", "h2"}))
+	ok, err = s.UseRecoveryCode("alice", "h1", at)
+	noErr(t, err)
+	equal(t, "recovery code", ok, true)
+	ok, err = s.UseRecoveryCode("alice", "h1", at)
+	noErr(t, err)
+	equal(t, "recovery code used twice", ok, false)
+	ok, err = s.UseRecoveryCode("alice", "nope", at)
+	noErr(t, err)
+	equal(t, "unknown recovery code", ok, false)
+	left, err := s.RecoveryCodesLeft("alice")
+	noErr(t, err)
+	equal(t, "recovery codes left", left, 1)
+
+	noErr(t, s.ReplaceRecoveryCodes("alice", []string{"h3"}))
+	ok, err = s.UseRecoveryCode("alice", "h2", at)
+	noErr(t, err)
+	equal(t, "replaced recovery code", ok, false)
+
+	deleted, err := s.DeleteTOTP("alice")
+	noErr(t, err)
+	equal(t, "two-factor turned off", deleted, true)
+	_, err = s.TOTP("alice")
+	isErr(t, "authenticator after turning off", err, ErrNoRecord)
+	left, err = s.RecoveryCodesLeft("alice")
+	noErr(t, err)
+	equal(t, "recovery codes left after turning off", left, 0)
+	deleted, err = s.DeleteTOTP("alice")
+	noErr(t, err)
+	equal(t, "two-factor turned off twice", deleted, false)
+
+	noErr(t, s.CreateLoginChallenge("c1", "alice", at.Add(5*time.Minute)))
+	noErr(t, s.CreateLoginChallenge("c2", "alice", at.Add(-time.Minute)))
+	nickname, err := s.ChallengeUser("c1")
+	noErr(t, err)
+	equal(t, "challenge user", nickname, "alice")
+	_, err = s.ChallengeUser("c2")
+	isErr(t, "expired challenge", err, ErrNoRecord)
+	noErr(t, s.DeleteExpiredChallenges(at))
+	_, err = s.ChallengeUser("c1")
+	noErr(t, err)
+	noErr(t, s.DeleteLoginChallenge("c1"))
+	_, err = s.ChallengeUser("c1")
+	isErr(t, "deleted challenge", err, ErrNoRecord)
+}
+
+func testStoreLoginAttempts(t *testing.T, s Store) {
+	base := now().Add(-time.Hour)
+	record := func(account, ip, reason string, minute int) time.Time {
+		t.Helper()
+		at := base.Add(time.Duration(minute) * time.Minute)
+		noErr(t, s.RecordLogin(LoginAttempt{
+			Account:   account,
+			IP:        ip,
+			Succeeded: reason == "",
+			Reason:    reason,
+			At:        at,
+		}))
+		return at
+	}
+	failures := func(what string, count func() (int, time.Time, error), want int, wantLast time.Time) {
+		t.Helper()
+		n, last, err := count()
+		noErr(t, err)
+		equal(t, what, n, want)
+		sameTime(t, what+", last", last, wantLast)
+	}
+	account := func(account string, since time.Time) func() (int, time.Time, error) {
+		return func() (int, time.Time, error) { return s.AccountFailures(account, since) }
+	}
+	ip := func(ip string, since time.Time) func() (int, time.Time, error) {
+		return func() (int, time.Time, error) { return s.IPFailures(ip, since) }
+	}
+
+	failures("no attempts", account("alice", base), 0, time.Time{})
+
+	record("alice", "10.0.0.1", LoginBadPassword, 1)
+	second := record("alice", "10.0.0.2", LoginBadCode, 2)
+	record("alice", "10.0.0.1", LoginLocked, 3)
+	bob := record("bob", "10.0.0.1", LoginUnknownUser, 4)
+
+	failures("account failures", account("alice", base), 2, second)
+	failures("account failures in the window", account("alice", base.Add(90*time.Second)), 1, second)
+	failures("address failures without lockouts", ip("10.0.0.1", base), 2, bob)
+
+	// A success wipes the account's slate, not the address's
+	record("alice", "10.0.0.1", "", 5)
+	failures("account failures after a success", account("alice", base), 0, time.Time{})
+	failures("address failures after a success", ip("10.0.0.1", base), 2, bob)
+	last := record("alice", "10.0.0.3", LoginBadPassword, 6)
+	failures("account failures after a success and a failure", account("alice", base), 1, last)
+}
+
+func testStoreMailRequests(t *testing.T, s Store) {
+	base := now().Add(-time.Hour)
+	record := func(account, ip string, minute int) time.Time {
+		t.Helper()
+		at := base.Add(time.Duration(minute) * time.Minute)
+		noErr(t, s.RecordMailRequest(account, ip, at))
+		return at
+	}
+	requests := func(what string, count func() (int, time.Time, error), want int, wantOldest time.Time) {
+		t.Helper()
+		n, oldest, err := count()
+		noErr(t, err)
+		equal(t, what, n, want)
+		sameTime(t, what+", oldest", oldest, wantOldest)
+	}
+	account := func(account string, since time.Time) func() (int, time.Time, error) {
+		return func() (int, time.Time, error) { return s.AccountMailRequests(account, since) }
+	}
+	ip := func(ip string, since time.Time) func() (int, time.Time, error) {
+		return func() (int, time.Time, error) { return s.IPMailRequests(ip, since) }
+	}
+
+	requests("no requests", account("alice", base), 0, time.Time{})
+
+	first := record("alice", "10.0.0.1", 1)
+	second := record("alice", "10.0.0.2", 2)
+	record("bob", "10.0.0.1", 3)
+
+	requests("account requests", account("alice", base), 2, first)
+	requests("account requests in the window", account("alice", base.Add(90*time.Second)), 1, second)
+	requests("address requests", ip("10.0.0.1", base), 2, first)
+	requests("other address", ip("10.0.0.3", base), 0, time.Time{})
+
+	// They are not login attempts
+	failures, _, err := s.AccountFailures("alice", base)
+	noErr(t, err)
+	equal(t, "login failures", failures, 0)
+
+	noErr(t, s.DeleteMailRequests(base.Add(150*time.Second)))
+	requests("account after deleting", account("alice", base), 0, time.Time{})
+	requests("address after deleting", ip("10.0.0.1", base), 1, base.Add(3*time.Minute))
+}
+
+func testStorePosts(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob")
+	noErr(t, s.CreatePost("alice", Post{Title: "First", Content: "hello", Category: "General"}))
+	noErr(t, s.CreatePost("bob", Post{Title: "Second", Content: "world", Category: "News"}))
+
+	posts, err := s.ListPosts()
+	noErr(t, err)
+	equal(t, "posts", len(posts), 2)
+	byTitle := make(map[string]Post)
+	for _, post := range posts {
+		byTitle[post.Title] = post
+	}
+	first := byTitle["First"]
+	equal(t, "post", [3]string{first.Author, first.Content, first.Category}, [3]string{"alice", "hello", "General"})
+
+	noErr(t, s.CreateComment("bob", Comment{PostID: first.ID, Content: "nice"}))
+	noErr(t, s.CreateComment("alice", Comment{PostID: first.ID, Content: "thanks"}))
+	comments, err := s.ListComments(first.ID)
+	noErr(t, err)
+	equal(t, "comments", len(comments), 2)
+	for _, comment := range comments {
+		equal(t, "comment post", comment.PostID, first.ID)
+	}
+	comments, err = s.ListComments(byTitle["Second"].ID)
+	noErr(t, err)
+	equal(t, "comments of another post", len(comments), 0)
+}
+
+func testStoreMessages(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob", "carol")
+
+	m1, seqs := createMessage(t, s, Message{From: "alice", To: "bob", Content: "one", ClientID: "c1"})
+	equal(t, "seqs of the first message", seqs, map[string]int64{"alice": 1, "bob": 1})
+	m2, seqs := createMessage(t, s, Message{From: "bob", To: "alice", Content: "two"})
+	equal(t, "seqs of the reply", seqs, map[string]int64{"alice": 2, "bob": 2})
+	_, seqs = createMessage(t, s, Message{From: "alice", To: "alice", Content: "note to self"})
+	equal(t, "seqs of a note to self", seqs, map[string]int64{"alice": 3})
+
+	_, _, err := s.CreateMessage(Message{From: "alice", To: "bob", Content: "one again", ClientID: "c1", Timestamp: "x"})
+	isErr(t, "repeated client id", err, ErrDuplicateMessage)
+	m4, seqs := createMessage(t, s, Message{From: "bob", To: "alice", Content: "four", ClientID: "c1"})
+	equal(t, "seqs of another sender's c1", seqs, map[string]int64{"alice": 4, "bob": 3})
+
+	msg, err := s.MessageByClientID("alice", "c1")
+	noErr(t, err)
+	equal(t, "message by client id", [3]any{msg.ID, msg.Seq, msg.Content}, [3]any{m1, int64(1), "one"})
+	msg, err = s.MessageByClientID("bob", "c1")
+	noErr(t, err)
+	equal(t, "other sender's message by client id", [3]any{msg.ID, msg.Seq, msg.Content}, [3]any{m4, int64(3), "four"})
+	_, err = s.MessageByClientID("alice", "nope")
+	isErr(t, "unknown client id", err, ErrNoRecord)
+
+	for nickname, want := range map[string]int64{"alice": 4, "bob": 3, "carol": 0} {
+		seq, err := s.LatestSeq(nickname)
+		noErr(t, err)
+		equal(t, "latest seq of "+nickname, seq, want)
+	}
+
+	since, err := s.MessagesSince("alice", 1, 10)
+	noErr(t, err)
+	equal(t, "messages since", contents(since), []string{"two", "note to self", "four"})
+	equal(t, "seqs since", seqsOf(since), []int64{2, 3, 4})
+	since, err = s.MessagesSince("alice", 1, 2)
+	noErr(t, err)
+	equal(t, "messages since, limited", contents(since), []string{"two", "note to self"})
+	since, err = s.MessagesSince("carol", 0, 10)
+	noErr(t, err)
+	equal(t, "messages since, none", len(since), 0)
+
+	page, err := s.ListMessages(MessageQuery{User: "alice", Other: "bob", Limit: 10})
+	noErr(t, err)
+	equal(t, "latest page, newest first", idsOf(page), []int64{m4, m2, m1})
+	page, err = s.ListMessages(MessageQuery{User: "bob", Other: "alice", Before: m4, Limit: 1})
+	noErr(t, err)
+	equal(t, "page before", idsOf(page), []int64{m2})
+	page, err = s.ListMessages(MessageQuery{User: "alice", Other: "bob", After: m1, Limit: 10})
+	noErr(t, err)
+	equal(t, "page after, oldest first", idsOf(page), []int64{m2, m4})
+	page, err = s.ListMessages(MessageQuery{User: "alice", Other: "carol", Limit: 10})
+	noErr(t, err)
+	equal(t, "page of another conversation", len(page), 0)
+
+	sender, err := s.MessageSender(m1, "bob")
+	noErr(t, err)
+	equal(t, "sender", sender, "alice")
+	_, err = s.MessageSender(m1, "carol")
+	isErr(t, "sender for someone else", err, ErrNoRecord)
+}
+
+func testStoreReceipts(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob", "carol")
+	m1, _ := createMessage(t, s, Message{From: "alice", To: "bob", Content: "one"})
+	m2, _ := createMessage(t, s, Message{From: "bob", To: "alice", Content: "two"})
+	createMessage(t, s, Message{From: "carol", To: "alice", Content: "three"})
+	createMessage(t, s, Message{From: "bob", To: "alice", Content: "four"})
+	delivered, read := "2024-01-02T03:05:00Z", "2024-01-02T03:06:00Z"
+
+	ok, err := s.MarkDelivered(m1, delivered)
+	noErr(t, err)
+	equal(t, "delivered", ok, true)
+	ok, err = s.MarkDelivered(m1, read)
+	noErr(t, err)
+	equal(t, "delivered twice", ok, false)
+
+	unread, err := s.UnreadCount("bob", "alice")
+	noErr(t, err)
+	equal(t, "unread before reading", unread, 1)
+	ok, err = s.MarkRead("alice", "bob", m1, read)
+	noErr(t, err)
+	equal(t, "read", ok, true)
+	ok, err = s.MarkRead("alice", "bob", m1, read)
+	noErr(t, err)
+	equal(t, "read twice", ok, false)
+	unread, err = s.UnreadCount("bob", "alice")
+	noErr(t, err)
+	equal(t, "unread after reading", unread, 0)
+
+	// Reading also delivers, up to the given message only
+	ok, err = s.MarkRead("bob", "alice", m2, read)
+	noErr(t, err)
+	equal(t, "read up to", ok, true)
+	page, err := s.ListMessages(MessageQuery{User: "alice", Other: "bob", Limit: 10})
+	noErr(t, err)
+	receipts := make(map[string][2]string)
+	for _, msg := range page {
+		receipts[msg.Content] = [2]string{msg.DeliveredAt, msg.ReadAt}
+	}
+	equal(t, "receipts", receipts, map[string][2]string{
+		"one":  {delivered, read},
+		"two":  {read, read},
+		"four": {"", ""},
+	})
+
+	group, err := s.CreateGroup("team", "carol")
+	noErr(t, err)
+	noErr(t, s.CreateInvite(group, "alice", "carol"))
+	noErr(t, s.AcceptInvite(group, "alice"))
+	createMessage(t, s, Message{From: "carol", GroupID: group, Content: "hi team"})
+
+	counts, err := s.UnreadCounts("alice")
+	noErr(t, err)
+	equal(t, "unread counts, senders then groups", counts, []Notification{
+		{Receiver: "alice", Sender: "bob", Unread: 1},
+		{Receiver: "alice", Sender: "carol", Unread: 1},
+		{Receiver: "alice", GroupID: group, Unread: 1},
+	})
+	counts, err = s.UnreadCounts("carol")
+	noErr(t, err)
+	equal(t, "unread counts, none", counts, []Notification{})
+}
+
+func testStoreGroups(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob", "carol")
+
+	id, err := s.CreateGroup("team", "alice")
+	noErr(t, err)
+	group, err := s.Group(id)
+	noErr(t, err)
+	equal(t, "new group", [3]any{group.Name, group.Owner, group.Members}, [3]any{"team", "alice", []string{"alice"}})
+	_, err = s.Group(id + 100)
+	isErr(t, "unknown group", err, ErrNoRecord)
+
+	noErr(t, s.CreateInvite(id, "bob", "alice"))
+	noErr(t, s.CreateInvite(id, "bob", "carol"))
+	isErr(t, "inviting an unknown user", s.CreateInvite(id, "nobody", "alice"), ErrNoRecord)
+	invites, err := s.ListInvites("bob")
+	noErr(t, err)
+	equal(t, "invites", len(invites), 1)
+	equal(t, "invite", [3]any{invites[0].GroupID, invites[0].Name, invites[0].InvitedBy}, [3]any{id, "team", "alice"})
+
+	// Messages from before joining are not unread
+	before, seqs := createMessage(t, s, Message{From: "alice", GroupID: id, Content: "before bob"})
+	equal(t, "seqs before joining", seqs, map[string]int64{"alice": 1})
+	noErr(t, s.AcceptInvite(id, "bob"))
+	isErr(t, "accepting twice", s.AcceptInvite(id, "bob"), ErrNoRecord)
+	invites, err = s.ListInvites("bob")
+	noErr(t, err)
+	equal(t, "invites after accepting", len(invites), 0)
+	group, err = s.Group(id)
+	noErr(t, err)
+	equal(t, "members", group.Members, []string{"alice", "bob"})
+	groups, err := s.ListGroups("bob")
+	noErr(t, err)
+	equal(t, "groups of a member", len(groups), 1)
+	groups, err = s.ListGroups("carol")
+	noErr(t, err)
+	equal(t, "groups of someone else", len(groups), 0)
+
+	unread, err := s.GroupUnreadCount(id, "bob")
+	noErr(t, err)
+	equal(t, "unread after joining", unread, 0)
+	after, seqs := createMessage(t, s, Message{From: "alice", GroupID: id, Content: "after bob"})
+	equal(t, "seqs after joining", seqs, map[string]int64{"alice": 2, "bob": 1})
+	for nickname, want := range map[string]int{"alice": 0, "bob": 1, "carol": 0} {
+		unread, err := s.GroupUnreadCount(id, nickname)
+		noErr(t, err)
+		equal(t, "group unread of "+nickname, unread, want)
+	}
+
+	page, err := s.ListMessages(MessageQuery{User: "bob", GroupID: id, Limit: 10})
+	noErr(t, err)
+	equal(t, "group page", idsOf(page), []int64{after, before})
+
+	dm, _ := createMessage(t, s, Message{From: "alice", To: "bob", Content: "direct"})
+	ok, err := s.MarkGroupRead(id, "bob", dm)
+	noErr(t, err)
+	equal(t, "group read up to a direct message", ok, false)
+	ok, err = s.MarkGroupRead(id, "bob", after)
+	noErr(t, err)
+	equal(t, "group read", ok, true)
+	ok, err = s.MarkGroupRead(id, "bob", before)
+	noErr(t, err)
+	equal(t, "group read backwards", ok, false)
+	unread, err = s.GroupUnreadCount(id, "bob")
+	noErr(t, err)
+	equal(t, "group unread after reading", unread, 0)
+
+	conversations, err := s.GroupConversations("bob")
+	noErr(t, err)
+	equal(t, "group conversations", conversations, []Conversation{{
+		GroupID:       id,
+		Name:          "team",
+		LastMessageID: after,
+		LastSender:    "alice",
+		LastMessage:   "after bob",
+		LastMessageAt: "2024-01-02T03:04:05Z",
+	}})
+	_, err = s.GroupConversation("carol", id)
+	isErr(t, "group conversation of someone else", err, ErrNoRecord)
+
+	noErr(t, s.CreateInvite(id, "carol", "bob"))
+	ok, err = s.DeleteInvite(id, "carol")
+	noErr(t, err)
+	equal(t, "declined", ok, true)
+	ok, err = s.DeleteInvite(id, "carol")
+	noErr(t, err)
+	equal(t, "declined twice", ok, false)
+
+	// The longest standing member takes over from a leaving owner
+	ok, err = s.RemoveMember(id, "alice")
+	noErr(t, err)
+	equal(t, "owner left", ok, true)
+	ok, err = s.RemoveMember(id, "alice")
+	noErr(t, err)
+	equal(t, "owner left twice", ok, false)
+	group, err = s.Group(id)
+	noErr(t, err)
+	equal(t, "group after the owner left", [2]any{group.Owner, group.Members}, [2]any{"bob", []string{"bob"}})
+}
+
+func testStoreConversations(t *testing.T, s Store) {
+	createUsers(t, s, "alice", "bob", "carol")
+	createMessage(t, s, Message{From: "alice", To: "bob", Content: "one"})
+	m2, _ := createMessage(t, s, Message{From: "bob", To: "alice", Content: "two", Timestamp: "2024-01-02T03:05:00Z"})
+
+	conversations, err := s.Conversations("alice")
+	noErr(t, err)
+	slices.SortFunc(conversations, func(a, b Conversation) int {
+		return strings.Compare(a.Nickname, b.Nickname)
+	})
+	bob := Conversation{Nickname: "bob", LastMessageID: m2, LastSender: "bob", LastMessage: "two", LastMessageAt: "2024-01-02T03:05:00Z", Unread: 1}
+	equal(t, "conversations", conversations, []Conversation{bob, {Nickname: "carol"}})
+
+	conversation, err := s.Conversation("alice", "bob")
+	noErr(t, err)
+	equal(t, "conversation", conversation, bob)
+	conversation, err = s.Conversation("bob", "alice")
+	noErr(t, err)
+	equal(t, "conversation of the other side", conversation.Unread, 1)
+	_, err = s.Conversation("alice", "alice")
+	isErr(t, "conversation with oneself", err, ErrNoRecord)
+	_, err = s.Conversation("alice", "nobody")
+	isErr(t, "conversation with an unknown user", err, ErrNoRecord)
+}
+
+func contents(messages []Message) []string {
+	var out []string
+	for _, msg := range messages {
+		out = append(out, msg.Content)
+	}
+	return out
+}
+
+func seqsOf(messages []Message) []int64 {
+	var out []int64
+	for _, msg := range messages {
+		out = append(out, msg.Seq)
+	}
+	return out
+}
+
+func idsOf(messages []Message) []int64 {
+	var out []int64
+	for _, msg := range messages {
+		out = append(out, msg.ID)
+	}
+	return out
+}
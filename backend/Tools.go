@@ -1,8 +1,6 @@
 package backend
 
 import (
-	"net/http"
-
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -11,10 +9,6 @@ type Error struct {
 	ErrNumber string
 }
 
-func renderErrorPage(w http.ResponseWriter, errMsg string, errCode int) {
-	http.Error(w, errMsg, errCode)
-}
-
 func CheckPassword(hashedPassword, password string) error {
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 	return err
@@ -0,0 +1,426 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+// TOTP codes follow RFC 6238 with the parameters every authenticator app
+// supports: SHA-1, six digits and a 30 second step. A code is also accepted
+// one step early or late to allow for clock drift.
+const (
+	TOTPPeriod = 30 * time.Second
+	TOTPDigits = 6
+	TOTPSkew   = 1
+)
+
+const (
+	// RecoveryCodeCount is how many recovery codes a user gets at a time.
+	RecoveryCodeCount = 10
+	// TwoFactorChallengeLifetime is how long a login may wait for its
+	// second factor.
+	TwoFactorChallengeLifetime = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is a user's authenticator. Secret is base32 encoded, as apps expect
+// it, and LastStep is the time step of the last accepted code.
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode is the code for one time step, as in RFC 4226 section 5.3.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+}
+
+// matchTOTP returns the time step code belongs to, if it is valid around now.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(TOTPPeriod/time.Second)
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI apps read from a QR code to enroll.
+func (S *Server) totpURI(nickname, secret string) string {
+	issuer := S.Config.TOTPIssuer
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTPDigits)},
+		"period":    {fmt.Sprint(int(TOTPPeriod / time.Second))},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+nickname) + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns fresh codes to show once and the hashes to keep.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes so a code can be typed
+// back however it was written down.
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code)))
+}
+
+// checkSecondFactor spends a code from nickname's authenticator, or one of
+// their recovery codes.
+func (S *Server) checkSecondFactor(nickname, code string, now time.Time) (bool, error) {
+	code = strings.TrimSpace(code)
+	totp, err := S.Store.TOTP(nickname)
+	if err == ErrNoRecord || (err == nil && !totp.Enabled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if step, ok := matchTOTP(totp.Secret, code, now); ok {
+		// A code seen before may have been watched over a shoulder
+		return S.Store.UseTOTPStep(nickname, step)
+	}
+	return S.Store.UseRecoveryCode(nickname, hashRecoveryCode(code), now)
+}
+
+// startTwoFactor answers the password step of a login for an enrolled user
+// with a challenge to send back to /login/2fa along with a code.
+func (S *Server) startTwoFactor(w http.ResponseWriter, nickname string, now time.Time) {
+	challenge := uuid.NewV4().String()
+	err := S.Store.CreateLoginChallenge(challenge, nickname, now.Add(TwoFactorChallengeLifetime))
+	if err != nil {
+		fmt.Println("DB TOTP Error:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"two_factor": true,
+		"challenge":  challenge,
+	})
+}
+
+// TwoFactorLoginHandler finishes a login with the second factor. Wrong codes
+// count as failed logins of the account.
+func (S *Server) TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	nickname, err := S.Store.ChallengeUser(request.Challenge)
+	if err != nil {
+		http.Error(w, "Login expired, start again", http.StatusUnauthorized)
+		return
+	}
+
+	ip, now := S.clientIP(r), S.now()
+	if S.codeLockout(w, r, nickname, ip, now) {
+		return
+	}
+
+	ok, err := S.checkSecondFactor(nickname, request.Code, now)
+	if err != nil {
+		fmt.Println("DB TOTP Error:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		S.recordLogin(nickname, ip, LoginBadCode, now)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := S.Store.DeleteLoginChallenge(request.Challenge); err != nil {
+		fmt.Println("DB TOTP Error:", err)
+	}
+	S.recordLogin(nickname, ip, "", now)
+	S.MakeToken(w, nickname, r.UserAgent())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"username": nickname,
+	})
+}
+
+// TwoFactorHandler tells the caller whether two-factor is on and how many
+// recovery codes they have left.
+func (S *Server) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	totp, err := S.Store.TOTP(nickname)
+	if err != nil && err != ErrNoRecord {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	left, err := S.Store.RecoveryCodesLeft(nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":             totp.Enabled,
+		"recovery_codes_left": left,
+	})
+}
+
+// TwoFactorEnrollHandler hands out a new secret with its provisioning URI,
+// two-factor is only on once a code from it is confirmed.
+func (S *Server) TwoFactorEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	started, err := S.Store.SetTOTPSecret(nickname, secret)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !started {
+		http.Error(w, "Two-factor is already enabled", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    S.totpURI(nickname, secret),
+	})
+}
+
+// TwoFactorConfirmHandler turns two-factor on with a first code and returns
+// the recovery codes, which are not shown again. Wrong codes count as failed
+// logins, as everywhere else a code is asked for.
+func (S *Server) TwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, request, ok := S.twoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	totp, err := S.Store.TOTP(nickname)
+	if err == ErrNoRecord || (err == nil && totp.Enabled) {
+		http.Error(w, "No enrollment in progress", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ip, now := S.clientIP(r), S.now()
+	if S.codeLockout(w, r, nickname, ip, now) {
+		return
+	}
+	step, ok := matchTOTP(totp.Secret, strings.TrimSpace(request.Code), now)
+	if ok {
+		ok, err = S.Store.EnableTOTP(nickname, step)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok {
+		S.recordLogin(nickname, ip, LoginBadCode, now)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	S.sendRecoveryCodes(w, nickname)
+}
+
+// TwoFactorDisableHandler turns two-factor off, given a current code.
+func (S *Server) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, _, ok := S.twoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	if _, err := S.Store.DeleteTOTP(nickname); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RecoveryCodesHandler replaces the caller's recovery codes, given a current
+// code.
+func (S *Server) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, _, ok := S.twoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	S.sendRecoveryCodes(w, nickname)
+}
+
+// TwoFactorResetHandler lets an admin turn off two-factor for a user who
+// lost their authenticator and their recovery codes.
+func (S *Server) TwoFactorResetHandler(w http.ResponseWriter, r *http.Request) {
+	admin, request, ok := S.twoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	if !slices.Contains(S.Config.Admins, admin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	reset, err := S.Store.DeleteTOTP(request.Nickname)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !reset {
+		http.Error(w, "Two-factor is not enabled for this user", http.StatusNotFound)
+		return
+	}
+	fmt.Println("Two-factor reset for", request.Nickname, "by", admin)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (S *Server) sendRecoveryCodes(w http.ResponseWriter, nickname string) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := S.Store.ReplaceRecoveryCodes(nickname, hashes); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"recovery_codes": codes,
+	})
+}
+
+// twoFactorCode is twoFactorRequest for the endpoints that need a valid
+// second factor from the caller. Wrong codes count as failed logins of the
+// account, as in TwoFactorLoginHandler, so a stolen session cannot guess its
+// way to turning two-factor off.
+func (S *Server) twoFactorCode(w http.ResponseWriter, r *http.Request) (string, TwoFactorRequest, bool) {
+	nickname, request, ok := S.twoFactorRequest(w, r)
+	if !ok {
+		return "", request, false
+	}
+
+	ip, now := S.clientIP(r), S.now()
+	if S.codeLockout(w, r, nickname, ip, now) {
+		return "", request, false
+	}
+
+	valid, err := S.checkSecondFactor(nickname, request.Code, now)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", request, false
+	}
+	if !valid {
+		S.recordLogin(nickname, ip, LoginBadCode, now)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return "", request, false
+	}
+	return nickname, request, true
+}
+
+// codeLockout refuses a second factor while the account or the address is
+// locked out of logging in, and reports whether it did.
+func (S *Server) codeLockout(w http.ResponseWriter, r *http.Request, nickname, ip string, now time.Time) bool {
+	wait, err := S.loginLockout(nickname, ip, now)
+	if err != nil {
+		fmt.Println("DB Login Error:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	if wait > 0 {
+		S.recordLogin(nickname, ip, LoginLocked, now)
+		S.refuseLogin(w, r, wait)
+		return true
+	}
+	return false
+}
+
+// twoFactorRequest checks the method and the session of a POST to one of the
+// /2fa endpoints and decodes its body.
+func (S *Server) twoFactorRequest(w http.ResponseWriter, r *http.Request) (string, TwoFactorRequest, bool) {
+	var request TwoFactorRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return "", request, false
+	}
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", request, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return "", request, false
+	}
+	return nickname, request, true
+}
@@ -0,0 +1,276 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B, their last six digits.
+func TestTOTPVectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, test := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		at := time.Unix(test.unix, 0)
+		if code := totpCode([]byte("12345678901234567890"), test.unix/30); code != test.code {
+			t.Errorf("code at %d: got %s, want %s", test.unix, code, test.code)
+		}
+		step, ok := matchTOTP(secret, test.code, at)
+		if !ok || step != test.unix/30 {
+			t.Errorf("match at %d: got step %d, %v", test.unix, step, ok)
+		}
+
+		// One step of drift either way is allowed, two are not. Before
+		// 1970 the steps do not divide evenly, so the first vector is left
+		// out
+		if test.unix < 2*int64(TOTPPeriod/time.Second) {
+			continue
+		}
+		for _, drift := range []struct {
+			by time.Duration
+			ok bool
+		}{
+			{-TOTPPeriod, true},
+			{TOTPPeriod, true},
+			{-2 * TOTPPeriod, false},
+			{2 * TOTPPeriod, false},
+		} {
+			if _, ok := matchTOTP(secret, test.code, at.Add(drift.by)); ok != drift.ok {
+				t.Errorf("code of %d at %v off: matched %v, want %v", test.unix, drift.by, ok, drift.ok)
+			}
+		}
+	}
+
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := matchTOTP(secret, code, time.Unix(59, 0)); ok {
+			t.Errorf("matched %q", code)
+		}
+	}
+}
+
+// twoFactorServer is a test server whose clock stands still at the start of
+// a time step until the test moves it. Login challenges expire by the real
+// time, so the clock starts at it.
+func twoFactorServer(t *testing.T, nicknames ...string) (*Server, func(time.Duration), func(secret string) string) {
+	t.Helper()
+	S := newTestServer(t, nicknames...)
+	now := time.Now().Truncate(TOTPPeriod)
+	S.clock = func() time.Time { return now }
+	code := func(secret string) string {
+		key, err := totpEncoding.DecodeString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return totpCode(key, now.Unix()/int64(TOTPPeriod/time.Second))
+	}
+	return S, func(d time.Duration) { now = now.Add(d) }, code
+}
+
+// enroll turns two-factor on for nickname and returns the secret and the
+// recovery codes.
+func enroll(t *testing.T, S *Server, nickname string, code func(string) string) (string, []string) {
+	t.Helper()
+	w := postAs(S.TwoFactorEnrollHandler, "/2fa/enroll", nickname, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: status %d: %s", w.Code, w.Body)
+	}
+	var enrollment struct{ Secret, URI string }
+	decode(t, w, &enrollment)
+
+	w = postAs(S.TwoFactorConfirmHandler, "/2fa/confirm", nickname, TwoFactorRequest{Code: code(enrollment.Secret)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: status %d: %s", w.Code, w.Body)
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decode(t, w, &confirmed)
+	return enrollment.Secret, confirmed.RecoveryCodes
+}
+
+// loginChallenge logs nickname in with their password and returns the
+// challenge to answer.
+func loginChallenge(t *testing.T, S *Server, nickname string) string {
+	t.Helper()
+	w := login(S, nickname, testPassword, "192.0.2.1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	var started struct {
+		TwoFactor bool `json:"two_factor"`
+		Challenge string
+	}
+	decode(t, w, &started)
+	if !started.TwoFactor || started.Challenge == "" {
+		t.Fatal("no challenge for an enrolled user")
+	}
+	return started.Challenge
+}
+
+func secondFactor(S *Server, challenge, code string) int {
+	return post(S.TwoFactorLoginHandler, "/login/2fa", TwoFactorRequest{Challenge: challenge, Code: code}, "192.0.2.1").Code
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	S, _, code := twoFactorServer(t, "alice")
+
+	w := postAs(S.TwoFactorEnrollHandler, "/2fa/enroll", "alice", nil)
+	var enrollment struct{ Secret, URI string }
+	decode(t, w, &enrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Forum:alice?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("provisioning URI %s", enrollment.URI)
+	}
+
+	// Not on until confirmed, logins still take the password alone
+	if w := login(S, "alice", testPassword, "192.0.2.1"); w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("login before confirming: status %d: %s", w.Code, w.Body)
+	}
+
+	for _, test := range []struct {
+		name string
+		code string
+		want int
+	}{
+		{"wrong code", "000000", http.StatusBadRequest},
+		{"garbage", "abc", http.StatusBadRequest},
+		{"current code", code(enrollment.Secret), http.StatusOK},
+		{"again once enabled", code(enrollment.Secret), http.StatusNotFound},
+	} {
+		if w := postAs(S.TwoFactorConfirmHandler, "/2fa/confirm", "alice", TwoFactorRequest{Code: test.code}); w.Code != test.want {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.want, w.Body)
+		}
+	}
+
+	if w := postAs(S.TwoFactorEnrollHandler, "/2fa/enroll", "alice", nil); w.Code != http.StatusConflict {
+		t.Errorf("enrolling twice: status %d", w.Code)
+	}
+	var status struct {
+		Enabled           bool
+		RecoveryCodesLeft int `json:"recovery_codes_left"`
+	}
+	decode(t, serve(S.TwoFactorHandler, http.MethodGet, "/2fa", "alice"), &status)
+	if !status.Enabled || status.RecoveryCodesLeft != RecoveryCodeCount {
+		t.Errorf("got %+v after confirming", status)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	S, wait, code := twoFactorServer(t, "alice")
+	secret, recoveryCodes := enroll(t, S, "alice", code)
+
+	// The step confirmed with is spent already
+	challenge := loginChallenge(t, S, "alice")
+	if got := secondFactor(S, challenge, code(secret)); got != http.StatusUnauthorized {
+		t.Fatalf("code of a used step: status %d", got)
+	}
+	wait(TOTPPeriod)
+	if got := secondFactor(S, challenge, code(secret)); got != http.StatusOK {
+		t.Fatalf("code of the next step: status %d", got)
+	}
+	// The challenge is gone once answered
+	if got := secondFactor(S, challenge, code(secret)); got != http.StatusUnauthorized {
+		t.Fatalf("answering a challenge twice: status %d", got)
+	}
+
+	// Recovery codes work once, however they are typed
+	challenge = loginChallenge(t, S, "alice")
+	typed := strings.ToUpper(strings.Replace(recoveryCodes[0], "-", " ", 1))
+	if got := secondFactor(S, challenge, typed); got != http.StatusOK {
+		t.Fatalf("recovery code %q: status %d", typed, got)
+	}
+	challenge = loginChallenge(t, S, "alice")
+	if got := secondFactor(S, challenge, recoveryCodes[0]); got != http.StatusUnauthorized {
+		t.Fatalf("spent recovery code: status %d", got)
+	}
+	if got := secondFactor(S, challenge, recoveryCodes[1]); got != http.StatusOK {
+		t.Fatalf("second recovery code: status %d", got)
+	}
+
+	if got := secondFactor(S, "no such challenge", recoveryCodes[2]); got != http.StatusUnauthorized {
+		t.Fatalf("unknown challenge: status %d", got)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	S, wait, code := twoFactorServer(t, "alice")
+	S.Config.Login.AccountAttempts = 3
+	secret, _ := enroll(t, S, "alice", code)
+	wait(TOTPPeriod)
+
+	challenge := loginChallenge(t, S, "alice")
+	for i := 0; i < 3; i++ {
+		if got := secondFactor(S, challenge, "000000"); got != http.StatusUnauthorized {
+			t.Fatalf("wrong code: status %d", got)
+		}
+	}
+	w := post(S.TwoFactorLoginHandler, "/login/2fa", TwoFactorRequest{Challenge: challenge, Code: code(secret)}, "192.0.2.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("right code while locked: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// So are the endpoints behind a session
+	w = postAs(S.TwoFactorDisableHandler, "/2fa/disable", "alice", TwoFactorRequest{Code: code(secret)})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("disabling while locked: status %d", w.Code)
+	}
+
+	wait(31 * time.Second)
+	if got := secondFactor(S, challenge, code(secret)); got != http.StatusOK {
+		t.Fatalf("after the lockout: status %d", got)
+	}
+}
+
+func TestTwoFactorConfirmLockout(t *testing.T) {
+	S, _, code := twoFactorServer(t, "alice")
+	S.Config.Login.AccountAttempts = 3
+	w := postAs(S.TwoFactorEnrollHandler, "/2fa/enroll", "alice", nil)
+	var enrollment struct{ Secret string }
+	decode(t, w, &enrollment)
+
+	for i := 0; i < 3; i++ {
+		if w := postAs(S.TwoFactorConfirmHandler, "/2fa/confirm", "alice", TwoFactorRequest{Code: "000000"}); w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong code: status %d", w.Code)
+		}
+	}
+	w = postAs(S.TwoFactorConfirmHandler, "/2fa/confirm", "alice", TwoFactorRequest{Code: code(enrollment.Secret)})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("right code while locked: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestTwoFactorAdminReset(t *testing.T) {
+	S, _, code := twoFactorServer(t, "alice", "admin")
+	S.Config.Admins = []string{"admin"}
+	enroll(t, S, "alice", code)
+
+	for _, test := range []struct {
+		name    string
+		session string
+		target  string
+		want    int
+	}{
+		{"not an admin", "alice", "alice", http.StatusForbidden},
+		{"no session", "", "alice", http.StatusUnauthorized},
+		{"admin", "admin", "alice", http.StatusNoContent},
+		{"not enrolled", "admin", "alice", http.StatusNotFound},
+	} {
+		w := postAs(S.TwoFactorResetHandler, "/admin/2fa/reset", test.session, TwoFactorRequest{Nickname: test.target})
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.want, w.Body)
+		}
+	}
+
+	// The password alone is enough again
+	if w := login(S, "alice", testPassword, "192.0.2.1"); w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("login after the reset: status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultTypingTimeout = 5 * time.Second
+
+// typingKey is a sender and either a recipient or a group.
+type typingKey struct {
+	from  string
+	to    string
+	group int64
+}
+
+type typingState struct {
+	clientID string
+	expires  time.Time
+	timer    *time.Timer
+}
+
+// TypingTracker remembers who is currently typing to whom, so the server
+// rather than the sender decides when an indicator goes away. A pair is a
+// sender and a recipient or a group, given as to or group with the other one
+// empty. Every active pair has a timer, if the sender goes quiet for longer
+// than the timeout the pair expires and onExpire is called with the stop
+// indicator to relay.
+//
+// Each instance tracks the senders connected to it. The indicators, and the
+// stops when a pair expires, go to the other instances through the Broker
+// like any frame, but TypingTo and TypingIn only know the local senders, so a
+// client resuming on another instance than the sender's sees the indicator
+// with the next typing frame rather than in its resumed frame.
+type TypingTracker struct {
+	mu       sync.Mutex
+	active   map[typingKey]*typingState
+	timeout  time.Duration
+	onExpire func(stopped TypingIndicator)
+}
+
+func NewTypingTracker(timeout time.Duration, onExpire func(stopped TypingIndicator)) *TypingTracker {
+	if timeout <= 0 {
+		timeout = DefaultTypingTimeout
+	}
+	return &TypingTracker{
+		active:   make(map[typingKey]*typingState),
+		timeout:  timeout,
+		onExpire: onExpire,
+	}
+}
+
+// Start marks from as typing to to on behalf of clientID. It returns false
+// when the pair was already active, in that case only the expiry is pushed
+// back and nothing needs to be relayed.
+func (T *TypingTracker) Start(clientID, from, to string, group int64) bool {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	key := typingKey{from, to, group}
+	if state, ok := T.active[key]; ok {
+		state.clientID = clientID
+		state.expires = time.Now().Add(T.timeout)
+		state.timer.Reset(T.timeout)
+		return false
+	}
+
+	state := &typingState{clientID: clientID, expires: time.Now().Add(T.timeout)}
+	state.timer = time.AfterFunc(T.timeout, func() { T.expire(key, state) })
+	T.active[key] = state
+	return true
+}
+
+// Stop clears the pair and reports whether it was active.
+func (T *TypingTracker) Stop(from, to string, group int64) bool {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	key := typingKey{from, to, group}
+	state, ok := T.active[key]
+	if !ok {
+		return false
+	}
+	state.timer.Stop()
+	delete(T.active, key)
+	return true
+}
+
+// StopClient clears every pair started from the given connection and returns
+// the stop indicators to relay to whoever was still seeing them.
+func (T *TypingTracker) StopClient(clientID string) []TypingIndicator {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	var stopped []TypingIndicator
+	for key, state := range T.active {
+		if state.clientID == clientID {
+			state.timer.Stop()
+			delete(T.active, key)
+			stopped = append(stopped, key.stopped())
+		}
+	}
+	return stopped
+}
+
+// TypingTo returns who is typing to the given user right now, as far as this
+// instance knows.
+func (T *TypingTracker) TypingTo(to string) []string {
+	return T.typing(func(key typingKey) bool { return key.group == 0 && key.to == to })
+}
+
+// TypingIn returns who is typing in the given group right now, as far as this
+// instance knows.
+func (T *TypingTracker) TypingIn(group int64) []string {
+	return T.typing(func(key typingKey) bool { return key.group == group })
+}
+
+func (T *TypingTracker) typing(match func(typingKey) bool) []string {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	senders := []string{}
+	for key := range T.active {
+		if match(key) {
+			senders = append(senders, key.from)
+		}
+	}
+	return senders
+}
+
+func (key typingKey) stopped() TypingIndicator {
+	return TypingIndicator{From: key.from, To: key.to, GroupID: key.group, IsTyping: false}
+}
+
+func (T *TypingTracker) expire(key typingKey, state *typingState) {
+	T.mu.Lock()
+	// The pair may have been stopped, restarted or refreshed while the timer
+	// was firing.
+	if T.active[key] != state || time.Now().Before(state.expires) {
+		T.mu.Unlock()
+		return
+	}
+	delete(T.active, key)
+	T.mu.Unlock()
+
+	if T.onExpire != nil {
+		T.onExpire(key.stopped())
+	}
+}
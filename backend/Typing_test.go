@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const testTypingTimeout = 50 * time.Millisecond
+
+func TestTypingTrackerExpires(t *testing.T) {
+	expired := make(chan TypingIndicator, 1)
+	T := NewTypingTracker(testTypingTimeout, func(stopped TypingIndicator) { expired <- stopped })
+
+	if !T.Start("1", "alice", "bob", 0) {
+		t.Fatal("first start not relayed")
+	}
+	time.Sleep(testTypingTimeout / 2)
+	// Typing on pushes the expiry back, without relaying anything
+	refreshed := time.Now()
+	if T.Start("1", "alice", "bob", 0) {
+		t.Error("refresh relayed")
+	}
+
+	select {
+	case stopped := <-expired:
+		if elapsed := time.Since(refreshed); elapsed < testTypingTimeout {
+			t.Errorf("expired %v after the refresh, want at least %v", elapsed, testTypingTimeout)
+		}
+		if stopped != (TypingIndicator{From: "alice", To: "bob"}) {
+			t.Errorf("relayed %+v", stopped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("never expired")
+	}
+	if typing := T.TypingTo("bob"); len(typing) != 0 {
+		t.Errorf("%v still typing after the timeout", typing)
+	}
+
+	// A pair stopped before the timeout does not expire later
+	T.Start("1", "alice", "bob", 0)
+	if !T.Stop("alice", "bob", 0) {
+		t.Error("stop of an active pair not relayed")
+	}
+	select {
+	case stopped := <-expired:
+		t.Errorf("expired %+v after being stopped", stopped)
+	case <-time.After(2 * testTypingTimeout):
+	}
+}
+
+// typingFrames returns the typing indicators queued for client.
+func typingFrames(t *testing.T, client *Client) []TypingIndicator {
+	t.Helper()
+	var indicators []TypingIndicator
+	for _, payload := range ofType(queued(t, client), FrameTyping) {
+		var indicator TypingIndicator
+		if err := json.Unmarshal(payload, &indicator); err != nil {
+			t.Fatal(err)
+		}
+		indicators = append(indicators, indicator)
+	}
+	return indicators
+}
+
+func TestTypingIndicator(t *testing.T) {
+	S := newTestServer(t, "alice", "bob")
+	S.hub = NewHub(WSConfig{SendQueueSize: 64})
+	S.Broker = NewMemoryBroker()
+	S.Broker.Subscribe(S.handleEvent)
+	S.typing = NewTypingTracker(testTypingTimeout, func(stopped TypingIndicator) {
+		S.sendTyping(stopped, nil)
+	})
+	alice, bob := testClient(S.hub, "1", "alice"), testClient(S.hub, "2", "bob")
+	S.hub.Register(alice)
+	S.hub.Register(bob)
+	typing := TypingIndicator{From: "alice", To: "bob", IsTyping: true}
+	stopped := TypingIndicator{From: "alice", To: "bob"}
+
+	// Turned off by the server once alice goes quiet
+	S.handleTypingIndicator(alice, typing)
+	if got := typingFrames(t, bob); len(got) != 1 || got[0] != typing {
+		t.Fatalf("bob got %+v when alice started typing", got)
+	}
+	var got []TypingIndicator
+	for deadline := time.Now().Add(time.Second); len(got) == 0 && time.Now().Before(deadline); time.Sleep(testTypingTimeout) {
+		got = typingFrames(t, bob)
+	}
+	if len(got) != 1 || got[0] != stopped {
+		t.Fatalf("bob got %+v after the timeout", got)
+	}
+
+	// Turned off by the message, and only once
+	S.handleTypingIndicator(alice, typing)
+	S.handleMessage(alice, "m", Message{To: "bob", Content: "hi"})
+	if got := typingFrames(t, bob); len(got) != 2 || got[0] != typing || got[1] != stopped {
+		t.Fatalf("bob got %+v around the message", got)
+	}
+	if senders := S.typing.TypingTo("bob"); len(senders) != 0 {
+		t.Errorf("%v still typing after the message", senders)
+	}
+	time.Sleep(3 * testTypingTimeout)
+	if got := typingFrames(t, bob); len(got) != 0 {
+		t.Errorf("bob got %+v after the message", got)
+	}
+}
@@ -1,151 +1,172 @@
 package backend
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
-	"github.com/twinj/uuid"
+	"github.com/gorilla/websocket"
 )
 
-func (S *Server) Notification(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// UnreadHandler returns how many unread messages the caller has from each
+// sender and in each group, counted from the messages table.
+func (S *Server) UnreadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	cookie, err := r.Cookie("session_token")
+	nickname, err := S.CheckSession(r)
 	if err != nil {
-		http.Error(w, "Unauthorized - No session", http.StatusUnauthorized)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	sessionID := cookie.Value
-	var nickname string
-	err = S.db.QueryRow(`
-		SELECT nickname FROM sessions 
-		WHERE session_id = ? AND expires_at > datetime('now')`, sessionID).Scan(&nickname)
+	notifications, err := S.Store.UnreadCounts(nickname)
 	if err != nil {
-		http.Error(w, "Unauthorized - Invalid session", http.StatusUnauthorized)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	var notif Notification
-	err = json.NewDecoder(r.Body).Decode(&notif)
-	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// ConversationsHandler returns the caller's chat sidebar, see
+// loadConversations for the ordering.
+func (S *Server) ConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var oldUnread int
-	err = S.db.QueryRow(`
-		SELECT unread_messages FROM notifications 
-		WHERE receiver_nickname = ? AND sender_nickname = ?`, nickname, notif.Sender).Scan(&oldUnread)
-
-	var newUnread int
+	nickname, err := S.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	if err == sql.ErrNoRows {
-		newUnread = 1
-		if notif.Unread != nil {
-			newUnread = 1
-		} else {
-			newUnread = 0
-		}
-		_, err = S.db.Exec(`
-			INSERT INTO notifications (receiver_nickname, sender_nickname, unread_messages) 
-			VALUES (?, ?, ?)`, nickname, notif.Sender, newUnread)
-		if err != nil {
-			http.Error(w, "Failed to insert notification", http.StatusInternalServerError)
-			return
-		}
-	} else if err != nil {
+	conversations, err := S.loadConversations(nickname)
+	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
-	} else {
-		if notif.Unread == nil {
-			newUnread = oldUnread
-		} else if *notif.Unread == 1 {
-			newUnread = oldUnread + 1
-		} else {
-			newUnread = *notif.Unread
-		}
-
-		_, err = S.db.Exec(`
-			UPDATE notifications 
-			SET unread_messages = ? 
-			WHERE receiver_nickname = ? AND sender_nickname = ?`, newUnread, nickname, notif.Sender)
-		if err != nil {
-			http.Error(w, "Failed to update notification", http.StatusInternalServerError)
-			return
-		}
 	}
 
-	notif.Receiver = nickname
-	notif.Unread = &newUnread
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(notif)
+	json.NewEncoder(w).Encode(conversations)
 }
 
 func (S *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		renderErrorPage(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		S.renderErrorPage(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		renderErrorPage(w, "Bad Request", http.StatusBadRequest)
+		S.renderErrorPage(w, r, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
 	err, found := S.UserFound(user)
 	if err != nil {
-		renderErrorPage(w, "Internal Server Error", http.StatusInternalServerError)
+		S.renderErrorPage(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	if found {
-		renderErrorPage(w, "Status Conflict", http.StatusConflict)
+		S.renderErrorPage(w, r, "Status Conflict", http.StatusConflict)
 		return
 	}
 
 	Err := S.AddUser(user)
 	if Err != "" {
-		renderErrorPage(w, Err, http.StatusInternalServerError)
+		S.renderErrorPage(w, r, Err, http.StatusInternalServerError)
 		return
 	}
+
+	if err := S.mailToken(html.EscapeString(user.Nickname), TokenVerify); err != nil {
+		fmt.Println("Mail Error:", err)
+	}
 }
 
 func (S *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		renderErrorPage(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		S.renderErrorPage(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var user LoginUser
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		renderErrorPage(w, "Bad Request", http.StatusBadRequest)
+		S.renderErrorPage(w, r, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
+	ip, now := S.clientIP(r), S.now()
 	nickname, hashedPassword, err := S.GetHashedPasswordFromDB(user.Identifier)
+	account := nickname
+	if err != nil {
+		account = user.Identifier
+	}
+
+	wait, lockErr := S.loginLockout(account, ip, now)
+	if lockErr != nil {
+		fmt.Println("DB Login Error:", lockErr)
+		S.renderErrorPage(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		S.recordLogin(account, ip, LoginLocked, now)
+		S.refuseLogin(w, r, wait)
+		return
+	}
+
+	// Unknown users and wrong passwords get the same answer, so it does
+	// not tell which accounts exist
 	if err != nil {
-		fmt.Println("undif")
+		S.recordLogin(account, ip, LoginUnknownUser, now)
+		S.renderErrorPage(w, r, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := CheckPassword(hashedPassword, user.Password); err != nil {
-		renderErrorPage(w, "Inccorect password", http.StatusInternalServerError)
+		S.recordLogin(account, ip, LoginBadPassword, now)
+		S.renderErrorPage(w, r, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	if S.Config.RequireVerifiedEmail {
+		_, verified, err := S.Store.UserEmail(nickname)
+		if err != nil {
+			fmt.Println("DB Email Error:", err)
+			S.renderErrorPage(w, r, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !verified {
+			S.renderErrorPage(w, r, "Email address not verified", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Enrolled users get a session only after the second step, /login/2fa
+	totp, err := S.Store.TOTP(nickname)
+	if err != nil && err != ErrNoRecord {
+		fmt.Println("DB TOTP Error:", err)
+		S.renderErrorPage(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if totp.Enabled {
+		S.startTwoFactor(w, nickname, now)
 		return
 	}
 
-	S.MakeToken(w, nickname)
+	S.recordLogin(account, ip, "", now)
+	S.MakeToken(w, nickname, r.UserAgent())
 
 	w.Header().Set("Content-Type", "application/json")
 	//fmt.Fprintf(w, `{"username":"%s"}`, nickname)
@@ -167,8 +188,7 @@ func (S *Server) CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := cookie.Value
-	var nickname string
-	err = S.db.QueryRow("SELECT nickname FROM sessions WHERE session_id = ? AND expires_at > datetime('now')", sessionID).Scan(&nickname)
+	nickname, err := S.Store.SessionUser(sessionID)
 	if err != nil {
 		http.Error(w, "Unauthorized - Invalid session", http.StatusUnauthorized)
 		return
@@ -182,10 +202,11 @@ func (S *Server) CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = S.db.Exec(
-		"INSERT INTO posts (user_id, title, content, category) VALUES ((SELECT id FROM users WHERE nickname = ?), ?, ?, ?)",
-		html.EscapeString(nickname), html.EscapeString(post.Title), html.EscapeString(post.Content), html.EscapeString(post.Category),
-	)
+	err = S.Store.CreatePost(html.EscapeString(nickname), Post{
+		Title:    html.EscapeString(post.Title),
+		Content:  html.EscapeString(post.Content),
+		Category: html.EscapeString(post.Category),
+	})
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -200,28 +221,11 @@ func (S *Server) GetPostsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := S.db.Query(`
-        SELECT posts.id, posts.title, posts.content, posts.category, posts.created_at, users.nickname
-        FROM posts
-        JOIN users ON posts.user_id = users.id
-        ORDER BY posts.created_at DESC
-    `)
+	posts, err := S.Store.ListPosts()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var posts []Post
-	for rows.Next() {
-		var p Post
-		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Category, &p.CreatedAt, &p.Author)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-		posts = append(posts, p)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(posts)
@@ -234,18 +238,17 @@ func (S *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = S.db.Exec("DELETE FROM sessions WHERE session_id = ?", cookie.Value)
+	nickname, userErr := S.Store.SessionUser(cookie.Value)
+	err = S.Store.DeleteSession(cookie.Value)
 	if err != nil {
 		http.Error(w, "Error deleting session", http.StatusInternalServerError)
 		return
 	}
+	if userErr == nil {
+		S.disconnectSessions(nickname, cookie.Value)
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_token",
-		Value:   "",
-		Expires: time.Unix(0, 0),
-		Path:    "/",
-	})
+	http.SetCookie(w, S.sessionCookie("", time.Unix(0, 0)))
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -276,8 +279,7 @@ func (S *Server) CreateCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	sessionID := cookie.Value
-	var nickname string
-	err = S.db.QueryRow("SELECT nickname FROM sessions WHERE session_id = ? AND expires_at > datetime('now')", sessionID).Scan(&nickname)
+	nickname, err := S.Store.SessionUser(sessionID)
 	if err != nil {
 		http.Error(w, "Unauthorized - Invalid session", http.StatusUnauthorized)
 		return
@@ -288,10 +290,10 @@ func (S *Server) CreateCommentHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
-	_, err = S.db.Exec(
-		"INSERT INTO comments (post_id, user_id, content) VALUES (?, (SELECT id FROM users WHERE nickname = ?), ?)",
-		(comment.PostID), html.EscapeString(nickname), html.EscapeString(comment.Content),
-	)
+	err = S.Store.CreateComment(html.EscapeString(nickname), Comment{
+		PostID:  comment.PostID,
+		Content: html.EscapeString(comment.Content),
+	})
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -304,33 +306,20 @@ func (S *Server) GetCommentsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	postID := r.URL.Query().Get("post_id")
-	if postID == "" {
+	postIDStr := r.URL.Query().Get("post_id")
+	if postIDStr == "" {
 		http.Error(w, "Missing post_id parameter", http.StatusBadRequest)
 		return
 	}
-	rows, err := S.db.Query(`
-        SELECT comments.id, comments.content, comments.created_at, users.nickname
-        FROM comments
-        JOIN users ON comments.user_id = users.id
-        WHERE comments.post_id = ?
-        ORDER BY comments.created_at ASC
-    `, postID)
+	postID, err := strconv.Atoi(postIDStr)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, "Invalid post_id parameter", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-
-	var comments []Comment
-	for rows.Next() {
-		var c Comment
-		err := rows.Scan(&c.ID, &c.Content, &c.CreatedAt, &c.Author)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-		comments = append(comments, c)
+	comments, err := S.Store.ListComments(postID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(comments)
@@ -352,64 +341,138 @@ func (S *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &Client{
-		ID:       uuid.NewV4().String(), // Generate unique ID
-		Conn:     conn,
-		Username: username,
-	}
+	cookie, _ := r.Cookie("session_token")
+	client := S.hub.NewClient(conn, username, sessionHandle(cookie.Value))
 
 	// Add client to the user's session list
-	if S.clients[username] == nil {
-		S.clients[username] = []*Client{}
+	if !S.hub.Register(client) {
+		client.Close(websocket.CloseGoingAway, ShutdownReason)
+		return
 	}
-	S.clients[username] = append(S.clients[username], client)
 
 	fmt.Println(username, "connected to WebSocket")
 
-	S.broadcastUserList("")
+	S.broadcastUserList()
 
-	go S.receiveMessages(client)
+	go S.receiveMessages(client, cookie.Value)
 }
 
+// GetMessagesHandler pages through one of the caller's conversations by
+// message id. The other participant is given as with=<nickname>, the older
+// from/to form is still accepted as long as one side is the caller, and a
+// group the caller is in as group=<id>. Without a cursor it returns the
+// latest page, before=<id> walks back in time and after=<id> forward.
+// next_cursor is the value to pass in the same direction to get the
+// following page.
 func (s *Server) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
-	from := r.URL.Query().Get("from")
-	to := r.URL.Query().Get("to")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, err := s.CheckSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	var groupID int64
+	if groupStr := query.Get("group"); groupStr != "" {
+		groupID, err = strconv.ParseInt(groupStr, 10, 64)
+		if err != nil || groupID <= 0 {
+			http.Error(w, "Invalid group", http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.memberGroup(w, groupID, from); !ok {
+			return
+		}
+	}
 
-	if from == "" || to == "" {
+	to := query.Get("with")
+	if to == "" && groupID == 0 {
+		queryFrom, queryTo := query.Get("from"), query.Get("to")
+		switch from {
+		case queryFrom:
+			to = queryTo
+		case queryTo:
+			to = queryFrom
+		default:
+			if queryFrom != "" || queryTo != "" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	if (to == "") == (groupID == 0) {
 		http.Error(w, "Missing parameters", http.StatusBadRequest)
 		return
 	}
 
-	offsetStr := r.URL.Query().Get("offset")
-	offset, err := strconv.Atoi(offsetStr)
-	if err != nil {
-		offset = 0
+	limit := s.Config.PageSize
+	if limitStr := query.Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, s.Config.MaxPageSize)
 	}
 
-	rows, err := s.db.Query(`
-	SELECT sender, receiver, content, timestamp
-	FROM messages
-	WHERE (sender = ? AND receiver = ?) OR (sender = ? AND receiver = ?)
-	ORDER BY timestamp DESC
-	LIMIT 10 OFFSET ?
-`, from, to, to, from, offset)
+	before, err := parseCursor(query.Get("before"))
+	if err != nil {
+		http.Error(w, "Invalid before cursor", http.StatusBadRequest)
+		return
+	}
+	after, err := parseCursor(query.Get("after"))
+	if err != nil {
+		http.Error(w, "Invalid after cursor", http.StatusBadRequest)
+		return
+	}
+	if before != 0 && after != 0 {
+		http.Error(w, "Use either before or after", http.StatusBadRequest)
+		return
+	}
 
+	// One extra row tells whether another page exists
+	messages, err := s.Store.ListMessages(MessageQuery{
+		User:    from,
+		Other:   to,
+		GroupID: groupID,
+		Before:  before,
+		After:   after,
+		Limit:   limit + 1,
+	})
 	if err != nil {
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var messages []Message
-	for rows.Next() {
-		var msg Message
-		err := rows.Scan(&msg.From, &msg.To, &msg.Content, &msg.Timestamp)
-		if err != nil {
-			http.Error(w, "Scan error", http.StatusInternalServerError)
-			return
-		}
-		messages = append([]Message{msg}, messages...)
+	page := MessagePage{HasMore: len(messages) > limit}
+	if page.HasMore {
+		messages = messages[:limit]
 	}
+	if len(messages) > 0 {
+		page.NextCursor = messages[len(messages)-1].ID
+	}
+	// Pages are always returned oldest first
+	if after == 0 {
+		slices.Reverse(messages)
+	}
+	page.Messages = messages
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseCursor(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	cursor, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || cursor <= 0 {
+		return 0, fmt.Errorf("invalid cursor %q", value)
+	}
+	return cursor, nil
 }
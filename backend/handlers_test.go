@@ -0,0 +1,298 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"real-time-forum/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of every user of newTestServer.
+const testPassword = "password"
+
+// newTestServer is a server on a MemoryStore with the given users, each
+// logged in with their nickname as session token. It is not running, tests
+// call the handlers directly.
+func newTestServer(t *testing.T, nicknames ...string) *Server {
+	t.Helper()
+	S := &Server{Config: config.Default(), Store: NewMemoryStore()}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nickname := range nicknames {
+		err := S.Store.CreateUser(User{Nickname: nickname, Email: nickname + "@example.com", Password: string(hashedPassword)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := S.Store.CreateSession(nickname, nickname, "test", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return S
+}
+
+// runServer starts S on a free local port with the assets of the repository.
+// It returns the address once the server listens, and a function that shuts
+// it down and returns what Run did.
+func runServer(t *testing.T, S *Server) (string, func() error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	S.Config.Port = port
+	S.Config.AssetsDir = ".."
+	S.Config.Mail.LogPath = filepath.Join(t.TempDir(), "mail.log")
+	S.Config.ShutdownTimeout = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- S.Run(ctx)
+	}()
+
+	addr := "127.0.0.1:" + port
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatal("server did not start:", err)
+		}
+	}
+	return addr, func() error {
+		cancel()
+		return <-done
+	}
+}
+
+// post handles a request with v as JSON body from ip.
+func post(handler http.HandlerFunc, target string, v interface{}, ip string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// postAs handles a request with v as JSON body as the user with the given
+// session token.
+func postAs(handler http.HandlerFunc, target, session string, v interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// decode reads the JSON body of a response into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+}
+
+// serve handles a request as the user with the given session token, none
+// when it is empty.
+func serve(handler http.HandlerFunc, method, target, session string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func sendMessage(t *testing.T, S *Server, msg Message) {
+	t.Helper()
+	msg.Timestamp = time.Now().Format(time.RFC3339)
+	if _, _, err := S.Store.CreateMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetMessagesAccess(t *testing.T) {
+	S := newTestServer(t, "alice", "bob", "carol")
+	sendMessage(t, S, Message{From: "alice", To: "bob", Content: "hi bob"})
+	sendMessage(t, S, Message{From: "bob", To: "alice", Content: "hi alice"})
+	group, err := S.Store.CreateGroup("secret", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(t, S, Message{From: "alice", GroupID: group, Content: "just me"})
+	groupQuery := "/messages?group=" + strconv.FormatInt(group, 10)
+
+	for _, test := range []struct {
+		name     string
+		session  string
+		target   string
+		code     int
+		messages int
+	}{
+		{"no session", "", "/messages?with=bob", http.StatusUnauthorized, 0},
+		{"unknown session", "mallory", "/messages?with=bob", http.StatusUnauthorized, 0},
+		{"no session for a group", "", groupQuery, http.StatusUnauthorized, 0},
+
+		{"participant with", "alice", "/messages?with=bob", http.StatusOK, 2},
+		{"other participant with", "bob", "/messages?with=alice", http.StatusOK, 2},
+		{"participant from", "alice", "/messages?from=alice&to=bob", http.StatusOK, 2},
+		{"participant to", "bob", "/messages?from=alice&to=bob", http.StatusOK, 2},
+		{"group member", "alice", groupQuery, http.StatusOK, 1},
+
+		// with= always means a conversation of the caller's own
+		{"third party with", "carol", "/messages?with=bob", http.StatusOK, 0},
+		{"third party with the other", "carol", "/messages?with=alice", http.StatusOK, 0},
+		{"third party from and to", "carol", "/messages?from=alice&to=bob", http.StatusForbidden, 0},
+		{"third party from only", "carol", "/messages?from=alice", http.StatusForbidden, 0},
+		{"third party to only", "carol", "/messages?to=bob", http.StatusForbidden, 0},
+		// Groups the caller is not in look like groups that do not exist
+		{"third party group", "carol", groupQuery, http.StatusNotFound, 0},
+		{"participant in someone else's group", "bob", groupQuery, http.StatusNotFound, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(S.GetMessagesHandler, http.MethodGet, test.target, test.session)
+			if w.Code != test.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.code, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var page MessagePage
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Messages) != test.messages {
+				t.Fatalf("%d messages, want %d: %+v", len(page.Messages), test.messages, page.Messages)
+			}
+			for _, msg := range page.Messages {
+				if msg.From != test.session && msg.To != test.session && msg.GroupID == 0 {
+					t.Errorf("%s got a message from %s to %s", test.session, msg.From, msg.To)
+				}
+			}
+		})
+	}
+}
+
+func TestSlideSessions(t *testing.T) {
+	S := newTestServer(t, "alice")
+	S.Mux = http.NewServeMux()
+	S.initRoutes()
+	handler := S.slideSessions(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for _, test := range []struct {
+		name   string
+		target string
+		slides bool
+	}{
+		{"api request", "/logged", true},
+		{"websocket upgrade", "/ws", true},
+		{"static file", "/style.css", false},
+		{"index", "/", false},
+		{"unknown path", "/missing", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lastSeen := time.Now().Add(-time.Hour).UTC()
+			if err := S.Store.TouchSession("alice", lastSeen, time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			w := serve(handler.ServeHTTP, http.MethodGet, test.target, "alice")
+			session, err := S.Store.Session("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if slid := !session.LastSeen.Equal(lastSeen); slid != test.slides {
+				t.Errorf("slid %v, want %v", slid, test.slides)
+			}
+			if reissued := len(w.Result().Cookies()) > 0; reissued != test.slides {
+				t.Errorf("reissued the cookie %v, want %v", reissued, test.slides)
+			}
+		})
+	}
+
+	// Within the resolution the session stays put, but the cookie follows
+	// an expiry the websocket may have moved
+	serve(handler.ServeHTTP, http.MethodGet, "/logged", "alice")
+	session, err := S.Store.Session("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(handler.ServeHTTP, http.MethodGet, "/logged", "alice")
+	again, err := S.Store.Session("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.LastSeen.Equal(session.LastSeen) {
+		t.Error("slid again within LastSeenResolution")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Expires.Equal(session.ExpiresAt.Truncate(time.Second)) {
+		t.Errorf("got cookies %v, want one expiring at %v", cookies, session.ExpiresAt)
+	}
+}
+
+// closeCounter counts the calls to Close of the Store and Broker it wraps.
+type closeCounter struct {
+	Store
+	Broker
+	closed atomic.Int32
+}
+
+func (C *closeCounter) Close() error {
+	C.closed.Add(1)
+	return nil
+}
+
+func TestRunTearsDownWhenListenFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	store := &closeCounter{Store: NewMemoryStore()}
+	broker := &closeCounter{Broker: NewMemoryBroker()}
+	S := &Server{Config: config.Default(), Store: store, Broker: broker}
+	S.Config.Port = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	S.Config.AssetsDir = ".."
+	S.Config.Mail.LogPath = filepath.Join(t.TempDir(), "mail.log")
+	S.Config.ShutdownTimeout = time.Second
+
+	if err := S.Run(context.Background()); err == nil {
+		t.Fatal("ran on a port already in use")
+	}
+	if store.closed.Load() != 1 || broker.closed.Load() != 1 {
+		t.Errorf("store closed %d times, broker %d times, want once each", store.closed.Load(), broker.closed.Load())
+	}
+	stopped := make(chan struct{})
+	go func() {
+		S.loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("the presence loop or the sweeper still runs")
+	}
+}
@@ -0,0 +1,416 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything that used to be hard-coded in the server. Every
+// setting has a flag name, e.g. -session-lifetime, and the same setting can
+// come from the environment as FORUM_SESSION_LIFETIME or from a config file
+// line "session-lifetime = 12h". Flags win over the environment, which wins
+// over the file.
+type Config struct {
+	Port string
+
+	// DBDriver is sqlite3 or postgres, DBDSN is a file path for SQLite and
+	// a connection string for PostgreSQL.
+	DBDriver string
+	DBDSN    string
+
+	// A session expires after SessionLifetime without activity, and after
+	// SessionMaxLifetime however active it is. Expired sessions are deleted
+	// every SessionSweepInterval.
+	SessionLifetime      time.Duration
+	SessionMaxLifetime   time.Duration
+	SessionSweepInterval time.Duration
+
+	// Message history page sizes, clients may ask for fewer or more
+	// messages per page but never more than MaxPageSize.
+	PageSize    int
+	MaxPageSize int
+
+	// AssetsDir serves static/ and templates/ from disk instead of the
+	// copies embedded in the binary, so edits show up without a rebuild.
+	AssetsDir string
+
+	// Broker is memory for a single instance or redis to fan chat traffic
+	// out across instances sharing RedisURL.
+	Broker   string
+	RedisURL string
+
+	// ShutdownTimeout bounds how long in-flight requests and websocket
+	// frames get to finish when the server stops.
+	ShutdownTimeout time.Duration
+
+	// TrustProxy takes the client address from the X-Forwarded-For header
+	// set by a reverse proxy in front of the server.
+	TrustProxy bool
+
+	// Admins are the nicknames allowed to reset other users' two-factor
+	// authentication.
+	Admins List
+	// TOTPIssuer names the forum in authenticator apps.
+	TOTPIssuer string
+
+	// PublicURL is where users reach the forum, links in emails point
+	// there. It defaults to http://localhost with the port.
+	PublicURL string
+	// RequireVerifiedEmail refuses logins until the user followed the link
+	// in their verification email.
+	RequireVerifiedEmail bool
+
+	Cookie CookieConfig
+	Login  LoginConfig
+	Mail   MailConfig
+	WS     WSConfig
+}
+
+// List is a comma separated flag value, setting it replaces the whole list.
+type List []string
+
+func (l *List) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// CookieConfig is applied to the session cookie.
+type CookieConfig struct {
+	Path   string
+	Domain string
+	Secure bool
+	// SameSite is lax, strict or none.
+	SameSite string
+}
+
+// LoginConfig throttles password guessing. Past AccountAttempts failures for
+// one account, or IPAttempts from one address, within Window, logins are
+// refused for Lockout, doubling with every further failure up to MaxLockout.
+type LoginConfig struct {
+	AccountAttempts int
+	IPAttempts      int
+	Window          time.Duration
+	Lockout         time.Duration
+	MaxLockout      time.Duration
+}
+
+// MailConfig picks how emails go out. The log mailer appends them to
+// LogPath instead of sending them, the smtp one relays them through
+// SMTPAddr, logging in when SMTPUsername is set.
+type MailConfig struct {
+	Mailer       string
+	LogPath      string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	From         string
+}
+
+// WSConfig mirrors backend.WSConfig field for field so it converts directly.
+type WSConfig struct {
+	SendQueueSize int
+	WriteWait     time.Duration
+	PongWait      time.Duration
+	PingPeriod    time.Duration
+	TypingTimeout time.Duration
+}
+
+const DefaultSQLiteDSN = "database/forum.db"
+
+// Default returns the settings the forum ran with before it was configurable.
+func Default() *Config {
+	return &Config{
+		Port:                 "8080",
+		DBDriver:             "sqlite3",
+		DBDSN:                DefaultSQLiteDSN,
+		SessionLifetime:      24 * time.Hour,
+		SessionMaxLifetime:   30 * 24 * time.Hour,
+		SessionSweepInterval: 10 * time.Minute,
+		PageSize:             10,
+		MaxPageSize:          50,
+		Broker:               "memory",
+		RedisURL:             "redis://localhost:6379/0",
+		ShutdownTimeout:      10 * time.Second,
+		TOTPIssuer:           "Forum",
+		PublicURL:            "http://localhost:8080",
+		Cookie: CookieConfig{
+			Path:     "/",
+			SameSite: "lax",
+		},
+		Mail: MailConfig{
+			Mailer:   "log",
+			LogPath:  "mail.log",
+			SMTPAddr: "localhost:25",
+			From:     "forum@localhost",
+		},
+		Login: LoginConfig{
+			AccountAttempts: 5,
+			IPAttempts:      20,
+			Window:          15 * time.Minute,
+			Lockout:         30 * time.Second,
+			MaxLockout:      15 * time.Minute,
+		},
+		WS: WSConfig{
+			SendQueueSize: 64,
+			WriteWait:     10 * time.Second,
+			PongWait:      60 * time.Second,
+			PingPeriod:    54 * time.Second,
+			TypingTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// Load registers the config flags on fs, which may already hold other flags,
+// and parses args. The result is validated.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+	// These follow other settings unless they are given explicitly
+	cfg.DBDSN, cfg.WS.PingPeriod, cfg.PublicURL = "", 0, ""
+
+	file := fs.String("config", os.Getenv("FORUM_CONFIG"), "optional config file with one name = value per line")
+	names := cfg.register(fs)
+
+	// Parse once to learn where the file is, and again after the file and
+	// the environment were applied so that flags take precedence.
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *file != "" {
+		if err := loadFile(fs, names, *file); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		value, ok := os.LookupEnv(EnvName(name))
+		if !ok {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvName(name), err)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.DBDSN == "" && cfg.DBDriver == "sqlite3" {
+		cfg.DBDSN = DefaultSQLiteDSN
+	}
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = "http://localhost:" + cfg.Port
+	}
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	if cfg.WS.PingPeriod == 0 {
+		cfg.WS.PingPeriod = cfg.WS.PongWait * 9 / 10
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// EnvName is the environment variable for a flag name.
+func EnvName(name string) string {
+	return "FORUM_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// register binds a flag to every field and returns the flag names.
+func (c *Config) register(fs *flag.FlagSet) []string {
+	existing := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { existing[f.Name] = true })
+
+	fs.StringVar(&c.Port, "port", c.Port, "HTTP port")
+	fs.StringVar(&c.DBDriver, "db-driver", c.DBDriver, "database driver, sqlite3 or postgres")
+	fs.StringVar(&c.DBDSN, "db-dsn", c.DBDSN, "database file (sqlite3, default "+DefaultSQLiteDSN+") or connection string (postgres)")
+	fs.DurationVar(&c.SessionLifetime, "session-lifetime", c.SessionLifetime, "how long a login lasts without activity")
+	fs.DurationVar(&c.SessionMaxLifetime, "session-max-lifetime", c.SessionMaxLifetime, "how long a login lasts at most, however active")
+	fs.DurationVar(&c.SessionSweepInterval, "session-sweep-interval", c.SessionSweepInterval, "how often expired sessions are deleted")
+	fs.IntVar(&c.PageSize, "page-size", c.PageSize, "messages per history page when the client does not ask")
+	fs.IntVar(&c.MaxPageSize, "max-page-size", c.MaxPageSize, "largest history page a client may ask for")
+	fs.StringVar(&c.AssetsDir, "assets-dir", c.AssetsDir, "directory holding static/ and templates/ to use instead of the embedded ones, for development")
+	fs.StringVar(&c.Broker, "broker", c.Broker, "chat fan-out between instances, memory (single instance) or redis")
+	fs.StringVar(&c.RedisURL, "redis-url", c.RedisURL, "redis server used by the redis broker")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight work when stopping")
+	fs.BoolVar(&c.TrustProxy, "trust-proxy", c.TrustProxy, "take client addresses from X-Forwarded-For, only behind a reverse proxy that sets it")
+	fs.Var(&c.Admins, "admins", "comma separated nicknames of the administrators")
+	fs.StringVar(&c.TOTPIssuer, "totp-issuer", c.TOTPIssuer, "name of the forum shown in authenticator apps")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "address users reach the forum at, for links in emails (default http://localhost:<port>)")
+	fs.BoolVar(&c.RequireVerifiedEmail, "require-verified-email", c.RequireVerifiedEmail, "refuse logins until the email address is verified")
+	fs.StringVar(&c.Mail.Mailer, "mailer", c.Mail.Mailer, "how emails go out, log (append to mail-log) or smtp")
+	fs.StringVar(&c.Mail.LogPath, "mail-log", c.Mail.LogPath, "file the log mailer appends emails to")
+	fs.StringVar(&c.Mail.SMTPAddr, "smtp-addr", c.Mail.SMTPAddr, "SMTP server as host:port")
+	fs.StringVar(&c.Mail.SMTPUsername, "smtp-username", c.Mail.SMTPUsername, "SMTP login, empty to send without one")
+	fs.StringVar(&c.Mail.SMTPPassword, "smtp-password", c.Mail.SMTPPassword, "SMTP password")
+	fs.StringVar(&c.Mail.From, "mail-from", c.Mail.From, "sender address of emails")
+	fs.StringVar(&c.Cookie.Path, "cookie-path", c.Cookie.Path, "session cookie path")
+	fs.StringVar(&c.Cookie.Domain, "cookie-domain", c.Cookie.Domain, "session cookie domain, empty for the request host")
+	fs.BoolVar(&c.Cookie.Secure, "cookie-secure", c.Cookie.Secure, "only send the session cookie over HTTPS")
+	fs.StringVar(&c.Cookie.SameSite, "cookie-samesite", c.Cookie.SameSite, "session cookie SameSite mode, lax, strict or none")
+	fs.IntVar(&c.Login.AccountAttempts, "login-account-attempts", c.Login.AccountAttempts, "failed logins to one account within login-window before it is locked")
+	fs.IntVar(&c.Login.IPAttempts, "login-ip-attempts", c.Login.IPAttempts, "failed logins from one address within login-window before it is locked")
+	fs.DurationVar(&c.Login.Window, "login-window", c.Login.Window, "how long a failed login counts against an account or address")
+	fs.DurationVar(&c.Login.Lockout, "login-lockout", c.Login.Lockout, "first lockout, each further failure doubles it")
+	fs.DurationVar(&c.Login.MaxLockout, "login-max-lockout", c.Login.MaxLockout, "longest lockout")
+	fs.IntVar(&c.WS.SendQueueSize, "ws-send-queue", c.WS.SendQueueSize, "frames a websocket client may have pending before it is dropped")
+	fs.DurationVar(&c.WS.WriteWait, "ws-write-wait", c.WS.WriteWait, "time allowed to write one websocket frame")
+	fs.DurationVar(&c.WS.PongWait, "ws-pong-wait", c.WS.PongWait, "time a websocket may stay silent before it is closed")
+	fs.DurationVar(&c.WS.PingPeriod, "ws-ping-period", c.WS.PingPeriod, "how often websockets are pinged, shorter than ws-pong-wait (default 9/10 of it)")
+	fs.DurationVar(&c.WS.TypingTimeout, "typing-timeout", c.WS.TypingTimeout, "how long a typing indicator lasts without a refresh")
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if !existing[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+// loadFile applies a file of "name = value" lines, blank lines and lines
+// starting with # are skipped.
+func loadFile(fs *flag.FlagSet, names []string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !known[name] {
+			return fmt.Errorf("%s:%d: expected a setting as name = value, got %q", path, line, text)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, line, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port <= 65535, "port %q is not a valid TCP port", c.Port)
+
+	check(c.DBDriver == "sqlite3" || c.DBDriver == "postgres", "db-driver %q is not sqlite3 or postgres", c.DBDriver)
+	check(c.DBDSN != "", "db-dsn is required for %s", c.DBDriver)
+
+	check(c.SessionLifetime > 0, "session-lifetime must be positive")
+	check(c.SessionMaxLifetime >= c.SessionLifetime, "session-max-lifetime must be at least session-lifetime")
+	check(c.SessionSweepInterval > 0, "session-sweep-interval must be positive")
+
+	check(c.PageSize > 0, "page-size must be positive")
+	check(c.MaxPageSize >= c.PageSize, "max-page-size must be at least page-size")
+
+	if c.AssetsDir != "" {
+		info, err := os.Stat(filepath.Join(c.AssetsDir, "static"))
+		check(err == nil && info.IsDir(), "assets-dir %q has no static directory", c.AssetsDir)
+	}
+
+	check(c.Broker == "memory" || c.Broker == "redis", "broker %q is not memory or redis", c.Broker)
+
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive")
+
+	check(c.TOTPIssuer != "" && !strings.Contains(c.TOTPIssuer, ":"), "totp-issuer must be set and must not contain a colon")
+
+	publicURL, err := url.Parse(c.PublicURL)
+	check(err == nil && (publicURL.Scheme == "http" || publicURL.Scheme == "https") && publicURL.Host != "", "public-url %q is not an http or https URL", c.PublicURL)
+
+	check(c.Mail.Mailer == "log" || c.Mail.Mailer == "smtp", "mailer %q is not log or smtp", c.Mail.Mailer)
+	check(c.Mail.Mailer != "log" || c.Mail.LogPath != "", "mail-log is required for the log mailer")
+	check(c.Mail.Mailer != "smtp" || c.Mail.SMTPAddr != "", "smtp-addr is required for the smtp mailer")
+	_, err = mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail-from %q is not an email address", c.Mail.From)
+
+	_, err = parseSameSite(c.Cookie.SameSite)
+	check(err == nil, "cookie-samesite %q is not lax, strict or none", c.Cookie.SameSite)
+	// Browsers drop SameSite=None cookies that are not Secure
+	check(!strings.EqualFold(c.Cookie.SameSite, "none") || c.Cookie.Secure, "cookie-samesite none requires cookie-secure")
+
+	check(c.Login.AccountAttempts > 0, "login-account-attempts must be positive")
+	check(c.Login.IPAttempts > 0, "login-ip-attempts must be positive")
+	check(c.Login.Lockout > 0, "login-lockout must be positive")
+	check(c.Login.MaxLockout >= c.Login.Lockout, "login-max-lockout must be at least login-lockout")
+	check(c.Login.Window >= c.Login.MaxLockout, "login-window must be at least login-max-lockout")
+
+	check(c.WS.SendQueueSize > 0, "ws-send-queue must be positive")
+	check(c.WS.WriteWait > 0, "ws-write-wait must be positive")
+	check(c.WS.PongWait > 0, "ws-pong-wait must be positive")
+	check(c.WS.PingPeriod > 0 && c.WS.PingPeriod < c.WS.PongWait, "ws-ping-period must be positive and shorter than ws-pong-wait")
+	check(c.WS.TypingTimeout > 0, "typing-timeout must be positive")
+
+	return errors.Join(errs...)
+}
+
+// SameSiteMode returns the cookie mode, Validate makes sure it parses.
+func (c CookieConfig) SameSiteMode() http.SameSite {
+	mode, _ := parseSameSite(c.SameSite)
+	return mode
+}
+
+// LockoutAfter is how long logins are refused after failures when allowed
+// of them are free, zero while failures is below allowed.
+func (c LoginConfig) LockoutAfter(failures, allowed int) time.Duration {
+	if failures < allowed {
+		return 0
+	}
+	lockout := c.Lockout
+	for i := allowed; i < failures && lockout < c.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, c.MaxLockout)
+}
+
+func parseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown SameSite mode %q", s)
+}
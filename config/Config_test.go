@@ -0,0 +1,146 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load runs Load on a fresh flag set with a config file holding lines, none
+// when lines is empty.
+func load(t *testing.T, lines []string, args ...string) (*Config, error) {
+	t.Helper()
+	if len(lines) > 0 {
+		path := filepath.Join(t.TempDir(), "forum.conf")
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	fs := flag.NewFlagSet("forum", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	return Load(fs, args)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file []string
+		env  string
+		args []string
+		port string
+	}{
+		{"default", nil, "", nil, "8080"},
+		{"file", []string{"# comment", "", "port = 8081"}, "", nil, "8081"},
+		{"env over file", []string{"port = 8081"}, "8082", nil, "8082"},
+		{"flag over env and file", []string{"port = 8081"}, "8082", []string{"-port", "8083"}, "8083"},
+		{"flag over env", nil, "8082", []string{"-port=8083"}, "8083"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv("FORUM_PORT", test.env)
+			}
+			cfg, err := load(t, test.file, test.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != test.port {
+				t.Errorf("port %s, want %s", cfg.Port, test.port)
+			}
+			// Settings left alone follow the ones given
+			if want := "http://localhost:" + test.port; cfg.PublicURL != want {
+				t.Errorf("public url %s, want %s", cfg.PublicURL, want)
+			}
+		})
+	}
+
+	// Every setting, nested ones too, has its variable
+	t.Setenv(EnvName("ws-pong-wait"), "30s")
+	t.Setenv(EnvName("login-account-attempts"), "9")
+	t.Setenv(EnvName("admins"), "alice, bob")
+	cfg, err := load(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WS.PongWait != 30*time.Second || cfg.WS.PingPeriod != 27*time.Second {
+		t.Errorf("pong wait %v and ping period %v", cfg.WS.PongWait, cfg.WS.PingPeriod)
+	}
+	if cfg.Login.AccountAttempts != 9 || cfg.Admins.String() != "alice,bob" {
+		t.Errorf("login account attempts %d, admins %v", cfg.Login.AccountAttempts, cfg.Admins)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file []string
+		env  map[string]string
+		want string
+	}{
+		{"unknown setting", []string{"port = 8081", "colour = blue"}, nil, "forum.conf:2:"},
+		{"bad value in the file", []string{"page-size = ten"}, nil, "forum.conf:1: page-size"},
+		{"bad value in the environment", nil, map[string]string{"FORUM_PAGE_SIZE": "ten"}, "FORUM_PAGE_SIZE"},
+		{"invalid setting", nil, map[string]string{"FORUM_BROKER": "kafka"}, `broker "kafka"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			_, err := load(t, test.file)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error about %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal("defaults:", err)
+	}
+
+	cfg := Default()
+	cfg.Port = "http"
+	cfg.ShutdownTimeout = 0
+	cfg.DBDriver = "mysql"
+	err := cfg.Validate()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("got %v, want the errors joined", err)
+	}
+	errs := joined.Unwrap()
+	want := []string{`port "http"`, `db-driver "mysql"`, "shutdown-timeout"}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), err)
+	}
+	for i, want := range want {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("error %d is %q, want one about %s", i, errs[i], want)
+		}
+	}
+	if !errors.Is(err, errs[0]) {
+		t.Error("the joined error does not wrap the first one")
+	}
+}
+
+func TestLockoutAfter(t *testing.T) {
+	c := LoginConfig{Lockout: 30 * time.Second, MaxLockout: 2 * time.Minute}
+	for _, test := range []struct {
+		failures int
+		lockout  time.Duration
+	}{
+		{2, 0},
+		{3, 30 * time.Second},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{50, 2 * time.Minute},
+	} {
+		if got := c.LockoutAfter(test.failures, 3); got != test.lockout {
+			t.Errorf("after %d failures: %v, want %v", test.failures, got, test.lockout)
+		}
+	}
+}
@@ -3,8 +3,18 @@ module real-time-forum
 go 1.24.1
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	github.com/twinj/uuid v1.0.0 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
+	github.com/alicebob/miniredis/v2 v2.33.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.12.3
+	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/redis/go-redis/v9 v9.7.3
+	github.com/twinj/uuid v1.0.0
+	golang.org/x/crypto v0.38.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
@@ -1,12 +1,38 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"real-time-forum/backend"
+	"real-time-forum/config"
 )
 
 func main() {
-	var Server backend.Server
-	backend.MakeDataBase()
-	Server.Run("8080")
-	Server.Shutdown()
+	migrate := flag.String("migrate", "", "run schema migrations (up, down or a version number) and exit")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *migrate != "" {
+		if err := backend.RunMigrations(cfg.DBDriver, cfg.DBDSN, *migrate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Ctrl-C or SIGTERM starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	Server := backend.Server{Config: cfg, Assets: assets}
+	backend.MakeDataBase(cfg.DBDriver, cfg.DBDSN)
+	if err := Server.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
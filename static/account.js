@@ -0,0 +1,50 @@
+import { request } from './api.js'
+
+// Password reset and email verification, see backend/Email.go. The links in
+// the mails open the forum with ?reset=<token> or ?verify=<token>.
+export async function forgotPassword() {
+  const identifier = prompt('Enter your email or nickname, we will mail you a link to reset your password')
+  if (!identifier) return
+  try {
+    await request('POST', '/password/forgot', { identifier })
+    alert('If the account exists, a reset link is on its way.')
+  } catch (err) {
+    alert(err.message)
+  }
+}
+
+export async function resendVerification(identifier) {
+  try {
+    await request('POST', '/email/resend', { identifier })
+    alert('If the address still needs confirming, a new link is on its way.')
+  } catch (err) {
+    alert(err.message)
+  }
+}
+
+export async function handleEmailLink() {
+  const params = new URLSearchParams(window.location.search)
+  const reset = params.get('reset')
+  const verify = params.get('verify')
+  if (!reset && !verify) return
+  // Tokens work once, keep them out of the history
+  history.replaceState(null, '', window.location.pathname)
+
+  try {
+    if (verify) {
+      await request('POST', '/email/verify', { token: verify })
+      alert('Your email address is confirmed.')
+      return
+    }
+    const password = prompt('Choose a new password, at least 8 characters')
+    if (password === null) return
+    if (password.length < 8) {
+      alert('The password must be at least 8 characters, ask for a new link to try again.')
+      return
+    }
+    await request('POST', '/password/reset', { token: reset, password })
+    alert('Your password is changed, you can log in with it now.')
+  } catch (err) {
+    alert(err.message)
+  }
+}
@@ -0,0 +1,13 @@
+// JSON requests to the API. The promise rejects with the server's error
+// text when the request fails.
+export async function request(method, path, body) {
+  const res = await fetch(path, {
+    method,
+    headers: { 'Content-Type': 'application/json' },
+    body: body && JSON.stringify(body),
+    credentials: 'include'
+  })
+  const text = await res.text()
+  if (!res.ok) throw new Error(text.trim() || res.statusText)
+  return text ? JSON.parse(text) : null
+}
@@ -3,6 +3,8 @@ import { startChatFeature } from './chat.js';
 import { handleLogin } from './login.js';
 import { loadPosts } from './posts.js';
 import { logout } from './logout.js';
+import { manageTwoFactor } from './twofactor.js';
+import { forgotPassword, handleEmailLink } from './account.js';
 
 
 window.addEventListener('storage', function (event) {
@@ -32,6 +34,14 @@ document.getElementById('logoutBtn').addEventListener('click', (e) => {
   document.getElementById('usernameDisplay').textContent = logged(false);
 });
 
+document.getElementById('twoFactorBtn').addEventListener('click', () => {
+  manageTwoFactor();
+});
+
+document.getElementById('forgotPasswordBtn').addEventListener('click', () => {
+  forgotPassword();
+});
+
 document.getElementById('registerForm').addEventListener('submit', async function (e) {
   handleRegister(e);
 });
@@ -91,6 +101,7 @@ const checkLoggedIn = () => {
 document.addEventListener('DOMContentLoaded', function () {
   checkLoggedIn();
   loadPosts();
+  handleEmailLink();
 });
 
 
@@ -101,12 +112,14 @@ export function logged(bool, user) {
     document.getElementById('showLogin').classList.add('hidden');
     document.getElementById('showRegister').classList.add('hidden');
     document.getElementById('logoutBtn').classList.remove('hidden');
+    document.getElementById('twoFactorBtn').classList.remove('hidden');
     document.getElementById('createPostForm').classList.remove('hidden');
   } else {
     document.getElementById('usernameDisplay').textContent = ""
     document.getElementById('showLogin').classList.remove('hidden');
     document.getElementById('showRegister').classList.remove('hidden');
     document.getElementById('logoutBtn').classList.add('hidden');
+    document.getElementById('twoFactorBtn').classList.add('hidden');
     document.getElementById('createPostForm').classList.add('hidden');
   }
 }
\ No newline at end of file
@@ -1,17 +1,31 @@
 import { logged, showSection } from './app.js';
+import * as groupApi from './groups.js';
 
+// Chats are keyed by the other user's nickname, or by the group id, a number,
+// for group chats
 const unreadCounts = new Map() // Messages unread
-const chatCache = new Map() // Cache messages per user
+const conversations = new Map() // Sidebar entries
+const chatCache = new Map() // Cache messages per chat
+const historyComplete = new Set() // Chats whose whole history is cached
+const groups = new Map() // group id -> group with its members
+let invites = [] // Group invites waiting for an answer
+const typingIn = new Map() // chat -> names typing there
 let socket = null //Websocket connection
-let selectedUser = null // Active chat now
+let selectedChat = null // Active chat now
 let currentUser = null // Logged username
 
-let chatPage = 0
 const messagePerPage = 10
+let nextCursor = null // id of the oldest loaded message in the open chat
 let isFetching = false
 let noMoreMessages = false
 let chatContainer = null
-let newMessages = 0
+
+// Websocket protocol, see backend/Protocol.go
+const PROTOCOL_VERSION = 1
+let frameCounter = 0
+const pendingMessages = new Map() // client id -> message waiting for its ack
+let lastSeq = 0 // highest message seq seen, resumed from after reconnecting
+let reconnectDelay = 1000
 
 // Typing indicator variables
 let typingTimeout = null
@@ -39,33 +53,37 @@ const debounce = (fn, delay) => {
   }
 }
 
-async function loadMessagesPage(from, to, page) {
-  const offset = page * messagePerPage
+async function loadMessagesPage(from, to) {
+  if (!nextCursor) {
+    noMoreMessages = true
+    isFetching = false
+    return
+  }
   const loader = document.getElementById("chatLoader")
   const minDisplayTime = 500 // milliseconds
   const start = Date.now()
   if (loader) loader.classList.remove("hidden")
 
   try {
-    const res = await fetch(`/messages?from=${from}&to=${to}&offset=${offset + newMessages}`)
+    const res = await fetch(`/messages?${historyQuery(to)}&before=${nextCursor}&limit=${messagePerPage}`)
     if (!res.ok) throw new Error("Failed to load chat messages")
-    const messages = await res.json()
-    if (messages.length === 0) {
-      noMoreMessages = true
-    } else {
+    const page = await res.json()
+    const messages = page.messages // oldest first
+    noMoreMessages = !page.has_more
+    nextCursor = page.next_cursor
+    if (noMoreMessages) historyComplete.add(to)
+    if (messages.length > 0) {
       const container = document.getElementById("chatMessages")
       const oldScrollHeight = container.scrollHeight
       const oldScrollTop = container.scrollTop
-      const sortedMessages = messages.sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp))
-      sortedMessages.reverse().forEach(msg => renderMessageAtTop(msg))
+      messages.slice().reverse().forEach(msg => renderMessageAtTop(msg))
 
       const newScrollHeight = container.scrollHeight
       const heightDifference = newScrollHeight - oldScrollHeight
       container.scrollTop = oldScrollTop + heightDifference
 
       const cached = chatCache.get(to) || []
-      const chronologicalMessages = messages.sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp))
-      chatCache.set(to, [...chronologicalMessages, ...cached])
+      chatCache.set(to, [...messages, ...cached])
     }
   } catch (err) {
     console.error("Pagination error:", err)
@@ -91,319 +109,700 @@ async function loadMessagesPage(from, to, page) {
   }
 }
 
+// The /messages parameter selecting a chat
+function historyQuery(chat) {
+  return typeof chat === "number" ? `group=${chat}` : `with=${encodeURIComponent(chat)}`
+}
+
+function chatOf(msg) {
+  return msg.group_id || (msg.from === currentUser ? msg.to : msg.from)
+}
+
 // loading old msg when scroll up 
 const renderMessageAtTop = (msg) => {
   const container = document.getElementById("chatMessages")
+  container.insertBefore(messageElement(msg), container.firstChild)
+}
+
+function messageElement(msg) {
   const div = document.createElement("div")
+  div.className = "message"
+  if (msg.id) div.dataset.messageId = msg.id
   div.innerHTML = `
     <p><strong>${msg.from}</strong>: ${msg.content}<br/>
-    <small>${new Date(msg.timestamp).toLocaleTimeString()}</small></p>
+    <small>${new Date(msg.timestamp).toLocaleTimeString()}</small>
+    <small class="receipt"></small></p>
   `;
-  container.insertBefore(div, container.firstChild)
+  msg.element = div
+  updateReceiptMark(msg)
+  return div
+}
+
+// Ticks on our own messages: one when stored, two when delivered, blue when read
+function updateReceiptMark(msg) {
+  if (!msg.element || msg.from !== currentUser) return
+  const mark = msg.element.querySelector(".receipt")
+  if (!msg.id) {
+    mark.textContent = ""
+  } else if (msg.read_at) {
+    mark.textContent = "✓✓"
+    mark.classList.add("read")
+  } else if (msg.delivered_at) {
+    mark.textContent = "✓✓"
+  } else {
+    mark.textContent = "✓"
+  }
+}
+
+function applyReceipt(receipt) {
+  const chatKey = receipt.from === currentUser ? receipt.to : receipt.from
+  const cached = chatCache.get(chatKey) || []
+  cached.forEach(msg => {
+    if (!msg.id || msg.from !== receipt.from) return
+    if (receipt.status === "read" && msg.id <= receipt.id && !msg.read_at) {
+      msg.read_at = receipt.at
+      msg.delivered_at = msg.delivered_at || receipt.at
+    } else if (receipt.status === "delivered" && msg.id === receipt.id) {
+      msg.delivered_at = receipt.at
+    } else {
+      return
+    }
+    updateReceiptMark(msg)
+  })
+}
+
+function sendReceipt(msg, status) {
+  if (!socket || !msg.id) return
+  // Groups only keep track of what each member has read
+  if (msg.group_id) {
+    if (status === "read") sendFrame('receipt', { id: msg.id, group_id: msg.group_id, status })
+    return
+  }
+  sendFrame('receipt', { id: msg.id, status })
+}
+
+// Mark everything the others sent in this conversation as read
+function markConversationRead(chat) {
+  const cached = chatCache.get(chat) || []
+  const last = [...cached].reverse().find(msg => msg.from !== currentUser && msg.id)
+  if (!last) return
+  if (typeof chat === "number" ? unreadCounts.get(chat) : !last.read_at) sendReceipt(last, "read")
+}
+
+// Wrap a payload in the protocol envelope and send it, returns the frame id
+// or null while disconnected
+function sendFrame(type, payload) {
+  if (!socket || socket.readyState !== WebSocket.OPEN) return null
+  const id = `c-${Date.now()}-${++frameCounter}`
+  socket.send(JSON.stringify({ type, id, version: PROTOCOL_VERSION, payload }))
+  return id
+}
+
+// The recipient of a frame about the given chat
+function addressOf(chat) {
+  return typeof chat === "number" ? { group_id: chat } : { to: chat }
 }
 
 // Function to send typing status
 function sendTypingStatus(isTypingNow) {
-  if (!socket || !selectedUser) return
-  
-  const typingMessage = {
-    type: 'typing',
-    from: currentUser,
-    to: selectedUser,
+  if (!socket || !selectedChat) return
+
+  sendFrame('typing', {
+    ...addressOf(selectedChat),
     isTyping: isTypingNow
-  }
-  
-  socket.send(JSON.stringify(typingMessage))
+  })
+}
+
+function setTyping(chat, name, typing) {
+  const names = typingIn.get(chat) || new Set()
+  if (typing) names.add(name)
+  else names.delete(name)
+  typingIn.set(chat, names)
+  if (chat === selectedChat) showTypingIndicator()
+}
+
+// "Alice is typing", "Alice and Bob are typing", "Alice and 2 others are typing"
+function typingText(names) {
+  if (names.length === 1) return `${names[0]} is typing`
+  if (names.length === 2) return `${names[0]} and ${names[1]} are typing`
+  return `${names[0]} and ${names.length - 1} others are typing`
 }
 
-// Function to show/hide typing indicator
-function showTypingIndicator(username, show) {
+// Show who is typing in the open chat, or nothing
+function showTypingIndicator() {
   const container = document.getElementById("chatMessages")
   let typingIndicator = document.getElementById("typingIndicator")
-  
-  if (show && !typingIndicator) {
+  const names = [...(typingIn.get(selectedChat) || [])]
+
+  if (names.length === 0) {
+    if (typingIndicator) typingIndicator.remove()
+    return
+  }
+  if (!typingIndicator) {
     typingIndicator = document.createElement("div")
     typingIndicator.id = "typingIndicator"
     typingIndicator.className = "typing-indicator"
-    typingIndicator.innerHTML = `
-      <p><em>${username} is typing</em>
-        <span class="typing-dots">
-          <span>.</span><span>.</span><span>.</span>
-        </span>
-      </p>
-    `
     container.appendChild(typingIndicator)
     container.scrollTop = container.scrollHeight
-  } else if (!show && typingIndicator) {
-    typingIndicator.remove()
   }
+  typingIndicator.innerHTML = `
+    <p><em>${typingText(names)}</em>
+      <span class="typing-dots">
+        <span>.</span><span>.</span><span>.</span>
+      </span>
+    </p>
+  `
 }
 
-// real time connexion using websockets, listens for msg, update
-export function startChatFeature(currentUsername) {
-  currentUser = currentUsername
+// Open the websocket and resume from the last seq seen. A dropped connection
+// is retried with a growing delay for as long as the session is valid.
+function connect() {
   socket = new WebSocket("ws://" + window.location.host + "/ws")
-
-  socket.addEventListener("message", (event) => {
-    const data = JSON.parse(event.data)
-    if (data.type === "user_list") {
-      setUserList(data.users)
-    } else if (data.type === "typing") {
-      // Handle typing indicator
-      if (data.from === selectedUser) {
-        showTypingIndicator(data.from, data.isTyping)
-      }
-    } else {
-      // Hide typing indicator when message is received
-      if (data.from === selectedUser) {
-        showTypingIndicator(data.from, false)
-      }
-      
-      newMessages++
-      if (data.from === selectedUser || data.to === selectedUser) {
-        renderMessage(data)
-        const chatKey = data.from === currentUser ? data.to : data.from
-        const cached = chatCache.get(chatKey) || []
-        chatCache.set(chatKey, [...cached, data])
-      } else if (data.to === currentUser) {
-        notification(data.to, data.from,1)
-      }
+  socket.addEventListener("open", () => {
+    reconnectDelay = 1000
+    sendFrame('resume', { seq: lastSeq })
+  })
+  socket.addEventListener("message", handleFrame)
+  socket.addEventListener("close", (event) => {
+    socket = null
+    // Logged out elsewhere, revoked or expired
+    if (event.reason === 'session revoked') {
+      window.location.reload()
+      return
+    }
+    const retry = () => {
+      setTimeout(connect, reconnectDelay)
+      reconnectDelay = Math.min(reconnectDelay * 2, 30000)
     }
+    fetch('/logged', { credentials: 'include' })
+      .then(res => {
+        if (res.ok) retry()
+      })
+      .catch(retry)
   })
+}
+
+// The server's state after a resume replaces whatever we had
+function applyResumed(frame) {
+  const data = frame.payload
+  lastSeq = data.seq
+  if (data.has_more) {
+    sendFrame('resume', { seq: lastSeq })
+    return
+  }
+  typingIn.clear()
+  data.typing.forEach(name => setTyping(name, name, true))
+  for (const [group, names] of Object.entries(data.group_typing)) {
+    names.forEach(name => setTyping(Number(group), name, true))
+  }
+  showTypingIndicator()
+  for (const chat of unreadCounts.keys()) {
+    unreadCounts.set(chat, 0)
+  }
+  data.unread.forEach(notif => unreadCounts.set(notif.group_id || notif.sender_nickname, notif.unread_messages))
+  loadGroups()
+  loadConversations()
+  // Anything unacknowledged may or may not have been stored, the client id
+  // keeps it from being stored twice
+  pendingMessages.forEach(sendPending)
+}
+
+function sendPending(msg) {
+  sendFrame('message', { ...addressOf(chatOf(msg)), content: msg.content, client_id: msg.client_id })
+}
+
+// The stored copy of one of our messages arrived, as an ack or a replay
+function confirmMessage(stored) {
+  const msg = pendingMessages.get(stored.client_id)
+  if (!msg) return false
+  pendingMessages.delete(stored.client_id)
+  msg.id = stored.id
+  msg.timestamp = stored.timestamp
+  if (msg.element) msg.element.dataset.messageId = msg.id
+  updateReceiptMark(msg)
+  return true
+}
+
+function newClientId() {
+  return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2, 10)}`
+}
+
+// real time connexion using websockets, listens for msg, update
+export function startChatFeature(currentUsername) {
+  currentUser = currentUsername
+  connect()
+  loadUnreadCounts()
+  loadGroups()
+  loadInvites()
+  loadConversations()
 
   const sendBtn = document.getElementById("sendBtn")
   const input = document.getElementById("messageInput")
   if (sendBtn && input) {
-    
-    // Add typing event listeners
-    const handleTyping = debounce(() => {
-      if (isTyping) {
-        isTyping = false
-        sendTypingStatus(false)
-      }
-    }, 1000) // Stop typing after 1 second of inactivity
-
-    input.addEventListener('input', () => {
-      if (!isTyping && input.value.trim().length > 0) {
-        isTyping = true
-        sendTypingStatus(true)
-      } else if (isTyping && input.value.trim().length === 0) {
-        isTyping = false
-        sendTypingStatus(false)
-        return
-      }
-      
-      if (input.value.trim().length > 0) {
-        handleTyping()
-      }
-    })
+    setupInput(sendBtn, input)
+  }
+}
 
-    // Stop typing on blur
-    input.addEventListener('blur', () => {
-      if (isTyping) {
-        isTyping = false
-        sendTypingStatus(false)
-      }
-    })
+function handleFrame(event) {
+  const frame = JSON.parse(event.data)
+  const data = frame.payload
+  if (frame.type === "resumed") {
+    applyResumed(frame)
+  } else if (frame.type === "user_list") {
+    setOnlineUsers(data.users)
+  } else if (frame.type === "conversation") {
+    updateConversation(data)
+    renderUserList()
+  } else if (frame.type === "typing") {
+    // Our own other tabs are told as well
+    if (data.from !== currentUser) {
+      setTyping(data.group_id || data.from, data.from, data.isTyping)
+    }
+  } else if (frame.type === "group") {
+    applyGroup(data)
+  } else if (frame.type === "group_invite") {
+    invites = [...invites.filter(invite => invite.group_id !== data.group_id), data]
+    renderUserList()
+  } else if (frame.type === "ack") {
+    if (data.seq) lastSeq = Math.max(lastSeq, data.seq)
+    confirmMessage(data.message)
+  } else if (frame.type === "receipt") {
+    applyReceipt(data)
+  } else if (frame.type === "error") {
+    console.error("Chat error:", data.code, data.message)
+  } else if (frame.type === "message") {
+    if (data.seq) lastSeq = Math.max(lastSeq, data.seq)
+    const chatKey = chatOf(data)
+    const cached = chatCache.get(chatKey) || []
+    // A resume may replay a message that was already delivered, or one
+    // of ours that is still waiting for its ack
+    if (data.client_id && confirmMessage(data)) return
+    if (cached.some(msg => msg.id === data.id)) return
+
+    // Hide typing indicator when message is received
+    setTyping(chatKey, data.from, false)
+
+    if (data.from !== currentUser) {
+      sendReceipt(data, chatKey === selectedChat ? "read" : "delivered")
+    }
+    if (chatKey === selectedChat) {
+      renderMessage(data)
+      chatCache.set(chatKey, [...cached, data])
+    }
+  } else if (frame.type === "unread") {
+    updateNotificationBadge(data)
+  }
+}
 
-    const sendMessage = () => {
-      // Stop typing indicator when sending
-      if (isTyping) {
-        isTyping = false
-        sendTypingStatus(false)
-      }
-      
-      fetch('/logged', {
-        credentials: 'include'
-      })
-        .then(res => {
-          if (!res.ok) throw new Error('Not logged in')
-          return res.json()
-        })
-        .then(() => {
-          const content = input.value.trim();
-          if (!content || !selectedUser) return;
-
-          const message = {
-            to: selectedUser,
-            from: currentUser,
-            content: content,
-            timestamp: new Date().toISOString(),
-          }
-          socket.send(JSON.stringify(message))
-          renderMessage(message)
-          const cached = chatCache.get(selectedUser) || []
-          chatCache.set(selectedUser, [...cached, message])
-          input.value = ""
-        })
-        .catch(() => {
-          logged(false)
-          showSection('loginSection')
-          document.getElementById("chatWindow").classList.add('hidden')
-        })
+function setupInput(sendBtn, input) {
+  // Add typing event listeners
+  const handleTyping = debounce(() => {
+    if (isTyping) {
+      isTyping = false
+      sendTypingStatus(false)
+    }
+  }, 1000) // Stop typing after 1 second of inactivity
+
+  // The server expires indicators it has not heard about for a while,
+  // so keep reminding it while the user is still typing
+  const keepTyping = throttle(() => sendTypingStatus(true), 2000)
+
+  input.addEventListener('input', () => {
+    if (!isTyping && input.value.trim().length > 0) {
+      isTyping = true
+      sendTypingStatus(true)
+    } else if (isTyping && input.value.trim().length > 0) {
+      keepTyping()
+    } else if (isTyping && input.value.trim().length === 0) {
+      isTyping = false
+      sendTypingStatus(false)
+      return
     }
     
-    sendBtn.addEventListener("click", sendMessage);
+    if (input.value.trim().length > 0) {
+      handleTyping()
+    }
+  })
+
+  // Stop typing on blur
+  input.addEventListener('blur', () => {
+    if (isTyping) {
+      isTyping = false
+      sendTypingStatus(false)
+    }
+  })
+
+  const sendMessage = () => {
+    // Stop typing indicator when sending
+    if (isTyping) {
+      isTyping = false
+      sendTypingStatus(false)
+    }
     
-    // Send on Enter key
-    input.addEventListener('keypress', (e) => {
-      if (e.key === 'Enter') {
-        sendMessage()
-      }
+    fetch('/logged', {
+      credentials: 'include'
     })
+      .then(res => {
+        if (!res.ok) throw new Error('Not logged in')
+        return res.json()
+      })
+      .then(() => {
+        const content = input.value.trim();
+        if (!content || !selectedChat) return;
+
+        const message = {
+          ...addressOf(selectedChat),
+          from: currentUser,
+          content: content,
+          timestamp: new Date().toISOString(),
+          client_id: newClientId(),
+        }
+        // Sent now if connected, otherwise once the socket has resumed
+        pendingMessages.set(message.client_id, message)
+        sendPending(message)
+        renderMessage(message)
+        const cached = chatCache.get(selectedChat) || []
+        chatCache.set(selectedChat, [...cached, message])
+        input.value = ""
+      })
+      .catch(() => {
+        logged(false)
+        showSection('loginSection')
+        document.getElementById("chatWindow").classList.add('hidden')
+      })
   }
+  
+  sendBtn.addEventListener("click", sendMessage);
+  
+  // Send on Enter key
+  input.addEventListener('keypress', (e) => {
+    if (e.key === 'Enter') {
+      sendMessage()
+    }
+  })
 }
 
 function renderMessage(msg) {
   const container = document.getElementById("chatMessages")
-  const div = document.createElement("div")
-  div.innerHTML = `
-    <p><strong>${msg.from}</strong>: ${msg.content}<br/>
-    <small>${new Date(msg.timestamp).toLocaleTimeString()}</small></p>
-  `;
-  container.appendChild(div)
+  container.appendChild(messageElement(msg))
   container.scrollTop = container.scrollHeight
 }
 
-function setUserList(users) {
+// Sidebar entries keyed by chat, loaded from /conversations and then
+// kept up to date by conversation and user_list frames
+function loadConversations() {
+  fetch("/conversations", { credentials: "include" })
+    .then(res => {
+      if (!res.ok) throw new Error("Failed to load conversations")
+      return res.json()
+    })
+    .then(list => {
+      conversations.clear()
+      list.forEach(updateConversation)
+      renderUserList()
+    })
+    .catch(err => console.error(err))
+}
+
+function updateConversation(conversation) {
+  const chat = conversation.group_id || conversation.nickname
+  conversations.set(chat, conversation)
+  unreadCounts.set(chat, conversation.unread_messages)
+}
+
+function loadGroups() {
+  groupApi.listGroups()
+    .then(list => {
+      groups.clear()
+      list.forEach(group => groups.set(group.id, group))
+      if (typeof selectedChat === "number") renderChatHeader()
+    })
+    .catch(err => console.error(err))
+}
+
+function loadInvites() {
+  groupApi.listInvites()
+    .then(list => {
+      invites = list
+      renderUserList()
+    })
+    .catch(err => console.error(err))
+}
+
+// A group changed, a group we are no longer in goes away
+function applyGroup(group) {
+  if (!group.members.includes(currentUser)) {
+    groups.delete(group.id)
+    conversations.delete(group.id)
+    unreadCounts.delete(group.id)
+    if (selectedChat === group.id) closeChat()
+    renderUserList()
+    return
+  }
+  groups.set(group.id, group)
+  if (!conversations.has(group.id)) loadConversations()
+  if (selectedChat === group.id) renderChatHeader()
+}
+
+function setOnlineUsers(users) {
+  const online = new Set(users)
+  conversations.forEach(conversation => {
+    if (!conversation.group_id) conversation.online = online.has(conversation.nickname)
+  })
+  renderUserList()
+}
+
+function titleOf(conversation) {
+  return conversation.group_id ? conversation.name : conversation.nickname
+}
+
+function sidebarEntry(text) {
+  const div = document.createElement("div")
+  div.className = "user"
+  div.style.display = "flex"
+  div.style.justifyContent = "space-between"
+  div.style.alignItems = "center"
+  div.style.cursor = "pointer"
+  div.style.padding = "5px"
+  div.style.borderBottom = "1px solid #ddd"
+  const nameSpan = document.createElement("span")
+  nameSpan.textContent = text
+  div.appendChild(nameSpan)
+  return div
+}
+
+function iconButton(icon, title, onClick) {
+  const button = document.createElement("i")
+  button.className = `fa-solid ${icon}`
+  button.title = title
+  button.style.cursor = "pointer"
+  button.style.marginLeft = "8px"
+  button.addEventListener("click", (e) => {
+    e.stopPropagation()
+    onClick()
+  })
+  return button
+}
+
+// Group actions report failures the same way
+function groupAction(promise) {
+  return promise.catch(err => alert(err.message))
+}
+
+function newGroup() {
+  const name = prompt("Group name")
+  if (!name || !name.trim()) return
+  groupAction(groupApi.createGroup(name.trim()).then(group => {
+    groups.set(group.id, group)
+    conversations.set(group.id, { group_id: group.id, name: group.name, unread_messages: 0 })
+    openChat(group.id)
+  }))
+}
+
+function answerInvite(invite, accepted) {
+  const answer = accepted ? groupApi.accept(invite.group_id) : groupApi.decline(invite.group_id)
+  groupAction(answer.then(() => {
+    invites = invites.filter(other => other.group_id !== invite.group_id)
+    if (accepted) loadConversations()
+    renderUserList()
+  }))
+}
+
+// Invites and a button for a new group on top, then the most recent
+// conversation first and everyone else alphabetically
+function renderUserList() {
   const list = document.getElementById("userList")
   list.innerHTML = ""
-  users.forEach((username) => {
-    if (username === currentUser) return
-
-    const div = document.createElement("div")
-    div.className = "user"
-    div.style.display = "flex"
-    div.style.justifyContent = "space-between"
-    div.style.alignItems = "center"
-    div.style.cursor = "pointer"
-    div.style.padding = "5px"
-    div.style.borderBottom = "1px solid #ddd"
-    const nameSpan = document.createElement("span")
-    nameSpan.textContent = username
-    const statusSpan = document.createElement("span")
-    statusSpan.classList.add("status", "online")
-    div.appendChild(nameSpan)
-    div.appendChild(statusSpan)
-    notification(currentUser, username)
-    div.addEventListener("click", async () => {
-      // Reset typing status when switching chats
-      if (isTyping) {
-        isTyping = false
-        sendTypingStatus(false)
-      }
-      
-      chatPage = 0
-      noMoreMessages = false
-      chatContainer = document.getElementById("chatMessages")
-      const existingHandler = chatContainer.scrollHandler
-      if (existingHandler) {
-        chatContainer.removeEventListener("scroll", existingHandler)
-      }
 
-      const scrollHandler = throttle(async () => {
-        const isNearTop = chatContainer.scrollTop <= 100
-        const isAtTop = chatContainer.scrollTop === 0
+  const create = sidebarEntry("New group")
+  create.appendChild(iconButton("fa-users", "New group", newGroup))
+  create.addEventListener("click", newGroup)
+  list.appendChild(create)
+
+  invites.forEach(invite => {
+    const div = sidebarEntry(`${invite.name} (invited by ${invite.invited_by})`)
+    const actions = document.createElement("span")
+    actions.appendChild(iconButton("fa-check", "Join", () => answerInvite(invite, true)))
+    actions.appendChild(iconButton("fa-xmark", "Decline", () => answerInvite(invite, false)))
+    div.appendChild(actions)
+    list.appendChild(div)
+  })
 
-        if ((isNearTop || isAtTop) && !isFetching && !noMoreMessages) {
-          isFetching = true
-          chatPage += 1
-          await loadMessagesPage(currentUser, selectedUser, chatPage)
-        }
-      }, 200)
-      chatContainer.scrollHandler = scrollHandler
-      chatContainer.addEventListener("scroll", scrollHandler)
-      selectedUser = username
-      document.getElementById("chatWithName").textContent = username
-      document.getElementById("chatWindow").classList.remove("hidden")
-      document.getElementById("chatMessages").innerHTML = ""
-
-      const badge = div.querySelector(".notification-badge")
-      if (badge) badge.remove()
-
-      // close chat button 
-      const closeChatBtn = document.getElementById("closeChatBtn")
-      if (closeChatBtn) {
-        closeChatBtn.onclick = () => {
-          // Reset typing when closing chat
-          if (isTyping) {
-            isTyping = false
-            sendTypingStatus(false)
-          }
-          document.getElementById("chatWindow").classList.add("hidden")
-          selectedUser = null;
-          document.getElementById("chatWithName").textContent = ""
-        }
-      }
-      notification(currentUser, username, 0)
-      const cachedMessages = chatCache.get(username)
-      if (cachedMessages) {
-        const sortedCached = [...cachedMessages].sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp))
-        sortedCached.forEach(renderMessage)
-      } else {
-        try {
-          chatPage = 0
-          noMoreMessages = false
-          const res = await fetch(`/messages?from=${currentUser}&to=${selectedUser}&offset=0`)
-          if (!res.ok) throw new Error("Failed to load chat history")
-          const messages = await res.json()
-          const sortedMessages = messages.sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp))
-          chatCache.set(selectedUser, sortedMessages)
-          sortedMessages.forEach(renderMessage)
-        } catch (err) {
-          console.error("Chat history error:", err)
-        }
-      }
-    })
+  const sorted = [...conversations.values()].sort((a, b) =>
+    (b.last_message_id || 0) - (a.last_message_id || 0) ||
+    titleOf(a).toLowerCase().localeCompare(titleOf(b).toLowerCase()))
+
+  sorted.forEach((conversation) => {
+    const chat = conversation.group_id || conversation.nickname
+    if (chat === currentUser) return
+
+    const div = sidebarEntry(titleOf(conversation))
+    div.chat = chat
+    if (conversation.last_message) {
+      div.title = `${conversation.last_sender}: ${conversation.last_message}`
+    }
+    if (conversation.group_id) {
+      const icon = document.createElement("i")
+      icon.className = "fa-solid fa-users"
+      div.appendChild(icon)
+    } else {
+      const statusSpan = document.createElement("span")
+      statusSpan.classList.add("status")
+      if (conversation.online) statusSpan.classList.add("online")
+      div.appendChild(statusSpan)
+    }
+    renderBadge(div, chat === selectedChat ? 0 : unreadCounts.get(chat) || 0)
+    div.addEventListener("click", () => openChat(chat))
 
     list.appendChild(div)
   })
 }
 
+// The open chat's title, for a group with its members and what we may do
+function renderChatHeader() {
+  const name = document.getElementById("chatWithName")
+  const actions = document.getElementById("chatActions")
+  actions.innerHTML = ""
+  if (typeof selectedChat !== "number") {
+    name.textContent = selectedChat || ""
+    return
+  }
+
+  const group = groups.get(selectedChat)
+  const conversation = conversations.get(selectedChat)
+  name.textContent = group ? `${group.name} (${group.members.join(", ")})` : conversation ? conversation.name : ""
+  if (!group) return
+  if (group.owner === currentUser) {
+    actions.appendChild(iconButton("fa-user-plus", "Invite", () => {
+      const nickname = prompt("Invite who?")
+      if (nickname && nickname.trim()) groupAction(groupApi.invite(group.id, nickname.trim()))
+    }))
+    actions.appendChild(iconButton("fa-user-minus", "Remove a member", () => {
+      const nickname = prompt("Remove who?")
+      if (nickname && nickname.trim()) groupAction(groupApi.remove(group.id, nickname.trim()))
+    }))
+  }
+  actions.appendChild(iconButton("fa-right-from-bracket", "Leave", () => {
+    if (confirm(`Leave ${group.name}?`)) groupAction(groupApi.leave(group.id))
+  }))
+}
+
+function closeChat() {
+  // Reset typing when closing chat
+  if (isTyping) {
+    isTyping = false
+    sendTypingStatus(false)
+  }
+  document.getElementById("chatWindow").classList.add("hidden")
+  selectedChat = null;
+  renderChatHeader()
+  renderUserList()
+}
+
+async function openChat(chat) {
+  // Reset typing status when switching chats
+  if (isTyping) {
+    isTyping = false
+    sendTypingStatus(false)
+  }
+
+  chatContainer = document.getElementById("chatMessages")
+  const existingHandler = chatContainer.scrollHandler
+  if (existingHandler) {
+    chatContainer.removeEventListener("scroll", existingHandler)
+  }
+
+  const scrollHandler = throttle(async () => {
+    const isNearTop = chatContainer.scrollTop <= 100
+    const isAtTop = chatContainer.scrollTop === 0
+
+    if ((isNearTop || isAtTop) && !isFetching && !noMoreMessages) {
+      isFetching = true
+      await loadMessagesPage(currentUser, selectedChat)
+    }
+  }, 200)
+  chatContainer.scrollHandler = scrollHandler
+  chatContainer.addEventListener("scroll", scrollHandler)
+  selectedChat = chat
+  renderChatHeader()
+  document.getElementById("chatWindow").classList.remove("hidden")
+  document.getElementById("chatMessages").innerHTML = ""
+
+  renderUserList()
+
+  // close chat button 
+  const closeChatBtn = document.getElementById("closeChatBtn")
+  if (closeChatBtn) {
+    closeChatBtn.onclick = closeChat
+  }
+  const cachedMessages = chatCache.get(chat)
+  if (cachedMessages) {
+    cachedMessages.forEach(renderMessage)
+    const oldest = cachedMessages.find(msg => msg.id)
+    nextCursor = oldest ? oldest.id : null
+    noMoreMessages = historyComplete.has(chat)
+  } else {
+    try {
+      nextCursor = null
+      noMoreMessages = false
+      const res = await fetch(`/messages?${historyQuery(chat)}&limit=${messagePerPage}`)
+      if (!res.ok) throw new Error("Failed to load chat history")
+      const page = await res.json()
+      nextCursor = page.next_cursor
+      noMoreMessages = !page.has_more
+      if (noMoreMessages) historyComplete.add(chat)
+      chatCache.set(chat, page.messages)
+      page.messages.forEach(renderMessage)
+    } catch (err) {
+      console.error("Chat history error:", err)
+    }
+  }
+  showTypingIndicator()
+  markConversationRead(chat)
+}
+
+// Unread counts come from the server, once on login and then pushed
+// whenever one changes
 function updateNotificationBadge(data) {
+  const chat = data.group_id || data.sender_nickname
+  unreadCounts.set(chat, data.unread_messages)
+
   const userList = document.getElementById("userList")
-  const users = userList.getElementsByClassName("user")
-  if (!userList || data.unread_messages == 0) return;
-
-  for (let div of users) {
-    const nameSpan = div.querySelector("span:first-child")
-    if (nameSpan && nameSpan.textContent === data.sender_nickname) {
-      let badge = div.querySelector(".notification-badge")
-
-      if (!badge) {
-        badge = document.createElement("span")
-        badge.classList.add("notification-badge")
-        div.appendChild(badge)
-      }
-      badge.textContent = data.unread_messages
+  if (!userList) return
+  for (let div of userList.getElementsByClassName("user")) {
+    if (div.chat === chat) {
+      // The open chat is being read right now
+      renderBadge(div, chat === selectedChat ? 0 : data.unread_messages)
     }
   }
 }
 
-function notification(receiver, sender, unread) {
-  const notifData = {
-    receiver_nickname: receiver,
-    sender_nickname: sender,
-    ...(unread != null && { unread_messages: unread })
-  };
+function renderBadge(div, count) {
+  let badge = div.querySelector(".notification-badge")
+  if (count === 0) {
+    if (badge) badge.remove()
+    return
+  }
+  if (!badge) {
+    badge = document.createElement("span")
+    badge.classList.add("notification-badge")
+    div.appendChild(badge)
+  }
+  badge.textContent = count
+}
 
-  fetch("/notification", {
-    method: "POST",
-    headers: {
-      "Content-Type": "application/json"
-    },
-    body: JSON.stringify(notifData)
-  })
+function loadUnreadCounts() {
+  fetch("/unread", { credentials: "include" })
     .then(res => {
       if (!res.ok) {
-        throw new Error("notif failed");
+        throw new Error("unread counts failed");
       }
       return res.json();
     })
-    .then(data => {
-      updateNotificationBadge(data)
+    .then(counts => {
+      counts.forEach(updateNotificationBadge)
     })
     .catch(err => {
       console.error(err);
     });
-}
\ No newline at end of file
+}
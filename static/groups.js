@@ -0,0 +1,13 @@
+import { request } from './api.js'
+
+// Group endpoints, see backend/Groups.go. Every call rejects with the
+// server's error text when the request fails.
+
+export const listGroups = () => request('GET', '/groups')
+export const listInvites = () => request('GET', '/groups/invites')
+export const createGroup = (name) => request('POST', '/groups', { name })
+export const invite = (groupId, nickname) => request('POST', '/groups/invite', { group_id: groupId, nickname })
+export const accept = (groupId) => request('POST', '/groups/accept', { group_id: groupId })
+export const decline = (groupId) => request('POST', '/groups/decline', { group_id: groupId })
+export const leave = (groupId) => request('POST', '/groups/leave', { group_id: groupId })
+export const remove = (groupId, nickname) => request('POST', '/groups/remove', { group_id: groupId, nickname })
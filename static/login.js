@@ -1,5 +1,6 @@
 import { showSection,logged } from './app.js';
 import { startChatFeature } from './chat.js';
+import { resendVerification } from './account.js';
 
 export function handleLogin(event) {
   event.preventDefault();
@@ -8,26 +9,48 @@ export function handleLogin(event) {
     password: document.getElementById("loginPassword").value
   };
 
-  fetch("/login", {
+  let message = "Invalid login"
+  let unverified = false
+  const post = (url, body) => fetch(url, {
     method: "POST",
     headers: {
       "Content-Type": "application/json"
     },
-    body: JSON.stringify(formData)
+    body: JSON.stringify(body)
   })
     .then(res => {
+      if (res.status === 429) {
+        message = `Too many failed logins, try again in ${res.headers.get("Retry-After")} seconds`
+      }
+      if (res.status === 403) {
+        unverified = true
+        message = "Confirm your email address first, the link is in the mail we sent when you registered"
+      }
       if (!res.ok) {
-        throw new Error("Registration failed");
+        throw new Error("Login failed");
       }
       return res.json();
     })
+
+  post("/login", formData)
+    .then(data => {
+      if (!data.two_factor) return data
+      // The password was right, enrolled users still need a code
+      const code = prompt("Enter the code from your authenticator app or a recovery code")
+      if (code === null) throw new Error("Login cancelled")
+      message = "Invalid code"
+      return post("/login/2fa", { challenge: data.challenge, code })
+    })
     .then(data => {
       startChatFeature(data.username);
       showSection('postsSection');
       logged(true,data.username);
     })
     .catch(err => {
-      alert("Invalid login")
+      alert(message)
+      if (unverified && confirm("Send the link again?")) {
+        resendVerification(formData.identifier)
+      }
       logged(false)
       console.error(err);
     });
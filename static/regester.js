@@ -59,6 +59,7 @@ export function handleRegister(event) {
       return res.text();
     })
     .then(data => {
+      alert("Welcome! We sent you an email to confirm your address.")
       showSection('loginSection');
     })
     .catch(err => {
@@ -0,0 +1,36 @@
+import { request } from './api.js'
+
+// Two-factor settings, see backend/TwoFactor.go. Codes are asked for and
+// shown with prompt and alert.
+export async function manageTwoFactor() {
+  try {
+    const status = await request('GET', '/2fa')
+    if (!status.enabled) {
+      if (!confirm('Two-factor authentication is off. Set it up now?')) return
+      const { secret, uri } = await request('POST', '/2fa/enroll')
+      const code = prompt(`Add this account to your authenticator app with the link\n${uri}\nor the key ${secret}, then enter the code it shows`)
+      if (code === null) return
+      const { recovery_codes } = await request('POST', '/2fa/confirm', { code })
+      showRecoveryCodes('Two-factor authentication is on.', recovery_codes)
+      return
+    }
+
+    const choice = prompt(`Two-factor authentication is on, ${status.recovery_codes_left} recovery codes left.\nType "off" to turn it off or "codes" for new recovery codes.`)
+    if (choice !== 'off' && choice !== 'codes') return
+    const code = prompt('Enter the code from your authenticator app or a recovery code')
+    if (code === null) return
+    if (choice === 'off') {
+      await request('POST', '/2fa/disable', { code })
+      alert('Two-factor authentication is off.')
+    } else {
+      const { recovery_codes } = await request('POST', '/2fa/recovery-codes', { code })
+      showRecoveryCodes('Your old recovery codes no longer work.', recovery_codes)
+    }
+  } catch (err) {
+    alert(err.message)
+  }
+}
+
+function showRecoveryCodes(intro, codes) {
+  alert(`${intro} Keep these recovery codes somewhere safe, each one works once:\n\n${codes.join('\n')}`)
+}